@@ -1,28 +1,92 @@
 package nixmq
 
 import (
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/lawnp/leafMQ/packets"
 )
 
 type Info struct {
-	BytesReceived      uint64
-	BytesSent          uint64
-	PacketsSent        uint64
-	PacketsReceived    uint64
-	Subscriptions      uint32
-	Clients            uint32
-	ClientDisconnected uint32
-	ClientConnected    uint32
+	BytesReceived              uint64
+	BytesSent                  uint64
+	PacketsSent                uint64
+	PacketsReceived            uint64
+	PacketsSentByType          [16]uint64 // indexed by packet type
+	PacketsReceivedByType      [16]uint64 // indexed by packet type
+	Subscriptions              uint32
+	Clients                    uint32
+	ClientDisconnected         uint32
+	ClientConnected            uint32
+	Connections                uint64    // total number of accepted connections
+	AuthFailures               uint64    // CONNECTs refused because of bad credentials or authorization
+	MessagesDropped            uint64    // messages dropped because the queue of an offline session was full
+	RetainedDropped            uint64    // retained messages evicted or refused because of the retained message limits
+	OutboundDropped            uint64    // messages dropped because the outbound queue of a slow client was full
+	SlowConsumerDisconnects    uint64    // clients disconnected because their outbound queue was full
+	Retransmissions            uint64    // unacknowledged packets resent while the client stayed connected
+	PacketsTooLarge            uint64    // packets refused because they exceed the maximum packet size
+	MessagesTooLarge           uint64    // messages dropped because they exceed the maximum packet size of the client
+	RefusedMaxConnections      uint64    // connections refused because the broker had its maximum number of connections open
+	RefusedListenerConnections uint64    // connections refused because the listener had its maximum number of connections open
+	RefusedConnectionsPerIP    uint64    // connections refused because of the maximum number of connections from an address
+	ConnectTimeouts            uint64    // connections closed because they didn't send a CONNECT in time
+	Started                    time.Time // time the broker was started
+	PublishFanout              Histogram // time spent delivering a PUBLISH to all subscribers
+	listeners                  sync.Map  // listener ID -> *ListenerInfo
+}
+
+// ListenerInfo holds connection statistics of a single listener
+type ListenerInfo struct {
+	Connections       uint64 // total accepted connections
+	ActiveConnections int64  // currently open connections
 }
 
 func (i *Info) AddPacketReceived(packet *packets.Packet) {
 	atomic.AddUint64(&i.PacketsReceived, 1)
 	atomic.AddUint64(&i.BytesReceived, uint64(packet.Size))
+	atomic.AddUint64(&i.PacketsReceivedByType[packet.FixedHeader.MessageType&0x0F], 1)
 }
 
-func (i *Info) AddPacketSent(n int64) {
+func (i *Info) AddPacketSent(packetType byte, n int64) {
 	atomic.AddUint64(&i.PacketsSent, 1)
 	atomic.AddUint64(&i.BytesSent, uint64(n))
+	atomic.AddUint64(&i.PacketsSentByType[packetType&0x0F], 1)
+}
+
+// Listener returns the statistics of the listener, creating them on first use
+func (i *Info) Listener(id string) *ListenerInfo {
+	li, _ := i.listeners.LoadOrStore(id, &ListenerInfo{})
+	return li.(*ListenerInfo)
+}
+
+// RangeListeners calls f for the statistics of every listener
+func (i *Info) RangeListeners(f func(id string, li *ListenerInfo)) {
+	i.listeners.Range(func(key, value any) bool {
+		f(key.(string), value.(*ListenerInfo))
+		return true
+	})
+}
+
+// upper bounds of the histogram buckets in seconds
+var histogramBuckets = [...]float64{0.00001, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// Histogram counts observed durations in fixed buckets, safe for concurrent use
+type Histogram struct {
+	buckets [len(histogramBuckets)]uint64
+	count   uint64
+	sum     uint64 // nanoseconds
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range histogramBuckets {
+		if seconds <= bound {
+			atomic.AddUint64(&h.buckets[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d.Nanoseconds()))
 }
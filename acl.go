@@ -0,0 +1,262 @@
+package nixmq
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// Access is the kind of access an ACL rule grants
+type Access byte
+
+const (
+	AccessDeny      Access = iota // deny publishing and subscribing
+	AccessRead                    // allow subscribing
+	AccessWrite                   // allow publishing
+	AccessReadWrite               // allow publishing and subscribing
+)
+
+var accessNames = map[string]Access{
+	"deny":      AccessDeny,
+	"read":      AccessRead,
+	"write":     AccessWrite,
+	"readwrite": AccessReadWrite,
+}
+
+type ErrInvalidACL struct {
+	Line   int
+	Reason string
+}
+
+func (e *ErrInvalidACL) Error() string {
+	return "invalid ACL on line " + strconv.Itoa(e.Line) + ": " + e.Reason
+}
+
+// ACLRule grants or denies access to topics matching a topic filter.
+// In patterns %u is replaced by the username and %c by the client ID.
+type ACLRule struct {
+	Username string // rule applies only to this user, empty for all users
+	ClientID string // rule applies only to this client, empty for all clients
+	Topic    string
+	Pattern  bool // substitute %u and %c in Topic
+	Access   Access
+}
+
+// ACL is a hook checking publish and subscribe access of clients against a list of rules.
+// Deny rules take precedence, topics not allowed by any rule are denied.
+type ACL struct {
+	HookBase
+	mu    sync.RWMutex
+	rules []ACLRule
+}
+
+func NewACL() *ACL {
+	return &ACL{}
+}
+
+func (a *ACL) ID() string {
+	return "acl"
+}
+
+func (a *ACL) Provides(event HookEvent) bool {
+	return event == OnACLCheck
+}
+
+func (a *ACL) Add(rule ACLRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = append(a.rules, rule)
+}
+
+// LoadACLFile reads ACL rules from a file, see ACL.Load for the format
+func LoadACLFile(path string) (*ACL, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	acl := NewACL()
+	if err := acl.Load(file); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Load replaces the rules with the ones read from r. The format is line based:
+//
+//	# comment
+//	topic read public/#         (applies to every client)
+//	user alice                  (following rules apply to username alice)
+//	topic readwrite alice/#
+//	client sensor-1             (following rules apply to client ID sensor-1)
+//	topic write sensors/1/#
+//	pattern readwrite home/%u/# (pattern applies to every client, %u and %c are substituted)
+//
+// The access level may be omitted and defaults to readwrite.
+func (a *ACL) Load(r io.Reader) error {
+	var rules []ACLRule
+	var username, clientID string
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "user":
+			if len(fields) != 2 {
+				return &ErrInvalidACL{line, "user needs a username"}
+			}
+			username, clientID = fields[1], ""
+		case "client":
+			if len(fields) != 2 {
+				return &ErrInvalidACL{line, "client needs a client ID"}
+			}
+			username, clientID = "", fields[1]
+		case "topic", "pattern":
+			rule, err := parseACLRule(fields)
+			if err != nil {
+				return &ErrInvalidACL{line, err.Error()}
+			}
+			if !rule.Pattern {
+				rule.Username = username
+				rule.ClientID = clientID
+			}
+			rules = append(rules, rule)
+		default:
+			return &ErrInvalidACL{line, "unknown keyword " + fields[0]}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = rules
+	return nil
+}
+
+func parseACLRule(fields []string) (ACLRule, error) {
+	rule := ACLRule{
+		Pattern: fields[0] == "pattern",
+		Access:  AccessReadWrite,
+	}
+
+	switch len(fields) {
+	case 2:
+		rule.Topic = fields[1]
+	case 3:
+		access, ok := accessNames[fields[1]]
+		if !ok {
+			return rule, errors.New("unknown access " + fields[1])
+		}
+		rule.Access = access
+		rule.Topic = fields[2]
+	default:
+		return rule, errors.New(fields[0] + " needs a topic filter")
+	}
+
+	if !packets.IsValidTopicFilter(rule.Topic) {
+		return rule, errors.New("invalid topic filter " + rule.Topic)
+	}
+	return rule, nil
+}
+
+// OnACLCheck returns true if the client may publish to the topic (write) or subscribe to the topic filter
+func (a *ACL) OnACLCheck(client *Client, topic string, write bool) bool {
+	// shared subscriptions are checked against the topic filter the group subscribes to
+	if _, filter, ok := packets.ParseSharedSubscription(topic); ok {
+		topic = filter
+	}
+
+	need := AccessRead
+	if write {
+		need = AccessWrite
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	allowed := false
+	for _, rule := range a.rules {
+		filter, ok := rule.filterFor(client)
+		if !ok || !aclCovers(filter, topic) {
+			continue
+		}
+		if rule.Access == AccessDeny {
+			return false
+		}
+		if rule.Access&need != 0 {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// filterFor returns the topic filter of the rule for the client, false if the rule does not apply to it
+func (r *ACLRule) filterFor(client *Client) (string, bool) {
+	if r.Username != "" && r.Username != client.Properties.Username {
+		return "", false
+	}
+	if r.ClientID != "" && r.ClientID != client.Properties.ClientID {
+		return "", false
+	}
+	if !r.Pattern {
+		return r.Topic, true
+	}
+
+	filter := r.Topic
+	for placeholder, value := range map[string]string{"%u": client.Properties.Username, "%c": client.Properties.ClientID} {
+		if !strings.Contains(filter, placeholder) {
+			continue
+		}
+		// values containing wildcards or separators would widen the pattern
+		if value == "" || strings.ContainsAny(value, "+#/") {
+			return "", false
+		}
+		filter = strings.ReplaceAll(filter, placeholder, value)
+	}
+	return filter, true
+}
+
+// aclCovers returns true if every topic matching filter also matches the rule's pattern.
+// For topic names without wildcards this is the same as topicMatches.
+func aclCovers(pattern string, filter string) bool {
+	patternLevels := splitTopic(pattern)
+	filterLevels := splitTopic(filter)
+
+	// [MQTT-4.7.2-1]
+	if strings.HasPrefix(filter, "$") && (patternLevels[0] == "#" || patternLevels[0] == "+") {
+		return false
+	}
+
+	for i, level := range patternLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+		switch {
+		case filterLevels[i] == "#":
+			return false
+		case level == "+":
+		case level != filterLevels[i]:
+			// a literal level does not cover a + in the filter
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(filterLevels)
+}
@@ -0,0 +1,106 @@
+package nixmq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testACL = `# everyone may read public topics except the secret one
+topic read public/#
+topic deny public/secret
+pattern readwrite home/%u/#
+
+user alice
+topic readwrite alice/#
+`
+
+// newACLBroker returns a broker with users alice and bob checked against testACL loaded from a file
+func newACLBroker(t *testing.T) (*Broker, *listeners.MemoryListener) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "acl")
+	if err := os.WriteFile(path, []byte(testACL), 0600); err != nil {
+		t.Fatalf("Failed to write ACL file: %v", err)
+	}
+	acl, err := LoadACLFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load ACL file: %v", err)
+	}
+
+	b, l := newTestBroker(t)
+	b.AllowAnonymous = false
+	addTestUser(t, b, "alice")
+	addTestUser(t, b, "bob")
+	b.AddHook(acl)
+	return b, l
+}
+
+// addTestUser adds the user with password "password", hashed at the lowest bcrypt cost to keep tests fast
+func addTestUser(t *testing.T, b *Broker, username string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	b.Users.AddHash(username, string(hash))
+}
+
+// connectUser connects an MQTT 5.0 client with the username as client ID and password "password"
+func connectUser(t *testing.T, l *listeners.MemoryListener, username string) *testClient {
+	t.Helper()
+	options := connectOptions(packets.MQTT5, username)
+	options.Username = username
+	options.Password = "password"
+	return connect(t, l, options)
+}
+
+func TestACL_Subscribe(t *testing.T) {
+	_, l := newACLBroker(t)
+	alice := connectUser(t, l, "alice")
+	bob := connectUser(t, l, "bob")
+
+	tests := []struct {
+		client *testClient
+		filter string
+		code   byte
+	}{
+		{alice, "alice/#", 0},
+		{bob, "alice/#", packets.NOT_AUTHORIZED_V5.Code},
+		{bob, "public/#", 0},
+		{bob, "public/secret", packets.NOT_AUTHORIZED_V5.Code},
+		{bob, "home/bob/lights", 0},
+		{bob, "home/alice/lights", packets.NOT_AUTHORIZED_V5.Code},
+		{bob, "home/+/lights", packets.NOT_AUTHORIZED_V5.Code},
+	}
+	for i, test := range tests {
+		suback := test.client.subscribe(uint16(i+1), test.filter, packets.SubscriptionOptions{QoS: 0})
+		if suback.ReasonCodes[0] != test.code {
+			t.Errorf("Expected reason code 0x%02X for %s, but got: 0x%02X", test.code, test.filter, suback.ReasonCodes[0])
+		}
+	}
+}
+
+func TestACL_Publish(t *testing.T) {
+	_, l := newACLBroker(t)
+	alice := connectUser(t, l, "alice")
+	alice.subscribe(1, "alice/#", packets.SubscriptionOptions{QoS: 0})
+	bob := connectUser(t, l, "bob")
+
+	// bob may read public topics but not publish to them or to the topics of alice
+	for _, topic := range []string{"public/news", "alice/inbox"} {
+		bob.send(newPublish(topic, "x", 1, false))
+		if puback := bob.expect(packets.PUBACK); puback.ReasonCode != packets.NOT_AUTHORIZED_V5.Code {
+			t.Errorf("Expected publish to %s to be refused, but got: 0x%02X", topic, puback.ReasonCode)
+		}
+	}
+	bob.publish("home/bob/lights", "on", 1, false)
+	alice.publish("alice/inbox", "note", 1, false)
+
+	alice.expectPublish("alice/inbox", "note")
+	alice.expectNothing(50 * time.Millisecond)
+}
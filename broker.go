@@ -7,32 +7,78 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lawnp/leafMQ/listeners"
 	"github.com/lawnp/leafMQ/packets"
+	"github.com/lawnp/leafMQ/storage"
 )
 
-const (
-	ProtocolVersion byte = 0x04
-)
+const Version = "0.2.0"
+
+// protocol levels the broker accepts on every listener
+var supportedProtocolVersions = map[byte]bool{
+	packets.MQTT31:  true,
+	packets.MQTT311: true,
+	packets.MQTT5:   true,
+}
 
 type Broker struct {
-	listeners     []listeners.Listener // listeners for incoming connections
-	clients       *Clients             // map of connected clients
-	Subscriptions *TopicTree           // tree of topics and their subscribers
-	Log           *log.Logger          // logger for logging messages
-	Info          *Info                // Information about the broker (bytes sent, number of clients, etc.)
-	Users         *Users               // map of users and their passwords (unencrypted in memory)
+	listeners            []listeners.Listener      // listeners for incoming connections
+	clients              *Clients                  // map of connected clients
+	Subscriptions        *TopicTree                // tree of topics and their subscribers
+	Log                  *log.Logger               // logger for logging messages
+	Info                 *Info                     // Information about the broker (bytes sent, number of clients, etc.)
+	Users                *Users                    // users and their password hashes
+	Hooks                *Hooks                    // hooks called on broker lifecycle events
+	SharedStrategy       SharedStrategy            // how messages are distributed among shared subscription group members
+	SysInterval          time.Duration             // how often statistics are published to $SYS topics, 0 disables them
+	DisconnectDenied     bool                      // disconnect clients publishing to denied topics instead of dropping the message
+	AllowAnonymous       bool                      // accept clients connecting without a username
+	MaxQueuedMessages    int                       // messages queued per session while it is offline or its inflight window is full, 0 for no limit
+	QueueQoS0            bool                      // also queue QoS 0 messages for offline sessions
+	QueueDropPolicy      DropPolicy                // which message is dropped when the queue of a session is full
+	MaxInflight          int                       // unacknowledged QoS 1 and 2 messages per client, further messages are queued, 0 for no limit
+	RetryInterval        time.Duration             // resend unacknowledged messages to connected MQTT 3.1 and 3.1.1 clients after this long, doubling after every retry, 0 only resends them when the session resumes
+	MaxRetries           int                       // retries before a client that doesn't acknowledge its messages is disconnected, 0 for no limit
+	Store                storage.Store             // durable storage of retained messages and persistent sessions, nil keeps them in memory only
+	MaxRetainedMessages  int                       // number of retained messages kept, 0 for no limit
+	MaxRetainedBytes     int                       // total size of the topics and payloads of retained messages, 0 for no limit
+	RetainedDropPolicy   DropPolicy                // whether the oldest retained message or the new one is dropped when a limit is reached
+	RetainedTTL          time.Duration             // lifetime of retained messages without a message expiry interval, 0 keeps them until cleared
+	MaxOutboundPackets   int                       // packets waiting to be written to a client before the slow consumer policy applies, 0 for no limit
+	SlowConsumerPolicy   SlowConsumerPolicy        // what happens when the outbound queue of a client is full
+	MaxOutboundBytes     int                       // total size of the packets waiting to be written to a client before the slow consumer policy applies, 0 for no limit
+	MaxPacketSize        uint32                    // largest packet accepted from connected clients, advertised to MQTT 5.0 clients, larger packets close the connection, 0 for the protocol maximum
+	MaxConnectPacketSize uint32                    // largest packet accepted before the client is connected, 0 for MaxPacketSize
+	ConnectTimeout       time.Duration             // how long a new connection may take to send its CONNECT before it is closed, 0 waits forever
+	MaxConnections       int                       // open connections, further connections are refused with CONNACK Server unavailable, 0 for no limit
+	MaxConnectionsPerIP  int                       // open connections from a single address, further connections are closed, 0 for no limit
+	listenerLimits       map[string]ListenerLimits // limits of listeners added with AddListenerWithLimits
+	connections          connectionCounts          // open connections counted against the connection limits
+	done                 chan struct{}             // closed when the broker is closed
+	closeOnce            sync.Once
 }
 
 // creates a new broker instance
 func New() *Broker {
 	return &Broker{
-		clients:       NewClients(),
-		Log:           initiateLog(),
-		Subscriptions: NewTopicTree(),
-		Info:          &Info{},
-		Users:         NewUsers(),
+		clients:              NewClients(),
+		Log:                  initiateLog(),
+		Subscriptions:        NewTopicTree(),
+		Info:                 &Info{},
+		Users:                NewUsers(),
+		Hooks:                new(Hooks),
+		SysInterval:          10 * time.Second,
+		MaxQueuedMessages:    1000,
+		MaxOutboundPackets:   1024,
+		MaxOutboundBytes:     16 << 20,
+		MaxPacketSize:        1 << 20,
+		MaxConnectPacketSize: 64 << 10,
+		ConnectTimeout:       10 * time.Second,
+		done:                 make(chan struct{}),
 	}
 }
 
@@ -60,13 +106,19 @@ func initiateLog() *log.Logger {
 
 func (b *Broker) Start() {
 	b.Log.Println("Starting broker")
-	b.Users.PopulateUsers() // testing purposes only
+	b.Info.Started = time.Now()
+
+	if b.Store != nil {
+		if err := b.restore(); err != nil {
+			b.Log.Println("Error restoring from storage:", err)
+		}
+	}
 
 	errChan := make(chan error)
 
 	for _, l := range b.listeners {
 		go func(l listeners.Listener) {
-			errChan <- l.Serve(b.BindClient)
+			errChan <- l.Serve(b.bindListener(l.ID()))
 		}(l)
 	}
 
@@ -76,13 +128,19 @@ func (b *Broker) Start() {
 		}
 	}()
 
+	if b.SysInterval > 0 {
+		go b.publishSys()
+	}
+
+	go b.expireRetained()
+
 	go b.handleCommands()
 }
 
 func (b *Broker) handleCommands() {
 	for {
-		var command string
-		fmt.Scanln(&command)
+		var command, arg string
+		fmt.Scanln(&command, &arg)
 
 		switch command {
 		case "clients":
@@ -97,46 +155,152 @@ func (b *Broker) handleCommands() {
 			}
 		case "info":
 			b.DisplayInfo()
+		case "retained":
+			if arg == "" {
+				arg = "#"
+			}
+			b.Log.Println("Retained messages matching", arg+":")
+			for _, message := range b.RetainedMessages(arg) {
+				b.Log.Println(message.Topic(), message.Size(), "bytes, stored", message.Stored.Format(time.RFC3339), "expires", formatExpiry(message.Expires))
+			}
+		case "purge":
+			if arg == "" {
+				b.Log.Println("Usage: purge <topic filter>")
+				continue
+			}
+			b.Log.Println("Purged", b.PurgeRetained(arg), "retained messages")
 		}
 	}
 }
 
+func formatExpiry(expires time.Time) string {
+	if expires.IsZero() {
+		return "never"
+	}
+	return expires.Format(time.RFC3339)
+}
+
 func (b *Broker) AddListener(listener listeners.Listener) {
 	b.listeners = append(b.listeners, listener)
 }
 
+// AddHook registers a hook, hooks are called in the order they were added
+func (b *Broker) AddHook(hook Hook) {
+	b.Hooks.Add(hook)
+	b.Log.Println("Added hook:", hook.ID())
+}
+
+// bindListener wraps BindClient to keep connection statistics of the listener
+func (b *Broker) bindListener(id string) listeners.BindFn {
+	li := b.Info.Listener(id)
+	return func(conn net.Conn) {
+		atomic.AddUint64(&li.Connections, 1)
+		atomic.AddInt64(&li.ActiveConnections, 1)
+		defer atomic.AddInt64(&li.ActiveConnections, -1)
+
+		b.bindClient(conn, id)
+	}
+}
+
+// BindClient serves the MQTT connection with the limits of the broker
 func (b *Broker) BindClient(conn net.Conn) {
+	b.bindClient(conn, "")
+}
+
+// bindClient serves a connection of the listener. Connections exceeding the limits of their address are closed
+// right away, those exceeding the limits of the broker or the listener are refused once they send their CONNECT.
+func (b *Broker) bindClient(conn net.Conn, listenerID string) {
+	limits := b.limits(listenerID)
+	address := remoteAddress(conn)
+	refusal, release := b.admitConnection(listenerID, address, limits)
+	defer release()
+
+	if refusal == refusedAddressLimit {
+		b.Log.Println("Too many connections from", address)
+		conn.Close()
+		return
+	}
+
 	client := NewClient(conn, b)
+	client.limits = limits
+	client.startWriter()
 	defer client.Close()
 
+	if b.ConnectTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(b.ConnectTimeout))
+	}
+
 	connectPacket, err := b.ReadConnect(client)
-	switch err.(type) {
+	if isTimeout(err) {
+		atomic.AddUint64(&b.Info.ConnectTimeouts, 1)
+		b.Log.Println("No CONNECT received in time from", address)
+		return
+	}
+
+	switch connectErr := err.(type) {
 	case nil:
 	case *packets.ErrWrongProtocolLevel:
 		b.sendConnack(client, packets.UNACCEPTABLE_PROTOCOL_VERSION, false)
 		return
-	case *packets.ErrWrongProtocolName:
+	case *packets.ErrMalformedConnect:
+		b.Log.Println("Packet format error:", err)
+		// MQTT 5.0 clients are told why the connection is refused, earlier versions are disconnected [MQTT-4.13.1-1]
+		if connectErr.ProtocolLevel == packets.MQTT5 {
+			client.Properties.ProtocolLevel = packets.MQTT5
+			b.sendConnack(client, packets.MALFORMED_PACKET, false)
+		}
+		return
+	default:
 		b.Log.Println("Packet format error:", err)
 		return
 	}
 
 	client.SetClientProperties(connectPacket.ConnectOptions)
 
+	if refusal != connectionAdmitted {
+		b.Log.Println("Refusing connection over the connection limit from", address)
+		b.sendConnack(client, packets.SERVER_UNAVAILABLE, false)
+		return
+	}
+
 	code := client.ValidateConnectionOptions()
-	sessionPresent := b.InheritSession(client)
+	if code == packets.ACCEPTED {
+		if err := b.Hooks.OnConnect(client, connectPacket); err != nil {
+			code = packets.NOT_AUTHORIZED
+		}
+	}
+	if code == packets.ACCEPTED {
+		code = b.authenticate(client, connectPacket)
+	}
+
+	// a refused connection must not take over the session of the connected client
+	sessionPresent := false
+	if code == packets.ACCEPTED {
+		sessionPresent = b.InheritSession(client)
+	}
 
 	b.sendConnack(client, code, sessionPresent)
 
+	if code == packets.BAD_USERNAME_OR_PASSWORD || code == packets.NOT_AUTHORIZED {
+		atomic.AddUint64(&b.Info.AuthFailures, 1)
+	}
+
 	if code != packets.ACCEPTED {
 		return
 	}
 
+	b.storeSession(client)
 	b.clients.Add(client)
 	client.RefreshKeepAlive()
 
 	if sessionPresent {
 		client.ResendPendingPackets()
 	}
+	b.sendQueued(client)
+
+	if b.RetryInterval > 0 && client.Properties.ProtocolLevel != packets.MQTT5 {
+		go client.retransmit()
+	}
 
 	err = client.ReadPackets()
 
@@ -144,6 +308,28 @@ func (b *Broker) BindClient(conn net.Conn) {
 		b.Log.Println("Error Reading connections:", err)
 		client.SendWill()
 	}
+
+	b.Hooks.OnDisconnect(client, err)
+}
+
+// authenticate accepts the client if any hook providing OnConnectAuthenticate or the Users list accepts its credentials.
+// The hooks run first, as they may set the identity of the client, e.g. from its certificate. If anonymous access
+// is allowed, clients without credentials that no hook accepted are accepted as anonymous clients, a rejected
+// password, such as an MQTT 5.0 token sent without a username, is never ignored.
+func (b *Broker) authenticate(client *Client, connectPacket *packets.Packet) packets.Code {
+	if b.Hooks.OnConnectAuthenticate(client, connectPacket) {
+		return packets.ACCEPTED
+	}
+
+	if client.Properties.Username == "" && client.Properties.Password == "" && b.AllowAnonymous {
+		return packets.ACCEPTED
+	}
+
+	if !b.Users.Authenticate(client.Properties.Username, client.Properties.Password) {
+		return packets.BAD_USERNAME_OR_PASSWORD
+	}
+
+	return packets.ACCEPTED
 }
 
 func (b *Broker) ReadConnect(client *Client) (*packets.Packet, error) {
@@ -155,34 +341,102 @@ func (b *Broker) ReadConnect(client *Client) (*packets.Packet, error) {
 	if fixedHeader.MessageType != packets.CONNECT {
 		return nil, fmt.Errorf("expected CONNECT packet, got %v", fixedHeader.MessageType)
 	}
+	if err := client.checkPacketSize(fixedHeader, client.limits.MaxConnectPacketSize); err != nil {
+		return nil, err
+	}
 
-	connect, err := packets.ParsePacket(fixedHeader, client.ConnByteReader)
+	// protocol level is read from the CONNECT packet itself
+	connect, err := packets.ParsePacket(fixedHeader, client.ConnByteReader, 0)
+	if err != nil {
+		return nil, err
+	}
 	b.Info.AddPacketReceived(connect)
-	return connect, err
+	return connect, nil
 }
 
 func (b *Broker) sendConnack(client *Client, code packets.Code, sesionPresent bool) {
 	connack := packets.NewConnack(code, sesionPresent)
+	connack.ProtocolVersion = client.Properties.ProtocolLevel
+
+	if connack.ProtocolVersion == packets.MQTT5 && code == packets.ACCEPTED {
+		connack.Properties = b.connackProperties(client)
+	}
+
 	// TODO check if client is still connected
 	client.Send(connack.Encode())
 }
 
+// connackProperties returns the MQTT 5.0 CONNACK properties advertising
+// the features this broker does not support [MQTT-3.2.2.3]
+func (b *Broker) connackProperties(client *Client) *packets.Properties {
+	unavailable := byte(0)
+	props := &packets.Properties{
+		SubscriptionIdentifierAvailable: &unavailable,
+	}
+
+	if client.Properties.AssignedClientID {
+		props.AssignedClientIdentifier = client.Properties.ClientID
+	}
+	if maximum := client.limits.MaxPacketSize; maximum > 0 {
+		props.MaximumPacketSize = &maximum
+	}
+
+	return props
+}
+
 // SendSubscribers sends a packet to all subscribers of a topic,
-// adjusting the QoS and encoding the packet before sending it.
+// adjusting the QoS and encoding the packet for each subscriber's protocol version.
 // If the packet has non-zero QoS, it adds it to the subscriber's
 // pending packets list before sending.
-func (b *Broker) SendSubscribers(packet *packets.Packet) {
+// publisher is the client that sent the packet, nil for will messages.
+func (b *Broker) SendSubscribers(packet *packets.Packet, publisher *Client) {
+	start := time.Now()
+	defer func() {
+		b.Info.PublishFanout.Observe(time.Since(start))
+	}()
+
 	subscribers := b.Subscriptions.GetSubscribers(packet.PublishTopic)
 
-	for client, maxQoS := range subscribers.getAll() {
-		packet.SetRightQoS(maxQoS)
-		buf := packet.EncodePublish()
+	publisherID := ""
+	if publisher != nil {
+		publisherID = publisher.Properties.ClientID
+	}
+	subscribers.selectShared(b.SharedStrategy, publisherID)
 
-		if packet.FixedHeader.Qos != 0 {
-			client.AddPendingPacket(packet)
+	message := newFanout(packet)
+	for client, opts := range subscribers.getAll() {
+		// [MQTT-3.8.3-3]
+		if opts.NoLocal && client == publisher {
+			continue
 		}
 
-		client.Send(buf)
+		b.deliver(client, message, opts, nil)
+	}
+	for _, member := range subscribers.shared {
+		b.deliver(member.client, message, member.opts, member.group)
+	}
+}
+
+// deliver sends the message to a single subscriber with the QoS and retain flag of its subscription.
+// group is the shared subscription group the subscriber was picked from, nil for other subscriptions.
+func (b *Broker) deliver(client *Client, message *fanout, opts packets.SubscriptionOptions, group *sharedGroup) {
+	// a subscription can be allowed while some of the topics it matches are denied
+	if !b.Hooks.OnACLCheck(client, message.packet.PublishTopic, false) {
+		return
+	}
+
+	qos := min(message.packet.FixedHeader.Qos, opts.QoS)
+	// [MQTT-3.3.1-9] and [MQTT-3.3.1-12]
+	retain := message.packet.FixedHeader.Retain && opts.RetainAsPublished
+	variant := message.variant(qos, retain, client.Properties.ProtocolLevel)
+
+	out := variant.packet
+	if qos > 0 {
+		out = variant.forSubscriber(client)
+	}
+
+	if b.send(client, out, variant.encoded, group) {
+		b.Hooks.OnMessageDelivered(client, out)
 	}
 }
 
@@ -191,6 +445,9 @@ func (b *Broker) SendSubscribers(packet *packets.Packet) {
 // Returns true if session inheritance is successful, and false otherwise.
 func (b *Broker) InheritSession(client *Client) bool {
 	if oldClient, ok := b.clients.Get(client.Properties.ClientID); ok {
+		// existing connection with the same ClientID is closed [MQTT-3.1.4-2]
+		oldClient.Disconnect(packets.SESSION_TAKEN_OVER)
+		b.Hooks.OnSessionTakeover(oldClient, client)
 
 		// if clean session is true, we need to take over the session
 		if client.Properties.CleanSession {
@@ -198,17 +455,19 @@ func (b *Broker) InheritSession(client *Client) bool {
 			return false
 		}
 
-		client.Session = oldClient.Session.ClonePendingPackets()
-
-		for topic, qos := range oldClient.Session.Subscriptions.getAll() {
+		for topic, opts := range oldClient.Session.Subscriptions.getAll() {
 			b.Subscriptions.Remove(topic, oldClient)
 			oldClient.Session.Subscriptions.remove(topic)
 
-			b.Subscriptions.Add(topic, qos, client)
-			client.Session.Subscriptions.add(topic, qos)
+			b.Subscriptions.Add(topic, opts, client)
+			client.Session.Subscriptions.add(topic, opts)
 		}
 
-		b.CleanUp(oldClient)
+		// taken after the subscriptions moved, so no message is queued for the old client afterwards
+		client.Session.inherit(oldClient.Session)
+
+		// the stored session now belongs to the new client
+		b.removeClient(oldClient)
 		return true
 	}
 
@@ -217,22 +476,29 @@ func (b *Broker) InheritSession(client *Client) bool {
 
 // SubscribeClient subscribes a client to the topics in the packet,
 // adding it to the Broker's subscriptions and updating the client's session subscriptions.
-// If there is a retained message for a topic, it sends a copy to the client with the adjusted QoS.
+// The retained messages of the topics matching a topic filter are sent to the client with the adjusted QoS,
+// unless the MQTT 5.0 retain handling option says otherwise.
 func (b *Broker) SubscribeClient(client *Client, packet *packets.Packet) {
 	for topic, qos := range packet.Subscriptions.GetAll() {
-		// In case topic filter was invalid, we don't need to do anything
-		if qos != 0x80 {
-			retained := b.Subscriptions.Add(topic, qos, client)
-			client.Session.Subscriptions.add(topic, qos)
-
-			if retained != nil {
-				// needs to be copied because we might need to change the QoS
-				retainedCopy := retained.Copy()
-				retainedCopy.SetRightQoS(qos)
-				client.Send(retainedCopy.EncodePublish())
+		// In case topic filter was invalid or denied, we don't need to do anything
+		if qos < 0x80 {
+			opts := packet.Subscriptions.GetOptions(topic)
+			existed := client.Session.Subscriptions.has(topic)
+
+			retained := b.Subscriptions.Add(topic, opts, client)
+			client.Session.Subscriptions.add(topic, opts)
+
+			if opts.RetainHandling == 2 || (opts.RetainHandling == 1 && existed) {
+				continue
+			}
+
+			for _, packet := range retained {
+				b.sendRetained(client, packet, qos)
 			}
 		}
 	}
+
+	b.storeSession(client)
 }
 
 func (b *Broker) UnsubscribeClient(client *Client, packet *packets.Packet) {
@@ -240,14 +506,26 @@ func (b *Broker) UnsubscribeClient(client *Client, packet *packets.Packet) {
 		b.Subscriptions.Remove(topic, client)
 		client.Session.Subscriptions.remove(topic)
 	}
+
+	b.storeSession(client)
 }
 
+// CleanUp removes the client and its session
 func (b *Broker) CleanUp(client *Client) {
+	b.removeClient(client)
+
+	if client.persistent() {
+		b.deleteStoredSession(client)
+	}
+}
+
+// removeClient removes the client and its subscriptions, keeping the stored session
+func (b *Broker) removeClient(client *Client) {
 	b.clients.Remove(client)
 
+	b.redistributeShared(client)
+
 	b.Subscriptions.RemoveClientSubscriptions(client)
-	// I think this is needed to ensure that the client is garbage collected
-	client.Broker = nil
 }
 
 func (b *Broker) DisplayInfo() {
@@ -268,6 +546,12 @@ func (b *Broker) CloseAllListeners() {
 	}
 }
 func (b *Broker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
 	b.CloseAllListeners()
+	if b.Store != nil {
+		b.storeError(b.Store.Close())
+	}
 	b.Log.Println("Closing broker")
 }
@@ -0,0 +1,289 @@
+package nixmq
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// how long a test client waits for a packet the broker is expected to send
+const testTimeout = 2 * time.Second
+
+// newTestBroker returns a broker accepting anonymous clients on an in-memory listener, closed when the test ends
+func newTestBroker(t *testing.T) (*Broker, *listeners.MemoryListener) {
+	t.Helper()
+	b := New()
+	b.Log = log.New(io.Discard, "", 0)
+	b.AllowAnonymous = true
+
+	l := listeners.NewMemory()
+	b.AddListener(l)
+	go l.Serve(b.bindListener(l.ID()))
+
+	t.Cleanup(b.Close)
+	return b, l
+}
+
+// testClient is the client side of a connection to a test broker, exchanging raw MQTT packets
+type testClient struct {
+	t               *testing.T
+	conn            net.Conn
+	reader          *bufio.Reader
+	protocolVersion byte
+}
+
+func dial(t *testing.T, l *listeners.MemoryListener, protocolVersion byte) *testClient {
+	t.Helper()
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), protocolVersion: protocolVersion}
+}
+
+// connect dials the broker and connects with the options, failing the test unless the connection is accepted
+func connect(t *testing.T, l *listeners.MemoryListener, options *packets.ConnectOptions) *testClient {
+	t.Helper()
+	c := dial(t, l, options.ProtocolLevel)
+	if connack := c.connect(options); connack.ReasonCode != packets.ACCEPTED.Code {
+		t.Fatalf("Expected connection of %q to be accepted, but got reason code 0x%02X", options.ClientID, connack.ReasonCode)
+	}
+	return c
+}
+
+// connectOptions returns the options of a client starting a clean session
+func connectOptions(protocolVersion byte, clientID string) *packets.ConnectOptions {
+	return &packets.ConnectOptions{ProtocolLevel: protocolVersion, ClientID: clientID, CleanSession: true, Keepalive: 60}
+}
+
+// connect sends the CONNECT and returns the CONNACK
+func (c *testClient) connect(options *packets.ConnectOptions) *packets.Packet {
+	c.t.Helper()
+	c.write(options.Encode())
+	return c.expect(packets.CONNACK)
+}
+
+func (c *testClient) write(buf []byte) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write(buf); err != nil {
+		c.t.Fatalf("Failed to write %x: %v", buf, err)
+	}
+}
+
+func (c *testClient) send(packet *packets.Packet) {
+	c.t.Helper()
+	packet.ProtocolVersion = c.protocolVersion
+	c.write(packet.Encode())
+}
+
+// read returns the next packet sent by the broker
+func (c *testClient) read(timeout time.Duration) (*packets.Packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	fixedHeader, err := packets.DecodeFixedHeader(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	return packets.ParsePacket(fixedHeader, c.reader, c.protocolVersion)
+}
+
+// expect reads the next packet, failing the test unless it is of the message type
+func (c *testClient) expect(messageType byte) *packets.Packet {
+	c.t.Helper()
+	packet, err := c.read(testTimeout)
+	if err != nil {
+		c.t.Fatalf("Expected %s, but got: %v", packets.PacketName(messageType), err)
+	}
+	if packet.FixedHeader.MessageType != messageType {
+		c.t.Fatalf("Expected %s, but got %s", packets.PacketName(messageType), packets.PacketName(packet.FixedHeader.MessageType))
+	}
+	return packet
+}
+
+// expectPublish reads the next PUBLISH, failing the test unless it has the topic and payload
+func (c *testClient) expectPublish(topic string, payload string) *packets.Packet {
+	c.t.Helper()
+	publish := c.expect(packets.PUBLISH)
+	if publish.PublishTopic != topic || string(publish.Payload) != payload {
+		c.t.Fatalf("Expected PUBLISH %q to %s, but got %q to %s", payload, topic, publish.Payload, publish.PublishTopic)
+	}
+	return publish
+}
+
+// expectNothing fails the test if the broker sends a packet within the duration
+func (c *testClient) expectNothing(d time.Duration) {
+	c.t.Helper()
+	packet, err := c.read(d)
+	if err == nil {
+		c.t.Fatalf("Expected no packet, but got %s", packets.PacketName(packet.FixedHeader.MessageType))
+	}
+	if !isTimeout(err) {
+		c.t.Fatalf("Expected no packet, but the connection failed: %v", err)
+	}
+}
+
+// expectClosed fails the test unless the broker closes the connection
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	for {
+		packet, err := c.read(testTimeout)
+		if err != nil {
+			if isTimeout(err) {
+				c.t.Fatalf("Expected the connection to be closed")
+			}
+			return
+		}
+		if packet.FixedHeader.MessageType != packets.DISCONNECT {
+			c.t.Fatalf("Expected the connection to be closed, but got %s", packets.PacketName(packet.FixedHeader.MessageType))
+		}
+	}
+}
+
+// subscribe subscribes to the topic filter and returns the SUBACK
+func (c *testClient) subscribe(packetID uint16, filter string, opts packets.SubscriptionOptions) *packets.Packet {
+	c.t.Helper()
+	c.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: packetID,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{filter: opts.QoS},
+			OrderedSubscriptions: []string{filter},
+			Options:              map[string]packets.SubscriptionOptions{filter: opts},
+		},
+	})
+	suback := c.expect(packets.SUBACK)
+	if suback.PacketIdentifier != packetID {
+		c.t.Fatalf("Expected SUBACK of packet %d, but got %d", packetID, suback.PacketIdentifier)
+	}
+	return suback
+}
+
+// publish sends a PUBLISH and reads its acknowledgement
+func (c *testClient) publish(topic string, payload string, qos byte, retain bool) {
+	c.t.Helper()
+	c.send(newPublish(topic, payload, qos, retain))
+	switch qos {
+	case 1:
+		c.expect(packets.PUBACK)
+	case 2:
+		c.expect(packets.PUBREC)
+		c.send(&packets.Packet{FixedHeader: &packets.FixedHeader{MessageType: packets.PUBREL, Qos: 1}, PacketIdentifier: 1})
+		c.expect(packets.PUBCOMP)
+	}
+}
+
+func newPublish(topic string, payload string, qos byte, retain bool) *packets.Packet {
+	publish := &packets.Packet{
+		FixedHeader:  &packets.FixedHeader{MessageType: packets.PUBLISH, Qos: qos, Retain: retain},
+		PublishTopic: topic,
+		Payload:      []byte(payload),
+	}
+	if qos > 0 {
+		publish.PacketIdentifier = 1
+	}
+	return publish
+}
+
+// ack acknowledges a QoS 1 PUBLISH received from the broker
+func (c *testClient) ack(publish *packets.Packet) {
+	c.t.Helper()
+	c.send(&packets.Packet{FixedHeader: &packets.FixedHeader{MessageType: packets.PUBACK}, PacketIdentifier: publish.PacketIdentifier})
+}
+
+// eventually fails the test unless the condition holds within the test timeout
+func eventually(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+	for deadline := time.Now().Add(testTimeout); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+	}
+}
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	for _, protocolVersion := range []byte{packets.MQTT31, packets.MQTT311, packets.MQTT5} {
+		_, l := newTestBroker(t)
+		subscriber := connect(t, l, connectOptions(protocolVersion, "subscriber"))
+		subscriber.subscribe(1, "sensors/+", packets.SubscriptionOptions{QoS: 1})
+
+		publisher := connect(t, l, connectOptions(protocolVersion, "publisher"))
+		publisher.publish("sensors/temp", "21", 1, false)
+
+		publish := subscriber.expectPublish("sensors/temp", "21")
+		if publish.FixedHeader.Qos != 1 {
+			t.Errorf("Expected QoS 1 for protocol level %d, but got %d", protocolVersion, publish.FixedHeader.Qos)
+		}
+		subscriber.ack(publish)
+	}
+}
+
+func TestBroker_SubackDoesNotEchoSubscribeProperties(t *testing.T) {
+	_, l := newTestBroker(t)
+	c := connect(t, l, connectOptions(packets.MQTT5, "client"))
+
+	c.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 3,
+		Properties:       &packets.Properties{SubscriptionIdentifiers: []uint32{7}, UserProperties: []packets.UserProperty{{Key: "k", Value: "v"}}},
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{"a": 1},
+			OrderedSubscriptions: []string{"a"},
+			Options:              map[string]packets.SubscriptionOptions{"a": {QoS: 1}},
+		},
+	})
+	suback := c.expect(packets.SUBACK)
+	if suback.Properties != nil && (len(suback.Properties.SubscriptionIdentifiers) > 0 || len(suback.Properties.UserProperties) > 0) {
+		t.Errorf("Expected SUBACK without the properties of the SUBSCRIBE, but got: %+v", suback.Properties)
+	}
+	if len(suback.ReasonCodes) != 1 || suback.ReasonCodes[0] != 1 {
+		t.Errorf("Expected granted QoS 1, but got: %v", suback.ReasonCodes)
+	}
+
+	c.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.UNSUBSCRIBE, Qos: 1},
+		PacketIdentifier: 4,
+		Properties:       &packets.Properties{UserProperties: []packets.UserProperty{{Key: "k", Value: "v"}}},
+		Subscriptions:    &packets.Subscriptions{Subscriptions: map[string]byte{"a": 0}, OrderedSubscriptions: []string{"a"}},
+	})
+	unsuback := c.expect(packets.UNSUBACK)
+	if unsuback.Properties != nil && len(unsuback.Properties.UserProperties) > 0 {
+		t.Errorf("Expected UNSUBACK without the properties of the UNSUBSCRIBE, but got: %+v", unsuback.Properties)
+	}
+}
+
+func TestBroker_UnixSocket(t *testing.T) {
+	b, _ := newTestBroker(t)
+	path := filepath.Join(t.TempDir(), "leafmq.sock")
+	l := listeners.NewUnix(path, 0600)
+	b.AddListener(l)
+	go l.Serve(b.bindListener(l.ID()))
+
+	dialUnix := func(clientID string) *testClient {
+		var conn net.Conn
+		eventually(t, func() bool {
+			var err error
+			conn, err = net.Dial("unix", path)
+			return err == nil
+		}, "Failed to dial the socket")
+		t.Cleanup(func() { conn.Close() })
+
+		c := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), protocolVersion: packets.MQTT311}
+		if connack := c.connect(connectOptions(packets.MQTT311, clientID)); connack.ReasonCode != packets.ACCEPTED.Code {
+			t.Fatalf("Expected connection of %q to be accepted, but got reason code 0x%02X", clientID, connack.ReasonCode)
+		}
+		return c
+	}
+
+	subscriber := dialUnix("subscriber")
+	subscriber.subscribe(1, "a", packets.SubscriptionOptions{QoS: 0})
+	dialUnix("publisher").publish("a", "over unix", 0, false)
+	subscriber.expectPublish("a", "over unix")
+}
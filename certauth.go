@@ -0,0 +1,103 @@
+package nixmq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// CertIdentity selects the field of the client certificate used as the MQTT username
+type CertIdentity byte
+
+const (
+	CertCommonName CertIdentity = iota // subject common name
+	CertDNSName                        // first DNS subject alternative name
+	CertEmail                          // first email subject alternative name
+	CertURI                            // first URI subject alternative name
+	CertOID                            // subject attribute with the configured OID
+)
+
+// tlsConn is implemented by connections of TLS and secure WebSocket listeners
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// CertificateAuth is a hook authenticating clients by the verified certificate they present
+// on a mutual TLS listener, see listeners.NewMutualTLSConfig. The identity taken from the
+// certificate replaces the username sent in CONNECT, so ACL rules apply to it.
+type CertificateAuth struct {
+	HookBase
+	Identity      CertIdentity
+	OID           asn1.ObjectIdentifier // subject attribute used with CertOID
+	MatchClientID bool                  // require the client ID to equal the certificate identity
+}
+
+func (a *CertificateAuth) ID() string {
+	return "certificate-auth"
+}
+
+func (a *CertificateAuth) Provides(event HookEvent) bool {
+	return event == OnConnectAuthenticate
+}
+
+func (a *CertificateAuth) OnConnectAuthenticate(client *Client, packet *packets.Packet) bool {
+	conn, ok := client.Conn.(tlsConn)
+	if !ok {
+		return false
+	}
+
+	// only certificates verified against the listener's client CAs are trusted
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return false
+	}
+
+	identity, err := a.identity(state.PeerCertificates[0])
+	if err != nil {
+		client.Broker.Log.Println("Client certificate rejected:", err)
+		return false
+	}
+
+	if a.MatchClientID && client.Properties.ClientID != identity {
+		return false
+	}
+
+	client.Properties.Username = identity
+	return true
+}
+
+// identity returns the configured identity field of the certificate
+func (a *CertificateAuth) identity(cert *x509.Certificate) (string, error) {
+	var identity string
+	switch a.Identity {
+	case CertCommonName:
+		identity = cert.Subject.CommonName
+	case CertDNSName:
+		if len(cert.DNSNames) > 0 {
+			identity = cert.DNSNames[0]
+		}
+	case CertEmail:
+		if len(cert.EmailAddresses) > 0 {
+			identity = cert.EmailAddresses[0]
+		}
+	case CertURI:
+		if len(cert.URIs) > 0 {
+			identity = cert.URIs[0].String()
+		}
+	case CertOID:
+		for _, name := range cert.Subject.Names {
+			if value, ok := name.Value.(string); ok && name.Type.Equal(a.OID) {
+				identity = value
+				break
+			}
+		}
+	}
+
+	if identity == "" {
+		return "", fmt.Errorf("certificate of %s has no identity field %d", cert.Subject, a.Identity)
+	}
+	return identity, nil
+}
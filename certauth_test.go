@@ -0,0 +1,115 @@
+package nixmq
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// newCertificate creates a certificate for the common name, signed by parent or self-signed if parent is nil
+func newCertificate(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	issuer, signer := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// dialTLS connects to the broker over mutual TLS with the client certificate
+func dialTLS(t *testing.T, b *Broker, ca tls.Certificate, clientCert tls.Certificate) *testClient {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverCert := newCertificate(t, "localhost", &ca)
+
+	server, client := net.Pipe()
+	go b.BindClient(tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}))
+
+	conn := tls.Client(client, &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	})
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn), protocolVersion: packets.MQTT311}
+}
+
+func TestCertificateAuth_AllowAnonymous(t *testing.T) {
+	b, _ := newTestBroker(t)
+	b.AddHook(&CertificateAuth{Identity: CertCommonName})
+	acl := NewACL()
+	acl.Add(ACLRule{Topic: "devices/%u/#", Pattern: true, Access: AccessReadWrite})
+	b.AddHook(acl)
+
+	ca := newCertificate(t, "ca", nil)
+	c := dialTLS(t, b, ca, newCertificate(t, "device-1", &ca))
+
+	// the identity is taken from the certificate although anonymous clients are allowed
+	if connack := c.connect(connectOptions(packets.MQTT311, "device")); connack.ReasonCode != packets.ACCEPTED.Code {
+		t.Fatalf("Expected the connection to be accepted, but got: 0x%02X", connack.ReasonCode)
+	}
+	eventually(t, func() bool { return b.clients.Len() == 1 }, "Expected the client to be added")
+	if client, ok := b.clients.Get("device"); !ok || client.Properties.Username != "device-1" {
+		t.Fatalf("Expected username device-1 from the certificate")
+	}
+
+	// ACL rules apply to the identity of the certificate
+	suback := c.subscribe(1, "devices/device-1/cmd", packets.SubscriptionOptions{QoS: 0})
+	if suback.ReasonCodes[0] != 0 {
+		t.Errorf("Expected subscription to its own topic to be granted, but got: 0x%02X", suback.ReasonCodes[0])
+	}
+	suback = c.subscribe(2, "devices/device-2/cmd", packets.SubscriptionOptions{QoS: 0})
+	if suback.ReasonCodes[0] != 0x80 {
+		t.Errorf("Expected subscription to another device to be refused, but got: 0x%02X", suback.ReasonCodes[0])
+	}
+}
+
+func TestCertificateAuth_AnonymousFallback(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.AddHook(&CertificateAuth{Identity: CertCommonName})
+
+	// clients without a certificate are still accepted as anonymous clients
+	connect(t, l, connectOptions(packets.MQTT311, "anonymous"))
+	eventually(t, func() bool { return b.clients.Len() == 1 }, "Expected the client to be added")
+	if client, ok := b.clients.Get("anonymous"); !ok || client.Properties.Username != "" {
+		t.Errorf("Expected an anonymous client")
+	}
+}
@@ -2,8 +2,11 @@ package nixmq
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,37 +15,60 @@ import (
 )
 
 type Client struct {
-	Properties *Properties
-	Conn       net.Conn
+	Properties     *Properties
+	Conn           net.Conn
 	ConnByteReader *bufio.Reader
-	Session    *Session
-	isClosed   bool
-	Broker     *Broker
+	PeerAddress    string // address the client connected from, empty for sessions restored without a connection
+	Session        *Session
+	isClosed       atomic.Bool
+	closeOnce      sync.Once
+	Broker         *Broker
+	out            *outbound      // packets waiting to be written to the connection
+	done           chan struct{}  // closed when the client is closed
+	limits         ListenerLimits // limits of the listener the client connected to
+	connected      bool           // counted as a connected client, guarded by the lock of Clients
 }
 
+// SessionNeverExpires is the session expiry interval of sessions that are kept until the client reconnects
+const SessionNeverExpires uint32 = 0xFFFFFFFF
+
 type Properties struct {
-	ProtocolLevel byte
-	ClientID      string
-	Username      string
-	Password      string
-	WillTopic     string
-	WillMessage   string
-	WillRetain    bool
-	WillQoS       byte
-	CleanSession  bool
-	Keepalive     uint16
+	ProtocolLevel         byte
+	ClientID              string
+	AssignedClientID      bool // client ID was generated by the broker (MQTT 5.0)
+	Username              string
+	Password              string
+	WillTopic             string
+	WillMessage           string
+	WillRetain            bool
+	WillQoS               byte
+	WillProperties        *packets.Properties // MQTT 5.0
+	CleanSession          bool                // CleanStart in MQTT 5.0
+	Keepalive             uint16
+	SessionExpiryInterval uint32 // seconds the session outlives the connection
+	ReceiveMaximum        uint16 // QoS 1 and 2 messages the client accepts unacknowledged, 0 if not limited (MQTT 5.0)
+	MaximumPacketSize     uint32 // largest packet the client accepts, 0 if not limited (MQTT 5.0)
 }
 
 type Session struct {
 	mu             sync.RWMutex
-	PendingPackets map[uint16]*packets.Packet
+	PendingPackets map[uint16]*packets.Packet // packets sent to the client waiting for an acknowledgement
 	Subscriptions  *Subscriptions
+	queue          []*packets.Packet          // messages waiting for the client to connect or for room in the inflight window, oldest first
+	active         bool                       // messages are sent right away instead of queued
+	received       map[uint16]*packets.Packet // PUBREC of QoS 2 messages received from the client waiting for PUBREL, not persisted
+	lastPacketID   uint16                     // last packet identifier assigned to a message sent to the client
+	sent           map[uint16]*sendInfo       // send order of the unacknowledged packets
+	sendSeq        uint64
+	sharedGroups   map[*packets.Packet]*sharedGroup // shared subscription group of the queued and unacknowledged messages received through one
 }
 
 func NewSession() *Session {
 	return &Session{
 		PendingPackets: make(map[uint16]*packets.Packet),
 		Subscriptions:  newSubscriptions(),
+		received:       make(map[uint16]*packets.Packet),
+		sent:           make(map[uint16]*sendInfo),
 	}
 }
 
@@ -53,77 +79,131 @@ func (s *Session) Get(packetID uint16) (*packets.Packet, bool) {
 	return p, ok
 }
 
+func (s *Session) getReceived(packetID uint16) (*packets.Packet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.received[packetID]
+	return p, ok
+}
+
+func (s *Session) addReceived(pubrec *packets.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received[pubrec.PacketIdentifier] = pubrec
+}
+
+// Len returns the number of unacknowledged packets
+func (s *Session) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.PendingPackets)
+}
+
 func (c *Client) AddPendingPacket(packet *packets.Packet) {
 	c.Session.mu.Lock()
 	defer c.Session.mu.Unlock()
 	c.Session.PendingPackets[packet.PacketIdentifier] = packet
+	c.Session.markSent(packet.PacketIdentifier)
+	c.Broker.storeInflight(c, packet)
 }
 
 func (c *Client) RemovePendingPacket(packet *packets.Packet) {
 	c.Session.mu.Lock()
 	defer c.Session.mu.Unlock()
+	delete(c.Session.sharedGroups, c.Session.PendingPackets[packet.PacketIdentifier])
 	delete(c.Session.PendingPackets, packet.PacketIdentifier)
-}
-
-func (s *Session) ClonePendingPackets() *Session {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	c := NewSession()
-
-	for k, v := range s.PendingPackets {
-		c.PendingPackets[k] = v
-	}
-
-	return c
-}
-
-func (c *Client) ResendPendingPackets() {
-	c.Session.mu.RLock()
-	defer c.Session.mu.RUnlock()
-	for _, packet := range c.Session.PendingPackets {
-		c.Send(packet.Encode())
-	}
+	delete(c.Session.sent, packet.PacketIdentifier)
+	c.Broker.storeAck(c, packet.PacketIdentifier)
 }
 
 func NewClient(conn net.Conn, broker *Broker) *Client {
-	return &Client{
+	client := &Client{
 		Properties: &Properties{
 			CleanSession: false,
 		},
-		Conn:    conn,
+		Conn:           conn,
 		ConnByteReader: bufio.NewReader(conn),
-		Broker:  broker,
-		Session: NewSession(),
+		Broker:         broker,
+		Session:        NewSession(),
+		out:            newOutbound(),
+		done:           make(chan struct{}),
 	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		client.PeerAddress = addr.String()
+	}
+	return client
 }
 
 func (c *Client) GenerateClientID() {
-	c.Properties.ClientID = "PLACEHOLDER_FOR_GENERATED_CLIENT_ID"
+	id := make([]byte, 8)
+	rand.Read(id)
+	c.Properties.ClientID = "leafmq-" + hex.EncodeToString(id)
+	c.Properties.AssignedClientID = true
 }
 
+// Send queues the packet for the writer goroutine, so a slow connection doesn't block the sender.
+// Packets sent to a closed client are dropped.
 func (c *Client) Send(packet []byte) {
-	buffer := net.Buffers{packet}
-	n, err := buffer.WriteTo(c.Conn) 
-	if err != nil {
-		c.Close()
+	c.push(outboundPacket{data: packet})
+}
+
+func (c *Client) push(packet outboundPacket) {
+	if c.IsClosed() {
+		packet.release()
+		return
+	}
+
+	dropped, ok := c.out.push(packet, c.Broker.MaxOutboundPackets, c.Broker.MaxOutboundBytes, c.Broker.SlowConsumerPolicy)
+	if dropped > 0 {
+		atomic.AddUint64(&c.Broker.Info.OutboundDropped, uint64(dropped))
+	}
+	if !ok {
+		c.Broker.slowConsumer(c)
 	}
-	c.Broker.Info.AddPacketSent(n)
 }
 
+// Close closes the connection and starts the session expiry. Safe to call multiple times.
 func (c *Client) Close() {
-	c.isClosed = true
-	// todo add atomic
-	atomic.AddUint32(&c.Broker.Info.ClientDisconnected, 1)
-	atomic.AddUint32(&c.Broker.Info.ClientConnected, ^uint32(0)) // --
+	c.closeOnce.Do(func() {
+		c.isClosed.Store(true)
+		close(c.done)
+		c.Session.deactivate()
+		c.Broker.clients.disconnect(c)
+
+		if c.out.close() {
+			// the writer closes the connection once the queued packets are written
+			c.Conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+		} else {
+			c.Conn.Close()
+		}
+		c.expireSession()
+	})
+}
 
-	c.Conn.Close()
-	if c.Properties.CleanSession {
-		c.Broker.CleanUp(c)
+// expireSession removes the session once its expiry interval passes.
+// Sessions with expiry interval 0 (3.1.1 CleanSession) are removed immediately.
+func (c *Client) expireSession() {
+	broker := c.Broker
+	if broker == nil {
+		return
+	}
+
+	switch interval := c.Properties.SessionExpiryInterval; interval {
+	case 0:
+		broker.CleanUp(c)
+	case SessionNeverExpires:
+	default:
+		time.AfterFunc(time.Duration(interval)*time.Second, func() {
+			// session was not taken over by a new connection in the meantime
+			if current, ok := broker.clients.Get(c.Properties.ClientID); ok && current == c {
+				broker.CleanUp(c)
+			}
+		})
 	}
 }
 
 func (c *Client) IsClosed() bool {
-	return c.isClosed
+	return c.isClosed.Load()
 }
 
 func (c *Client) ReadPackets() error {
@@ -134,12 +214,19 @@ func (c *Client) ReadPackets() error {
 
 		fixedHeader, err := packets.DecodeFixedHeader(c.ConnByteReader)
 		if err != nil {
+			c.disconnectOnError(err)
 			return err
 		}
 		c.RefreshKeepAlive()
 
-		packet, err := packets.ParsePacket(fixedHeader, c.ConnByteReader)
+		if err := c.checkPacketSize(fixedHeader, c.limits.MaxPacketSize); err != nil {
+			c.disconnectOnError(err)
+			return err
+		}
+
+		packet, err := packets.ParsePacket(fixedHeader, c.ConnByteReader, c.Properties.ProtocolLevel)
 		if err != nil {
+			c.disconnectOnError(err)
 			return err
 		}
 
@@ -170,20 +257,75 @@ func (c *Client) HandlePacket(packet *packets.Packet) {
 		c.HandlePubcomp(packet)
 	case packets.PINGREQ:
 		c.HandlePingreq(packet)
+	case packets.AUTH:
+		c.HandleAuth(packet)
 
 	default:
-		fmt.Println("TODO: implement handling of", packet.FixedHeader.MessageType)
+		// CONNACK, SUBACK, UNSUBACK and PINGRESP are only sent by the server
+		c.Disconnect(packets.PROTOCOL_ERROR)
 	}
 }
 
 // Broker should not recive CONNECT packet here. If it does disconnect client
 func (c *Client) HandleConnect(packet *packets.Packet) {
 	fmt.Println("Disconnecting client because of another CONNECT packet")
-	c.Close()
+	c.Disconnect(packets.PROTOCOL_ERROR)
 }
 
 func (c *Client) HandleDisconnect(packet *packets.Packet) {
-	c.isClosed = true
+	if packet.Properties != nil && packet.Properties.SessionExpiryInterval != nil {
+		// session expiry can't be set on DISCONNECT if it was 0 on CONNECT [MQTT-3.14.2-2]
+		if c.Properties.SessionExpiryInterval == 0 && *packet.Properties.SessionExpiryInterval != 0 {
+			c.Disconnect(packets.PROTOCOL_ERROR)
+			return
+		}
+		if interval := *packet.Properties.SessionExpiryInterval; interval != c.Properties.SessionExpiryInterval {
+			c.Properties.SessionExpiryInterval = interval
+			if c.persistent() {
+				c.Broker.storeSession(c)
+			} else {
+				c.Broker.deleteStoredSession(c)
+			}
+		}
+	}
+
+	if packet.ReasonCode == packets.DISCONNECT_WITH_WILL_MESSAGE.Code {
+		c.SendWill()
+	}
+
+	c.isClosed.Store(true)
+}
+
+// Enhanced authentication is not supported, as no CONNECT can contain an
+// authentication method AUTH packets are a protocol error [MQTT-4.12.0-1]
+func (c *Client) HandleAuth(packet *packets.Packet) {
+	c.Disconnect(packets.PROTOCOL_ERROR)
+}
+
+// Disconnect closes the connection, notifying MQTT 5.0 clients with a DISCONNECT
+// packet carrying the reason code.
+func (c *Client) Disconnect(code packets.Code) {
+	if c.Properties.ProtocolLevel == packets.MQTT5 && !c.IsClosed() {
+		c.Send(packets.NewDisconnect(code, packets.MQTT5).EncodeDisconnect())
+	}
+	c.Close()
+}
+
+// disconnectOnError notifies MQTT 5.0 clients why the packet they sent was rejected
+func (c *Client) disconnectOnError(err error) {
+	if c.Properties.ProtocolLevel != packets.MQTT5 {
+		return
+	}
+
+	switch err.(type) {
+	case *packets.ErrTopicAliasInvalid:
+		c.Disconnect(packets.TOPIC_ALIAS_INVALID)
+	case *packets.ErrPacketTooLarge:
+		c.Disconnect(packets.PACKET_TOO_LARGE)
+	case *packets.ErrMalformedProperties, *packets.ErrInvalidQoS, *packets.ErrInvalidFixedHeader,
+		*packets.ErrMalformedPacket, *packets.ErrUnknownPacketType:
+		c.Disconnect(packets.MALFORMED_PACKET)
+	}
 }
 
 func (c *Client) HandlePingreq(packet *packets.Packet) {
@@ -191,95 +333,246 @@ func (c *Client) HandlePingreq(packet *packets.Packet) {
 }
 
 func (c *Client) HandleSubscribe(packet *packets.Packet) {
+	// No Local on a shared subscription is a protocol error [MQTT-3.8.3-4]
+	for topic, opts := range packet.Subscriptions.Options {
+		if _, _, shared := packets.ParseSharedSubscription(topic); shared && opts.NoLocal {
+			c.Disconnect(packets.PROTOCOL_ERROR)
+			return
+		}
+	}
+
+	packet = c.Broker.Hooks.OnSubscribe(c, packet)
+	c.authorizeSubscriptions(packet)
+
+	// MQTT 3.1 SUBACK has no failure return code, so invalid subscriptions close the connection
+	if c.Properties.ProtocolLevel == packets.MQTT31 && hasFailedSubscription(packet) {
+		c.Close()
+		return
+	}
+
 	c.Broker.SubscribeClient(c, packet)
-	suback := packet.EncodeSuback()
-	c.Send(suback)
+	c.Send(packets.NewSuback(packet).EncodeSuback())
+}
+
+// authorizeSubscriptions refuses the topic filters the client is not allowed to subscribe to
+func (c *Client) authorizeSubscriptions(packet *packets.Packet) {
+	for topic, code := range packet.Subscriptions.GetAll() {
+		if code < 0x80 && !c.Broker.Hooks.OnACLCheck(c, topic, false) {
+			packet.Subscriptions.Subscriptions[topic] = c.refusedSubscriptionCode()
+		}
+	}
+}
+
+// refusedSubscriptionCode is the SUBACK return code of unauthorized subscriptions
+func (c *Client) refusedSubscriptionCode() byte {
+	if c.Properties.ProtocolLevel == packets.MQTT5 {
+		return packets.NOT_AUTHORIZED_V5.Code
+	}
+	return 0x80
+}
+
+func hasFailedSubscription(packet *packets.Packet) bool {
+	for _, code := range packet.Subscriptions.GetAll() {
+		if code >= 0x80 {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *Client) HandleUnsubscribe(packet *packets.Packet) {
+	packet = c.Broker.Hooks.OnUnsubscribe(c, packet)
 	c.Broker.UnsubscribeClient(c, packet)
-	unsuback := packet.EncodeUnsuback()
-	c.Send(unsuback)
+	c.Send(packets.NewUnsuback(packet).EncodeUnsuback())
 }
 
 func (c *Client) HandlePublish(packet *packets.Packet) {
-	if packet.FixedHeader.Qos == 1 {
-		c.Send(packet.EncodePuback())
+	// retransmitted QoS 2 message that was already received, the PUBREC may have been lost
+	if packet.FixedHeader.Qos == 2 {
+		if pubrec, ok := c.Session.getReceived(packet.PacketIdentifier); ok {
+			c.Send(pubrec.EncodeResp())
+			return
+		}
 	}
 
-	if packet.FixedHeader.Qos == 2 {
-		if _, ok := c.Session.Get(packet.PacketIdentifier); ok {
+	// rejected messages are still acknowledged, MQTT 5.0 clients are told why with the reason code
+	reasonCode := packets.SUCCESS.Code
+	modified, err := c.Broker.Hooks.OnPublish(c, packet)
+	if err == nil {
+		packet = modified
+		if !c.Broker.Hooks.OnACLCheck(c, packet.PublishTopic, true) {
+			err = ErrNotAuthorized
+		}
+	}
+
+	if err != nil {
+		reasonCode = packets.NOT_AUTHORIZED_V5.Code
+		if err == ErrNotAuthorized && c.Broker.DisconnectDenied {
+			c.Disconnect(packets.NOT_AUTHORIZED_V5)
 			return
 		}
+	}
+
+	if packet.FixedHeader.Qos == 1 {
+		puback := packets.BuildResp(packet, packets.PUBACK)
+		puback.ReasonCode = reasonCode
+		c.Send(puback.EncodeResp())
+	}
+
+	if packet.FixedHeader.Qos == 2 {
 		pubrec := packets.BuildResp(packet, packets.PUBREC)
-		c.AddPendingPacket(pubrec)
+		pubrec.ReasonCode = reasonCode
+		// PUBREC with a failure reason code ends the MQTT 5.0 QoS 2 flow [MQTT-4.3.3-8]
+		if err == nil || c.Properties.ProtocolLevel != packets.MQTT5 {
+			c.Session.addReceived(pubrec)
+		}
 		c.Send(pubrec.EncodeResp())
 	}
 
+	if err != nil {
+		return
+	}
+
+	// $SYS topics are reserved for the broker's own statistics
+	if strings.HasPrefix(packet.PublishTopic, "$SYS/") {
+		return
+	}
+
 	if packet.FixedHeader.Retain {
-		c.Broker.Subscriptions.Retain(packet)
+		c.Broker.retain(c, packet)
 	}
 
-	c.Broker.SendSubscribers(packet)
+	c.Broker.SendSubscribers(packet, c)
 }
 
 func (c *Client) HandlePuback(packet *packets.Packet) {
-	c.RemovePendingPacket(packet)
+	if c.completePending(packet.PacketIdentifier, packets.PUBLISH) {
+		c.Broker.sendQueued(c)
+	}
 }
 
 func (c *Client) HandlePubrec(packet *packets.Packet) {
+	// PUBREC with a failure reason code ends the MQTT 5.0 QoS 2 flow [MQTT-4.3.3-8]
+	if c.Properties.ProtocolLevel == packets.MQTT5 && packet.ReasonCode >= 0x80 {
+		if c.completePending(packet.PacketIdentifier, packets.PUBLISH) {
+			c.Broker.sendQueued(c)
+		}
+		return
+	}
+
 	pubrel := packets.BuildResp(packet, packets.PUBREL)
-	delete(c.Session.PendingPackets, packet.PacketIdentifier)
-	c.AddPendingPacket(pubrel)
+
+	c.Session.mu.Lock()
+	pending, ok := c.Session.PendingPackets[packet.PacketIdentifier]
+	if ok && pending.FixedHeader.MessageType == packets.PUBLISH {
+		// replaces the PUBLISH with the same packet identifier
+		delete(c.Session.sharedGroups, pending)
+		c.Session.PendingPackets[pubrel.PacketIdentifier] = pubrel
+		c.Session.markSent(pubrel.PacketIdentifier)
+		c.Broker.storeInflight(c, pubrel)
+	} else if !ok {
+		pubrel.ReasonCode = packets.PACKET_IDENTIFIER_NOT_FOUND.Code
+	}
+	c.Session.mu.Unlock()
+
 	c.Send(pubrel.EncodeResp())
 }
 
 func (c *Client) HandlePubrel(packet *packets.Packet) {
-	if _, ok := c.Session.Get(packet.PacketIdentifier); !ok {
-		fmt.Println("Packet identifier not found")
-		return
+	pubcomp := packets.BuildResp(packet, packets.PUBCOMP)
+
+	c.Session.mu.Lock()
+	if _, ok := c.Session.received[packet.PacketIdentifier]; ok {
+		delete(c.Session.received, packet.PacketIdentifier)
+	} else {
+		// a retransmitted PUBREL whose PUBCOMP was lost is still completed
+		pubcomp.ReasonCode = packets.PACKET_IDENTIFIER_NOT_FOUND.Code
 	}
+	c.Session.mu.Unlock()
 
-	pubcomp := packets.BuildResp(packet, packets.PUBCOMP)
-	c.RemovePendingPacket(packet)
 	c.Send(pubcomp.EncodeResp())
 }
 
 func (c *Client) HandlePubcomp(packet *packets.Packet) {
-	delete(c.Session.PendingPackets, packet.PacketIdentifier)
+	if c.completePending(packet.PacketIdentifier, packets.PUBREL) {
+		c.Broker.sendQueued(c)
+	}
+}
+
+// completePending removes the unacknowledged packet with the packet identifier if it is of the given type,
+// freeing its packet identifier and its place in the inflight window. Returns false if there was no such packet.
+func (c *Client) completePending(packetID uint16, messageType byte) bool {
+	c.Session.mu.Lock()
+	defer c.Session.mu.Unlock()
+
+	pending, ok := c.Session.PendingPackets[packetID]
+	if !ok || pending.FixedHeader.MessageType != messageType {
+		return false
+	}
+	delete(c.Session.PendingPackets, packetID)
+	delete(c.Session.sent, packetID)
+	delete(c.Session.sharedGroups, pending)
+	c.Broker.storeAck(c, packetID)
+	return true
 }
 
 func (c *Client) SetClientProperties(connectionOptions *packets.ConnectOptions) {
 	c.Properties = &Properties{
-		ProtocolLevel: connectionOptions.ProtocolLevel,
-		ClientID:      connectionOptions.ClientID,
-		Username:      connectionOptions.Username,
-		Password:      connectionOptions.Password,
-		WillTopic:     connectionOptions.WillTopic,
-		WillMessage:   connectionOptions.WillMessage,
-		WillRetain:    connectionOptions.WillRetain,
-		WillQoS:       connectionOptions.WillQoS,
-		CleanSession:  connectionOptions.CleanSession,
-		Keepalive:     connectionOptions.Keepalive,
+		ProtocolLevel:  connectionOptions.ProtocolLevel,
+		ClientID:       connectionOptions.ClientID,
+		Username:       connectionOptions.Username,
+		Password:       connectionOptions.Password,
+		WillTopic:      connectionOptions.WillTopic,
+		WillMessage:    connectionOptions.WillMessage,
+		WillRetain:     connectionOptions.WillRetain,
+		WillQoS:        connectionOptions.WillQoS,
+		WillProperties: connectionOptions.WillProperties,
+		CleanSession:   connectionOptions.CleanSession,
+		Keepalive:      connectionOptions.Keepalive,
+	}
+
+	// MQTT 3.1.1 sessions end with the connection or are kept until the client returns
+	if c.Properties.ProtocolLevel != packets.MQTT5 {
+		if !c.Properties.CleanSession {
+			c.Properties.SessionExpiryInterval = SessionNeverExpires
+		}
+		return
+	}
+
+	props := connectionOptions.Properties
+	if props == nil {
+		return
+	}
+	if props.SessionExpiryInterval != nil {
+		c.Properties.SessionExpiryInterval = *props.SessionExpiryInterval
+	}
+	if props.ReceiveMaximum != nil {
+		c.Properties.ReceiveMaximum = *props.ReceiveMaximum
+	}
+	if props.MaximumPacketSize != nil {
+		c.Properties.MaximumPacketSize = *props.MaximumPacketSize
 	}
 }
 
 func (c *Client) ValidateConnectionOptions() packets.Code {
-	if c.Properties.ProtocolLevel != ProtocolVersion {
+	if !supportedProtocolVersions[c.Properties.ProtocolLevel] {
 		return packets.UNACCEPTABLE_PROTOCOL_VERSION
 	}
 
+	// MQTT 5.0 clients may leave the client ID empty and have the broker assign one [MQTT-3.1.3-6]
+	if c.Properties.ClientID == "" && c.Properties.ProtocolLevel == packets.MQTT5 {
+		c.GenerateClientID()
+	}
+
 	// Maximum client identifier length is 23 as per [MQTT-3.1.3-5], however the Broker may allow longer clientID
 	// Current implementation allows clientID of length 64 as testing with EMQX bench tool surpasses 23 characters
 	if c.Properties.ClientID == "" || len(c.Properties.ClientID) > 64 {
 		return packets.IDENTIFIER_REJECTED
 	}
 
-	un := c.Properties.Username
-	pw := c.Properties.Password
-
-	if correctPassword, ok := c.Broker.Users.Get(un); !ok || pw != correctPassword {
-		return packets.BAD_USERNAME_OR_PASSWORD
+	// MQTT 3.1 strictly limits client identifiers to 23 characters
+	if c.Properties.ProtocolLevel == packets.MQTT31 && len(c.Properties.ClientID) > 23 {
+		return packets.IDENTIFIER_REJECTED
 	}
 
 	return packets.ACCEPTED
@@ -305,8 +598,16 @@ func (c *Client) SendWill() {
 		return
 	}
 
-	will := BuildWill(c.Properties)
-	c.Broker.SendSubscribers(will)
+	will, err := c.Broker.Hooks.OnWill(c, BuildWill(c.Properties))
+	if err != nil || !c.Broker.Hooks.OnACLCheck(c, will.PublishTopic, true) {
+		return
+	}
+
+	if will.FixedHeader.Retain {
+		c.Broker.retain(c, will)
+	}
+
+	c.Broker.SendSubscribers(will, nil)
 }
 
 func BuildWill(properties *Properties) *packets.Packet {
@@ -326,5 +627,6 @@ func BuildWill(properties *Properties) *packets.Packet {
 	will.FixedHeader.RemainingLength = uint32(rl)
 	will.PublishTopic = properties.WillTopic
 	will.Payload = []byte(properties.WillMessage)
+	will.Properties = properties.WillProperties.ForwardCopy()
 	return will
 }
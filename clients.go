@@ -23,10 +23,20 @@ func (c *Clients) Add(client *Client) {
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if current, ok := c.internal[client.Properties.ClientID]; ok && current != client {
+		c.uncount(current)
+	}
 	c.internal[client.Properties.ClientID] = client
 
-	atomic.AddUint32(&client.Broker.Info.ClientConnected, 1)
+	// the connection might have been closed before the client was added
+	client.connected = !client.isClosed.Load()
+	if client.connected {
+		atomic.AddUint32(&client.Broker.Info.ClientConnected, 1)
+	} else {
+		atomic.AddUint32(&client.Broker.Info.ClientDisconnected, 1)
+	}
 	atomic.AddUint32(&client.Broker.Info.Clients, 1)
+	atomic.AddUint64(&client.Broker.Info.Connections, 1)
 }
 
 func (c *Clients) Get(clientID string) (*Client, bool) {
@@ -39,10 +49,37 @@ func (c *Clients) Get(clientID string) (*Client, bool) {
 func (c *Clients) Remove(client *Client) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	// client might have already been replaced by a new connection with the same ClientID
+	if current, ok := c.internal[client.Properties.ClientID]; !ok || current != client {
+		return
+	}
 	delete(c.internal, client.Properties.ClientID)
+	c.uncount(client)
+}
+
+// disconnect counts the client as disconnected once its connection is closed.
+// Clients closed before they were added, like ones refused or timed out, were never counted.
+func (c *Clients) disconnect(client *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !client.connected {
+		return
+	}
+	client.connected = false
 
-	atomic.AddUint32(&client.Broker.Info.ClientDisconnected, ^uint32(0)) // --
-	atomic.AddUint32(&client.Broker.Info.Clients, ^uint32(0))            // --
+	atomic.AddUint32(&client.Broker.Info.ClientConnected, ^uint32(0)) // --
+	atomic.AddUint32(&client.Broker.Info.ClientDisconnected, 1)
+}
+
+// uncount removes the client that is no longer in the map from the counters, called while holding the lock
+func (c *Clients) uncount(client *Client) {
+	if client.connected {
+		client.connected = false
+		atomic.AddUint32(&client.Broker.Info.ClientConnected, ^uint32(0)) // --
+	} else {
+		atomic.AddUint32(&client.Broker.Info.ClientDisconnected, ^uint32(0)) // --
+	}
+	atomic.AddUint32(&client.Broker.Info.Clients, ^uint32(0)) // --
 }
 
 func (c *Clients) GetAll() map[string]*Client {
@@ -51,6 +88,15 @@ func (c *Clients) GetAll() map[string]*Client {
 	return c.internal
 }
 
+// Each calls f for every client while holding the read lock
+func (c *Clients) Each(f func(*Client)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, client := range c.internal {
+		f(client)
+	}
+}
+
 func (c *Clients) Len() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
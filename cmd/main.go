@@ -1,17 +1,107 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/lawnp/leafMQ"
 	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/storage"
 )
 
 func main() {
+	aclFile := flag.String("acl", "", "file with topic access control rules")
+	passwordFile := flag.String("passwd", "", "password file created with the passwd command")
+	allowAnonymous := flag.Bool("allow-anonymous", false, "accept clients connecting without a username")
+	jwks := flag.String("jwks", "", "JSON Web Key Set file, authenticates clients sending a JWT as their password")
+	jwtAudience := flag.String("jwt-audience", "", "audience JWTs must be issued for")
+	authWebhook := flag.String("auth-webhook", "", "URL authenticating and authorizing clients, see nixmq.WebhookAuth")
+	authWebhookFailOpen := flag.Bool("auth-webhook-fail-open", false, "allow clients when the auth webhook fails")
+	authWebhookDeliveries := flag.Bool("auth-webhook-deliveries", false, "also ask the auth webhook about the topic of every message delivered to a client")
+	tlsCert := flag.String("tls-cert", "", "certificate of the TLS listener on port 8883")
+	tlsKey := flag.String("tls-key", "", "private key of the TLS listener")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificates of clients, authenticates clients by their certificate's common name")
+	storeFile := flag.String("store", "", "file retained messages and persistent sessions are stored in, kept in memory only if not set")
+	maxRetained := flag.Int("max-retained", 0, "number of retained messages kept, the oldest is evicted when exceeded, 0 for no limit")
+	maxRetainedBytes := flag.Int("max-retained-bytes", 0, "total size of retained messages, the oldest are evicted when exceeded, 0 for no limit")
+	retainedTTL := flag.Duration("retained-ttl", 0, "lifetime of retained messages without a message expiry interval, 0 keeps them until cleared")
+	maxInflight := flag.Int("max-inflight", 0, "unacknowledged QoS 1 and 2 messages per client, further messages are queued, 0 for no limit")
+	retryInterval := flag.Duration("retry-interval", 0, "resend unacknowledged messages to connected MQTT 3.1.1 clients after this long, doubling after every retry, 0 disables it")
+	maxRetries := flag.Int("max-retries", 0, "retries before a client that doesn't acknowledge its messages is disconnected, 0 for no limit")
+	maxPacketSize := flag.Uint("max-packet-size", 1<<20, "largest packet in bytes accepted from connected clients, 0 for the protocol maximum")
+	maxConnectPacketSize := flag.Uint("max-connect-packet-size", 64<<10, "largest packet in bytes accepted before a client is connected, 0 for -max-packet-size")
+	wsMaxPacketSize := flag.Uint("ws-max-packet-size", 0, "largest packet in bytes accepted from websocket clients, 0 for -max-packet-size")
+	connectTimeout := flag.Duration("connect-timeout", 10*time.Second, "how long a new connection may take to send its CONNECT, 0 waits forever")
+	maxConnections := flag.Int("max-connections", 0, "open connections, further clients are refused as server unavailable, 0 for no limit")
+	maxConnectionsPerIP := flag.Int("max-connections-per-ip", 0, "open connections from a single address, further connections are closed, 0 for no limit")
+	wsMaxConnections := flag.Int("ws-max-connections", 0, "open websocket connections, 0 for no limit")
+	maxOutboundBytes := flag.Int("max-outbound-bytes", 16<<20, "total size of the packets waiting to be written to a client before the slow consumer policy applies, 0 for no limit")
+	flag.Parse()
+
+	broker := nixmq.New()
+	broker.AllowAnonymous = *allowAnonymous
+	broker.MaxRetainedMessages = *maxRetained
+	broker.MaxRetainedBytes = *maxRetainedBytes
+	broker.RetainedTTL = *retainedTTL
+	broker.MaxInflight = *maxInflight
+	broker.RetryInterval = *retryInterval
+	broker.MaxRetries = *maxRetries
+	broker.MaxPacketSize = uint32(*maxPacketSize)
+	broker.MaxConnectPacketSize = uint32(*maxConnectPacketSize)
+	broker.MaxOutboundBytes = *maxOutboundBytes
+	broker.ConnectTimeout = *connectTimeout
+	broker.MaxConnections = *maxConnections
+	broker.MaxConnectionsPerIP = *maxConnectionsPerIP
+
+	if *passwordFile != "" {
+		users, err := nixmq.LoadPasswordFile(*passwordFile)
+		if err != nil {
+			log.Fatalln("Error loading password file:", err)
+		}
+		broker.Users = users
+	}
+
+	if *storeFile != "" {
+		store, err := storage.OpenFile(*storeFile)
+		if err != nil {
+			log.Fatalln("Error opening store:", err)
+		}
+		broker.Store = store
+	}
+
+	if *aclFile != "" {
+		acl, err := nixmq.LoadACLFile(*aclFile)
+		if err != nil {
+			log.Fatalln("Error loading ACL:", err)
+		}
+		broker.AddHook(acl)
+	}
+
+	if *jwks != "" {
+		jwtAuth := nixmq.NewJWTAuth()
+		jwtAuth.Audience = *jwtAudience
+		if err := jwtAuth.LoadJWKSFile(*jwks); err != nil {
+			log.Fatalln("Error loading JWKS:", err)
+		}
+		broker.AddHook(jwtAuth)
+	}
+
+	if *authWebhook != "" {
+		webhook := nixmq.NewWebhookAuth(*authWebhook)
+		webhook.FailOpen = *authWebhookFailOpen
+		webhook.CheckDeliveries = *authWebhookDeliveries
+		broker.AddHook(webhook)
+	}
+
+	// Prometheus metrics are scraped from /metrics
+	http.Handle("/metrics", broker.MetricsHandler())
+
 	// this is for profiling memory usage
 	// right now used for manually detecting memory leaks
 	go func() {
@@ -26,11 +116,37 @@ func main() {
 		done <- true
 	}()
 
-	broker := nixmq.New()
-
 	tcp := listeners.NewTCP("127.0.0.1", "1883")
 	broker.AddListener(tcp)
+
+	ws := listeners.NewWebsocket("127.0.0.1", "8080", "/mqtt")
+	broker.AddListenerWithLimits(ws, nixmq.ListenerLimits{MaxPacketSize: uint32(*wsMaxPacketSize), MaxConnections: *wsMaxConnections})
+
+	if *tlsCert != "" {
+		config, err := tlsConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalln("Error loading TLS certificates:", err)
+		}
+		if *tlsClientCA != "" {
+			broker.AddHook(&nixmq.CertificateAuth{Identity: nixmq.CertCommonName})
+		}
+		broker.AddListener(listeners.NewTLS("127.0.0.1", "8883", config))
+	}
+
 	broker.Start()
 
 	<-done
+	broker.Close()
+}
+
+func tlsConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if clientCAFile != "" {
+		return listeners.NewMutualTLSConfig(certFile, keyFile, clientCAFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
 }
@@ -0,0 +1,116 @@
+// Command passwd creates and edits LeafMQ password files.
+//
+//	passwd [-c] [-a algorithm] [-b password] file username   add or update a user
+//	passwd -D file username                                  delete a user
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lawnp/leafMQ"
+	"golang.org/x/term"
+)
+
+func main() {
+	create := flag.Bool("c", false, "create a new password file, overwriting an existing one")
+	remove := flag.Bool("D", false, "delete the user")
+	algorithm := flag.String("a", string(nixmq.Bcrypt), "hash algorithm: bcrypt, argon2id or pbkdf2")
+	password := flag.String("b", "", "password, read from the terminal if not given")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: passwd [-c] [-D] [-a algorithm] [-b password] file username")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path, username := flag.Arg(0), flag.Arg(1)
+
+	if err := run(path, username, *create, *remove, nixmq.HashAlgorithm(*algorithm), *password); err != nil {
+		fmt.Fprintln(os.Stderr, "passwd:", err)
+		os.Exit(1)
+	}
+}
+
+func run(path, username string, create, remove bool, algorithm nixmq.HashAlgorithm, password string) error {
+	if username == "" || strings.ContainsAny(username, ":\n") {
+		return errors.New("username must not be empty or contain ':'")
+	}
+
+	users := nixmq.NewUsers()
+	if !create {
+		var err error
+		users, err = nixmq.LoadPasswordFile(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if remove {
+		if _, ok := users.Get(username); !ok {
+			return fmt.Errorf("user %s not found", username)
+		}
+		users.Remove(username)
+		return users.WriteFile(path)
+	}
+
+	if password == "" {
+		var err error
+		password, err = readPassword()
+		if err != nil {
+			return err
+		}
+	}
+
+	hash, err := nixmq.HashPassword(password, algorithm)
+	if err != nil {
+		return err
+	}
+	users.AddHash(username, hash)
+	return users.WriteFile(path)
+}
+
+// readPassword asks for the password twice, without echo when reading from a terminal
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return checkPassword(strings.TrimRight(line, "\r\n"))
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprint(os.Stderr, "Reenter password: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(again) {
+		return "", errors.New("passwords do not match")
+	}
+	return checkPassword(string(password))
+}
+
+func checkPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return password, nil
+}
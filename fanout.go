@@ -0,0 +1,72 @@
+package nixmq
+
+import (
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// fanout is a received PUBLISH on its way to the subscribers. The received packet is never modified,
+// the message is prepared and encoded at most once for every QoS, retain flag and protocol encoding
+// the subscribers receive it with.
+type fanout struct {
+	packet   *packets.Packet
+	variants [3][2][2]*publishVariant // by QoS, retain flag and MQTT 5.0 encoding
+}
+
+// publishVariant is the message as sent to the subscribers receiving it with the same options
+type publishVariant struct {
+	packet  *packets.Packet // shared by the subscribers, never modified
+	encoded *packets.EncodedPublish
+}
+
+func newFanout(packet *packets.Packet) *fanout {
+	return &fanout{packet: packet}
+}
+
+// variant returns the message as sent with the QoS and retain flag to clients of the protocol level
+func (f *fanout) variant(qos byte, retain bool, protocolLevel byte) *publishVariant {
+	v5 := protocolLevel == packets.MQTT5
+	slot := &f.variants[qos][boolIndex(retain)][boolIndex(v5)]
+	if *slot != nil {
+		return *slot
+	}
+
+	fixedHeader := *f.packet.FixedHeader
+	fixedHeader.Qos = qos
+	fixedHeader.Retain = retain
+	// the DUP flag of the received message is not propagated [MQTT-3.3.1-3]
+	fixedHeader.Dup = false
+
+	packet := *f.packet
+	packet.FixedHeader = &fixedHeader
+	packet.PacketIdentifier = 0
+	packet.ProtocolVersion = packets.MQTT311
+	if v5 {
+		packet.ProtocolVersion = packets.MQTT5
+	}
+	packet.Properties = f.packet.Properties.ForwardCopy()
+
+	*slot = &publishVariant{packet: &packet, encoded: packet.EncodeShared()}
+	return *slot
+}
+
+// subscriberPacket is a copy of a shared message owned by a single subscriber, allocated at once
+type subscriberPacket struct {
+	packet      packets.Packet
+	fixedHeader packets.FixedHeader
+}
+
+// forSubscriber returns a copy of the message the subscriber's session can assign a packet identifier,
+// the payload and the properties stay shared
+func (v *publishVariant) forSubscriber(client *Client) *packets.Packet {
+	c := &subscriberPacket{packet: *v.packet, fixedHeader: *v.packet.FixedHeader}
+	c.packet.FixedHeader = &c.fixedHeader
+	c.packet.ProtocolVersion = client.Properties.ProtocolLevel
+	return &c.packet
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,194 @@
+package nixmq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+func TestFanout_PerSubscriberPackets(t *testing.T) {
+	_, l := newTestBroker(t)
+
+	// a has a message unacknowledged, so the next packet identifier of its session differs from the others
+	a := connect(t, l, connectOptions(packets.MQTT311, "a"))
+	a.subscribe(1, "first", packets.SubscriptionOptions{QoS: 1})
+	connect(t, l, connectOptions(packets.MQTT311, "first")).publish("first", "x", 1, false)
+	busy := a.expectPublish("first", "x")
+	a.subscribe(2, "t", packets.SubscriptionOptions{QoS: 1})
+
+	b := connect(t, l, connectOptions(packets.MQTT311, "b"))
+	b.subscribe(1, "t", packets.SubscriptionOptions{QoS: 1})
+	c := connect(t, l, connectOptions(packets.MQTT5, "c"))
+	c.subscribe(1, "t", packets.SubscriptionOptions{QoS: 0})
+	d := connect(t, l, connectOptions(packets.MQTT5, "d"))
+	d.subscribe(1, "t", packets.SubscriptionOptions{QoS: 2, RetainAsPublished: true})
+
+	// the DUP flag of the received message is not forwarded
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+	publish := newPublish("t", "message", 2, true)
+	publish.FixedHeader.Dup = true
+	publisher.send(publish)
+	publisher.expect(packets.PUBREC)
+
+	tests := []struct {
+		name     string
+		client   *testClient
+		qos      byte
+		retain   bool
+		packetID uint16
+	}{
+		{"a", a, 1, false, busy.PacketIdentifier + 1},
+		{"b", b, 1, false, 1},
+		{"c", c, 0, false, 0},
+		{"d", d, 2, true, 1},
+	}
+	for _, test := range tests {
+		received := test.client.expectPublish("t", "message")
+		if received.FixedHeader.Qos != test.qos || received.FixedHeader.Retain != test.retain || received.FixedHeader.Dup {
+			t.Errorf("%s: expected QoS %d and retain %v without DUP, but got QoS %d, retain %v and DUP %v", test.name,
+				test.qos, test.retain, received.FixedHeader.Qos, received.FixedHeader.Retain, received.FixedHeader.Dup)
+		}
+		if received.PacketIdentifier != test.packetID {
+			t.Errorf("%s: expected packet identifier %d, but got %d", test.name, test.packetID, received.PacketIdentifier)
+		}
+	}
+
+	// the retained message keeps the QoS it was published with
+	e := connect(t, l, connectOptions(packets.MQTT311, "e"))
+	e.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 1,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{"t": 2},
+			OrderedSubscriptions: []string{"t"},
+			Options:              map[string]packets.SubscriptionOptions{"t": {QoS: 2}},
+		},
+	})
+	if retained := e.expectPublish("t", "message"); retained.FixedHeader.Qos != 2 || !retained.FixedHeader.Retain {
+		t.Errorf("Expected the retained message with QoS 2, but got QoS %d and retain %v", retained.FixedHeader.Qos, retained.FixedHeader.Retain)
+	}
+}
+
+// benchmarkSubscriber connects a client subscribed to the topic filter with the QoS and starts acknowledging
+// the messages it receives without decoding them, so the allocations measured are the broker's
+func benchmarkSubscriber(b *testing.B, l *listeners.MemoryListener, protocolVersion byte, clientID string, filter string, qos byte) {
+	b.Helper()
+	conn, err := l.Dial()
+	if err != nil {
+		b.Fatalf("Failed to dial: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	expect := func(messageType byte) {
+		fixedHeader, err := packets.DecodeFixedHeader(reader)
+		if err == nil {
+			_, err = packets.ParsePacket(fixedHeader, reader, protocolVersion)
+		}
+		if err != nil || fixedHeader.MessageType != messageType {
+			b.Fatalf("Expected %s of %s, but got: %v", packets.PacketName(messageType), clientID, err)
+		}
+	}
+
+	conn.Write(connectOptions(protocolVersion, clientID).Encode())
+	expect(packets.CONNACK)
+	subscribe := &packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 1,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{filter: qos},
+			OrderedSubscriptions: []string{filter},
+			Options:              map[string]packets.SubscriptionOptions{filter: {QoS: qos}},
+		},
+		ProtocolVersion: protocolVersion,
+	}
+	conn.Write(subscribe.Encode())
+	expect(packets.SUBACK)
+
+	go acknowledge(conn, reader)
+}
+
+// acknowledge answers QoS 1 messages with PUBACK and QoS 2 messages with PUBREC and PUBCOMP until the connection closes
+func acknowledge(conn net.Conn, reader *bufio.Reader) {
+	buf := make([]byte, 256)
+	ack := make([]byte, 4)
+	for {
+		header, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		length := 0
+		for shift := 0; ; shift += 7 {
+			digit, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			length |= int(digit&0x7F) << shift
+			if digit&0x80 == 0 {
+				break
+			}
+		}
+		if length > len(buf) {
+			buf = make([]byte, length)
+		}
+		if _, err := io.ReadFull(reader, buf[:length]); err != nil {
+			return
+		}
+
+		// the packet identifier follows the topic of a PUBLISH and starts a PUBREL
+		offset := 0
+		switch messageType, qos := header>>4, header>>1&0x03; {
+		case messageType == packets.PUBLISH && qos == 1:
+			ack[0] = packets.PUBACK << 4
+			offset = 2 + int(binary.BigEndian.Uint16(buf))
+		case messageType == packets.PUBLISH && qos == 2:
+			ack[0] = packets.PUBREC << 4
+			offset = 2 + int(binary.BigEndian.Uint16(buf))
+		case messageType == packets.PUBREL:
+			ack[0] = packets.PUBCOMP << 4
+		default:
+			continue
+		}
+		ack[1], ack[2], ack[3] = 2, buf[offset], buf[offset+1]
+		if _, err := conn.Write(ack); err != nil {
+			return
+		}
+	}
+}
+
+// the fan-out of a QoS 2 message to subscribers of MQTT 3.1.1 and 5.0 with QoS 0, 1 and 2 subscriptions,
+// encoded once per variant and copied for each subscriber assigning a packet identifier
+func BenchmarkBroker_SendSubscribers(b *testing.B) {
+	for _, subscribers := range []int{10, 100, 1000} {
+		b.Run(strconv.Itoa(subscribers), func(b *testing.B) {
+			broker := New()
+			broker.Log = log.New(io.Discard, "", 0)
+			broker.AllowAnonymous = true
+			broker.SysInterval = 0
+			// bounds the unacknowledged messages of subscribers falling behind, further messages are queued
+			broker.MaxInflight = 100
+			l := listeners.NewMemory()
+			broker.AddListener(l)
+			go l.Serve(broker.bindListener(l.ID()))
+			b.Cleanup(broker.Close)
+
+			protocolVersions := []byte{packets.MQTT311, packets.MQTT5}
+			for i := 0; i < subscribers; i++ {
+				benchmarkSubscriber(b, l, protocolVersions[i%2], "subscriber-"+strconv.Itoa(i), "bench/+", byte(i%3))
+			}
+
+			packet := newPublish("bench/t", "payload of a typical sensor reading", 2, false)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				broker.SendSubscribers(packet, nil)
+			}
+		})
+	}
+}
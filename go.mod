@@ -1,3 +1,11 @@
 module github.com/lawnp/leafMQ
 
 go 1.22
+
+require (
+	github.com/gorilla/websocket v1.5.3
+	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
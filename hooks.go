@@ -0,0 +1,224 @@
+package nixmq
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+var (
+	// ErrRejected can be returned by hooks to reject a connection, publish or will message
+	ErrRejected = errors.New("rejected by hook")
+	// ErrNotAuthorized is the reason a publish denied by OnACLCheck is dropped
+	ErrNotAuthorized = errors.New("not authorized")
+)
+
+// HookEvent identifies a hook callback, used by Hook.Provides
+type HookEvent byte
+
+const (
+	OnConnect HookEvent = iota
+	OnConnectAuthenticate
+	OnDisconnect
+	OnSubscribe
+	OnUnsubscribe
+	OnPublish
+	OnMessageDelivered
+	OnRetain
+	OnSessionTakeover
+	OnWill
+	OnACLCheck
+)
+
+// Hook receives broker lifecycle events. Hooks should embed HookBase
+// and override the callbacks they need, reporting them in Provides.
+type Hook interface {
+	ID() string
+	Provides(event HookEvent) bool
+
+	// OnConnect is called when a client sends a valid CONNECT, returning an error refuses the connection
+	OnConnect(client *Client, packet *packets.Packet) error
+	// OnConnectAuthenticate returns true if the hook accepts the client's credentials
+	OnConnectAuthenticate(client *Client, packet *packets.Packet) bool
+	// OnDisconnect is called when the connection of an accepted client ends, err is nil on a clean DISCONNECT
+	OnDisconnect(client *Client, err error)
+	// OnSubscribe can modify the requested subscriptions, setting a topic's return code to 0x80 refuses it
+	OnSubscribe(client *Client, packet *packets.Packet) *packets.Packet
+	// OnUnsubscribe can modify the topics being unsubscribed
+	OnUnsubscribe(client *Client, packet *packets.Packet) *packets.Packet
+	// OnPublish can modify a received PUBLISH, returning an error drops it
+	OnPublish(client *Client, packet *packets.Packet) (*packets.Packet, error)
+	// OnMessageDelivered is called after a PUBLISH is sent to a subscriber, the packet is shared and must not be modified
+	OnMessageDelivered(client *Client, packet *packets.Packet)
+	// OnRetain is called when a message is stored as the retained message of its topic
+	OnRetain(client *Client, packet *packets.Packet)
+	// OnSessionTakeover is called when a new connection takes over an existing session
+	OnSessionTakeover(old *Client, new *Client)
+	// OnWill can modify the will message of a client, returning an error suppresses it
+	OnWill(client *Client, will *packets.Packet) (*packets.Packet, error)
+	// OnACLCheck returns true if the client may publish to the topic (write) or subscribe to the topic filter
+	OnACLCheck(client *Client, topic string, write bool) bool
+}
+
+// HookBase implements every Hook callback as a no-op
+type HookBase struct{}
+
+func (h *HookBase) ID() string                    { return "base" }
+func (h *HookBase) Provides(event HookEvent) bool { return false }
+
+func (h *HookBase) OnConnect(client *Client, packet *packets.Packet) error { return nil }
+func (h *HookBase) OnConnectAuthenticate(client *Client, packet *packets.Packet) bool {
+	return false
+}
+func (h *HookBase) OnDisconnect(client *Client, err error) {}
+func (h *HookBase) OnSubscribe(client *Client, packet *packets.Packet) *packets.Packet {
+	return packet
+}
+func (h *HookBase) OnUnsubscribe(client *Client, packet *packets.Packet) *packets.Packet {
+	return packet
+}
+func (h *HookBase) OnPublish(client *Client, packet *packets.Packet) (*packets.Packet, error) {
+	return packet, nil
+}
+func (h *HookBase) OnMessageDelivered(client *Client, packet *packets.Packet) {}
+func (h *HookBase) OnRetain(client *Client, packet *packets.Packet)           {}
+func (h *HookBase) OnSessionTakeover(old *Client, new *Client)                {}
+func (h *HookBase) OnWill(client *Client, will *packets.Packet) (*packets.Packet, error) {
+	return will, nil
+}
+func (h *HookBase) OnACLCheck(client *Client, topic string, write bool) bool { return true }
+
+// Hooks is the ordered list of registered hooks
+type Hooks struct {
+	mu       sync.RWMutex
+	internal []Hook
+}
+
+func (h *Hooks) Add(hook Hook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.internal = append(h.internal, hook)
+}
+
+func (h *Hooks) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.internal)
+}
+
+// Provides returns true if any registered hook provides the event
+func (h *Hooks) Provides(event HookEvent) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, hook := range h.internal {
+		if hook.Provides(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// providing returns the hooks that provide the event, in registration order
+func (h *Hooks) providing(event HookEvent) []Hook {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	hooks := make([]Hook, 0, len(h.internal))
+	for _, hook := range h.internal {
+		if hook.Provides(event) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+func (h *Hooks) OnConnect(client *Client, packet *packets.Packet) error {
+	for _, hook := range h.providing(OnConnect) {
+		if err := hook.OnConnect(client, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnConnectAuthenticate returns true if any hook accepts the client's credentials
+func (h *Hooks) OnConnectAuthenticate(client *Client, packet *packets.Packet) bool {
+	for _, hook := range h.providing(OnConnectAuthenticate) {
+		if hook.OnConnectAuthenticate(client, packet) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *Hooks) OnDisconnect(client *Client, err error) {
+	for _, hook := range h.providing(OnDisconnect) {
+		hook.OnDisconnect(client, err)
+	}
+}
+
+func (h *Hooks) OnSubscribe(client *Client, packet *packets.Packet) *packets.Packet {
+	for _, hook := range h.providing(OnSubscribe) {
+		packet = hook.OnSubscribe(client, packet)
+	}
+	return packet
+}
+
+func (h *Hooks) OnUnsubscribe(client *Client, packet *packets.Packet) *packets.Packet {
+	for _, hook := range h.providing(OnUnsubscribe) {
+		packet = hook.OnUnsubscribe(client, packet)
+	}
+	return packet
+}
+
+// OnPublish passes the packet through every hook, stopping at the first error
+func (h *Hooks) OnPublish(client *Client, packet *packets.Packet) (*packets.Packet, error) {
+	var err error
+	for _, hook := range h.providing(OnPublish) {
+		packet, err = hook.OnPublish(client, packet)
+		if err != nil {
+			return packet, err
+		}
+	}
+	return packet, nil
+}
+
+func (h *Hooks) OnMessageDelivered(client *Client, packet *packets.Packet) {
+	for _, hook := range h.providing(OnMessageDelivered) {
+		hook.OnMessageDelivered(client, packet)
+	}
+}
+
+func (h *Hooks) OnRetain(client *Client, packet *packets.Packet) {
+	for _, hook := range h.providing(OnRetain) {
+		hook.OnRetain(client, packet)
+	}
+}
+
+func (h *Hooks) OnSessionTakeover(old *Client, new *Client) {
+	for _, hook := range h.providing(OnSessionTakeover) {
+		hook.OnSessionTakeover(old, new)
+	}
+}
+
+// OnWill passes the will through every hook, stopping at the first error
+func (h *Hooks) OnWill(client *Client, will *packets.Packet) (*packets.Packet, error) {
+	var err error
+	for _, hook := range h.providing(OnWill) {
+		will, err = hook.OnWill(client, will)
+		if err != nil {
+			return will, err
+		}
+	}
+	return will, nil
+}
+
+// OnACLCheck returns true if every hook allows the access, or no hook checks access
+func (h *Hooks) OnACLCheck(client *Client, topic string, write bool) bool {
+	for _, hook := range h.providing(OnACLCheck) {
+		if !hook.OnACLCheck(client, topic, write) {
+			return false
+		}
+	}
+	return true
+}
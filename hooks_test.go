@@ -0,0 +1,104 @@
+package nixmq
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// recordingHook records its calls in the shared log and appends its ID to published payloads
+type recordingHook struct {
+	HookBase
+	id  string
+	mu  *sync.Mutex
+	log *[]string
+}
+
+func (h *recordingHook) ID() string { return h.id }
+
+func (h *recordingHook) Provides(event HookEvent) bool {
+	return event == OnConnect || event == OnConnectAuthenticate || event == OnSubscribe ||
+		event == OnPublish || event == OnMessageDelivered || event == OnDisconnect
+}
+
+func (h *recordingHook) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.log = append(*h.log, h.id+" "+event)
+}
+
+func (h *recordingHook) OnConnect(client *Client, packet *packets.Packet) error {
+	h.record("connect " + client.Properties.ClientID)
+	return nil
+}
+
+func (h *recordingHook) OnConnectAuthenticate(client *Client, packet *packets.Packet) bool {
+	h.record("authenticate " + client.Properties.ClientID)
+	return false
+}
+
+func (h *recordingHook) OnSubscribe(client *Client, packet *packets.Packet) *packets.Packet {
+	h.record("subscribe " + client.Properties.ClientID)
+	return packet
+}
+
+func (h *recordingHook) OnPublish(client *Client, packet *packets.Packet) (*packets.Packet, error) {
+	h.record("publish " + string(packet.Payload))
+	if string(packet.Payload) == "reject" {
+		return packet, ErrRejected
+	}
+	packet.Payload = append(packet.Payload, h.id...)
+	return packet, nil
+}
+
+func (h *recordingHook) OnMessageDelivered(client *Client, packet *packets.Packet) {
+	h.record("delivered " + string(packet.Payload))
+}
+
+func (h *recordingHook) OnDisconnect(client *Client, err error) {
+	h.record(fmt.Sprintf("disconnect %s %v", client.Properties.ClientID, err))
+}
+
+func TestHooks_Order(t *testing.T) {
+	b, l := newTestBroker(t)
+	var mu sync.Mutex
+	var log []string
+	b.AddHook(&recordingHook{id: "a", mu: &mu, log: &log})
+	b.AddHook(&recordingHook{id: "b", mu: &mu, log: &log})
+
+	c := connect(t, l, connectOptions(packets.MQTT311, "client"))
+	c.subscribe(1, "t", packets.SubscriptionOptions{QoS: 0})
+	c.publish("t", "reject", 0, false)
+	c.publish("t", "x", 0, false)
+
+	// each hook sees the payload modified by the hooks added before it
+	c.expectPublish("t", "xab")
+	c.expectNothing(50 * time.Millisecond)
+	c.send(&packets.Packet{FixedHeader: &packets.FixedHeader{MessageType: packets.DISCONNECT}})
+	c.expectClosed()
+
+	expected := []string{
+		"a connect client", "b connect client",
+		"a authenticate client", "b authenticate client",
+		"a subscribe client", "b subscribe client",
+		"a publish reject",
+		"a publish x", "b publish xa",
+		"a delivered xab", "b delivered xab",
+		"a disconnect client <nil>", "b disconnect client <nil>",
+	}
+	eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(log) >= len(expected)
+	}, "Expected every hook to be called")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(log, expected) {
+		t.Errorf("Expected hook calls:\n%v\nbut got:\n%v", expected, log)
+	}
+}
@@ -0,0 +1,54 @@
+package nixmq
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+func TestInflight_Window(t *testing.T) {
+	receiveMaximum := uint16(2)
+	tests := []struct {
+		name        string
+		maxInflight int
+		options     *packets.ConnectOptions
+	}{
+		{"MaxInflight", 2, connectOptions(packets.MQTT311, "subscriber")},
+		{"Receive Maximum", 10, connectOptions(packets.MQTT5, "subscriber")},
+	}
+	tests[1].options.Properties = &packets.Properties{ReceiveMaximum: &receiveMaximum}
+
+	for _, test := range tests {
+		b, l := newTestBroker(t)
+		b.MaxInflight = test.maxInflight
+		subscriber := connect(t, l, test.options)
+		subscriber.subscribe(1, "a", packets.SubscriptionOptions{QoS: 1})
+
+		// every message is published with packet identifier 1
+		publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+		for i := 1; i <= 4; i++ {
+			publisher.publish("a", strconv.Itoa(i), 1, false)
+		}
+
+		// the broker assigns its own packet identifiers and sends no more than the window
+		first := subscriber.expectPublish("a", "1")
+		second := subscriber.expectPublish("a", "2")
+		if first.PacketIdentifier == second.PacketIdentifier {
+			t.Errorf("%s: expected distinct packet identifiers, but got %d twice", test.name, first.PacketIdentifier)
+		}
+		subscriber.expectNothing(50 * time.Millisecond)
+
+		// each acknowledgement makes room for the next message
+		subscriber.ack(second)
+		third := subscriber.expectPublish("a", "3")
+		if third.PacketIdentifier == first.PacketIdentifier {
+			t.Errorf("%s: expected a packet identifier not in use, but got %d", test.name, third.PacketIdentifier)
+		}
+		subscriber.expectNothing(50 * time.Millisecond)
+		subscriber.ack(first)
+		subscriber.ack(third)
+		subscriber.ack(subscriber.expectPublish("a", "4"))
+	}
+}
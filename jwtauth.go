@@ -0,0 +1,408 @@
+package nixmq
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// jwtAlgorithms maps the supported JWS algorithms to their hash functions
+var jwtAlgorithms = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// JWTAuth is a hook authenticating clients sending a JSON Web Token as their password.
+// Tokens are verified with HMAC secrets or RSA and ECDSA public keys selected by the
+// "kid" header, the key added with an empty key ID is used for tokens without one.
+//
+// The username is taken from UsernameClaim. If the token has the "publish" or "subscribe"
+// claims, holding lists of topic filters, the client may only use the topics they cover.
+// Clients are disconnected when their token expires.
+type JWTAuth struct {
+	HookBase
+	Audience      string        // required "aud" claim, not checked if empty
+	Issuer        string        // required "iss" claim, not checked if empty
+	UsernameClaim string        // claim used as the username, "sub" if empty
+	Leeway        time.Duration // allowed clock skew for "exp" and "nbf"
+
+	mu       sync.RWMutex
+	secrets  map[string][]byte
+	keys     map[string]crypto.PublicKey
+	sessions map[*Client]*jwtSession
+}
+
+// jwtSession holds the permissions of a client authenticated with a token
+type jwtSession struct {
+	publish   []string // nil if the token doesn't restrict publishing
+	subscribe []string // nil if the token doesn't restrict subscribing
+	expiry    *time.Timer
+}
+
+func NewJWTAuth() *JWTAuth {
+	return &JWTAuth{
+		secrets:  make(map[string][]byte),
+		keys:     make(map[string]crypto.PublicKey),
+		sessions: make(map[*Client]*jwtSession),
+	}
+}
+
+func (a *JWTAuth) ID() string {
+	return "jwt-auth"
+}
+
+func (a *JWTAuth) Provides(event HookEvent) bool {
+	return event == OnConnectAuthenticate || event == OnACLCheck || event == OnDisconnect
+}
+
+// AddSecret adds an HMAC secret for HS256, HS384 and HS512 tokens
+func (a *JWTAuth) AddSecret(kid string, secret []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.secrets[kid] = secret
+}
+
+// AddKey adds an *rsa.PublicKey for RS and PS tokens or an *ecdsa.PublicKey for ES tokens
+func (a *JWTAuth) AddKey(kid string, key crypto.PublicKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys[kid] = key
+}
+
+// LoadJWKSFile adds the keys of a JSON Web Key Set file, see JWTAuth.LoadJWKS
+func (a *JWTAuth) LoadJWKSFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return a.LoadJWKS(file)
+}
+
+// LoadJWKS adds the RSA ("RSA"), ECDSA ("EC") and HMAC ("oct") keys of a JSON Web Key Set
+func (a *JWTAuth) LoadJWKS(r io.Reader) error {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return err
+	}
+
+	for _, key := range set.Keys {
+		switch key.Kty {
+		case "RSA":
+			n, err1 := decodeBigInt(key.N)
+			e, err2 := decodeBigInt(key.E)
+			if err := errors.Join(err1, err2); err != nil || !e.IsInt64() {
+				return fmt.Errorf("invalid RSA key %q", key.Kid)
+			}
+			a.AddKey(key.Kid, &rsa.PublicKey{N: n, E: int(e.Int64())})
+		case "EC":
+			curve, ok := jwkCurves[key.Crv]
+			x, err1 := decodeBigInt(key.X)
+			y, err2 := decodeBigInt(key.Y)
+			if err := errors.Join(err1, err2); err != nil || !ok || !curve.IsOnCurve(x, y) {
+				return fmt.Errorf("invalid EC key %q", key.Kid)
+			}
+			a.AddKey(key.Kid, &ecdsa.PublicKey{Curve: curve, X: x, Y: y})
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(key.K)
+			if err != nil {
+				return fmt.Errorf("invalid oct key %q", key.Kid)
+			}
+			a.AddSecret(key.Kid, secret)
+		default:
+			return fmt.Errorf("unsupported key type %q", key.Kty)
+		}
+	}
+	return nil
+}
+
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (a *JWTAuth) OnConnectAuthenticate(client *Client, packet *packets.Packet) bool {
+	claims, err := a.verify(client.Properties.Password, time.Now())
+	if err != nil {
+		return false
+	}
+
+	usernameClaim := a.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return false
+	}
+
+	// a permission claim that can't be read must not leave the client unrestricted
+	publish, err1 := topicListClaim(claims, "publish")
+	subscribe, err2 := topicListClaim(claims, "subscribe")
+	if err := errors.Join(err1, err2); err != nil {
+		client.Broker.Log.Println("Token rejected:", err)
+		return false
+	}
+	session := &jwtSession{
+		publish:   publish,
+		subscribe: subscribe,
+	}
+
+	// the connection ends when the token expires
+	if exp, ok := claims["exp"].(float64); ok {
+		remaining := time.Until(time.Unix(int64(exp), 0).Add(a.Leeway))
+		session.expiry = time.AfterFunc(remaining, func() {
+			client.Disconnect(packets.MAXIMUM_CONNECT_TIME)
+		})
+	}
+
+	client.Properties.Username = username
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sessions[client] = session
+	return true
+}
+
+// OnACLCheck restricts clients authenticated with a token to the topics of its permission claims
+func (a *JWTAuth) OnACLCheck(client *Client, topic string, write bool) bool {
+	a.mu.RLock()
+	session, ok := a.sessions[client]
+	a.mu.RUnlock()
+	if !ok {
+		return true
+	}
+
+	filters := session.subscribe
+	if write {
+		filters = session.publish
+	}
+	if filters == nil {
+		return true
+	}
+
+	if _, filter, ok := packets.ParseSharedSubscription(topic); ok {
+		topic = filter
+	}
+	for _, filter := range filters {
+		if aclCovers(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *JWTAuth) OnDisconnect(client *Client, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if session, ok := a.sessions[client]; ok {
+		if session.expiry != nil {
+			session.expiry.Stop()
+		}
+		delete(a.sessions, client)
+	}
+}
+
+// verify checks the signature and the registered claims of the token, returning its claims
+func (a *JWTAuth) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := a.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	// tokens without an expiry would grant access forever
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(a.Leeway)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+	if a.Audience != "" && !containsString(claims["aud"], a.Audience) {
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+func (a *JWTAuth) verifySignature(alg string, kid string, signed string, signature []byte) error {
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, alg)
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// the key type must match the algorithm, so a public key is never used as an HMAC secret
+	if strings.HasPrefix(alg, "HS") {
+		secret, ok := a.secrets[kid]
+		if !ok {
+			return fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+
+	key, ok := a.keys[kid]
+	if !ok {
+		return fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(key, hash, digest, signature, nil) == nil {
+				return nil
+			}
+		}
+	case *ecdsa.PublicKey:
+		// ES signatures are r and s, each padded to the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] == "ES" && len(signature) == 2*size && hash.Size()*8 == ecdsaHashBits(key.Curve) {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+	}
+	return ErrInvalidToken
+}
+
+// ecdsaHashBits returns the hash size the JWS algorithm of the curve uses, ES512 uses P-521
+func ecdsaHashBits(curve elliptic.Curve) int {
+	if bits := curve.Params().BitSize; bits != 521 {
+		return bits
+	}
+	return 512
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// containsString returns true if the claim is the string or a list containing it
+func containsString(claim any, s string) bool {
+	switch claim := claim.(type) {
+	case string:
+		return claim == s
+	case []any:
+		for _, v := range claim {
+			if v == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// topicListClaim returns the topic filters of a permission claim, nil if the claim is missing.
+// A claim that is not a list of strings is an error, an empty list allows no topics.
+func topicListClaim(claims map[string]any, name string) ([]string, error) {
+	claim, ok := claims[name]
+	if !ok {
+		return nil, nil
+	}
+
+	list, ok := claim.([]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q claim is not a list", ErrInvalidToken, name)
+	}
+	filters := make([]string, 0, len(list))
+	for _, v := range list {
+		filter, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q claim holds a %T", ErrInvalidToken, name, v)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
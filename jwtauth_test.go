@@ -0,0 +1,139 @@
+package nixmq
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+var testJWTSecret = []byte("secret")
+
+// signHS256 returns an HS256 token with the claims signed with the secret
+func signHS256(t *testing.T, claims map[string]any, secret []byte) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Failed to encode claims: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newJWTBroker returns a broker authenticating clients with tokens signed with testJWTSecret
+func newJWTBroker(t *testing.T) (*Broker, *listeners.MemoryListener) {
+	t.Helper()
+	b, l := newTestBroker(t)
+	b.AllowAnonymous = false
+	jwtAuth := NewJWTAuth()
+	jwtAuth.AddSecret("", testJWTSecret)
+	b.AddHook(jwtAuth)
+	return b, l
+}
+
+// connectWithToken connects an MQTT 5.0 client sending the token as its password and returns the CONNACK
+func connectWithToken(t *testing.T, l *listeners.MemoryListener, token string) (*testClient, *packets.Packet) {
+	t.Helper()
+	c := dial(t, l, packets.MQTT5)
+	options := connectOptions(packets.MQTT5, "client")
+	options.Password = token
+	return c, c.connect(options)
+}
+
+func TestJWTAuth_ValidToken(t *testing.T) {
+	b, l := newJWTBroker(t)
+	token := signHS256(t, map[string]any{
+		"sub":       "alice",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"publish":   []string{"sensors/#"},
+		"subscribe": []string{"commands/alice"},
+	}, testJWTSecret)
+
+	c, connack := connectWithToken(t, l, token)
+	if connack.ReasonCode != packets.ACCEPTED.Code {
+		t.Fatalf("Expected the token to be accepted, but got: 0x%02X", connack.ReasonCode)
+	}
+	eventually(t, func() bool { return b.clients.Len() == 1 }, "Expected the client to be added")
+	if client, ok := b.clients.Get("client"); !ok || client.Properties.Username != "alice" {
+		t.Errorf("Expected username alice from the token")
+	}
+
+	if suback := c.subscribe(1, "commands/alice", packets.SubscriptionOptions{QoS: 0}); suback.ReasonCodes[0] != 0 {
+		t.Errorf("Expected subscription allowed by the token, but got: 0x%02X", suback.ReasonCodes[0])
+	}
+	if suback := c.subscribe(2, "commands/bob", packets.SubscriptionOptions{QoS: 0}); suback.ReasonCodes[0] != packets.NOT_AUTHORIZED_V5.Code {
+		t.Errorf("Expected subscription not allowed by the token to be refused, but got: 0x%02X", suback.ReasonCodes[0])
+	}
+
+	c.send(newPublish("admin/x", "x", 1, false))
+	if puback := c.expect(packets.PUBACK); puback.ReasonCode != packets.NOT_AUTHORIZED_V5.Code {
+		t.Errorf("Expected publish not allowed by the token to be refused, but got: 0x%02X", puback.ReasonCode)
+	}
+}
+
+func TestJWTAuth_RejectedTokens(t *testing.T) {
+	valid := map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	with := func(name string, value any) map[string]any {
+		claims := map[string]any{name: value}
+		for k, v := range valid {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Expired", signHS256(t, with("exp", time.Now().Add(-time.Hour).Unix()), testJWTSecret)},
+		{"Bad signature", signHS256(t, valid, []byte("other secret"))},
+		{"Publish claim not a list", signHS256(t, with("publish", "sensors/#"), testJWTSecret)},
+		{"Subscribe claim not a list", signHS256(t, with("subscribe", map[string]any{"topic": "sensors/#"}), testJWTSecret)},
+		{"Publish claim with a number", signHS256(t, with("publish", []any{"sensors/#", 1}), testJWTSecret)},
+		{"Null publish claim", signHS256(t, with("publish", nil), testJWTSecret)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, l := newJWTBroker(t)
+			_, connack := connectWithToken(t, l, test.token)
+			if connack.ReasonCode != packets.BAD_USERNAME_OR_PASSWORD.V5().Code {
+				t.Errorf("Expected the token to be rejected, but got: 0x%02X", connack.ReasonCode)
+			}
+		})
+	}
+}
+
+func TestJWTAuth_RejectedTokenIsNotAnonymous(t *testing.T) {
+	b, l := newJWTBroker(t)
+	b.AllowAnonymous = true
+
+	token := signHS256(t, map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "publish": "sensors/#"}, testJWTSecret)
+	if _, connack := connectWithToken(t, l, token); connack.ReasonCode == packets.ACCEPTED.Code {
+		t.Errorf("Expected the token to be rejected although anonymous clients are allowed")
+	}
+}
+
+func TestTopicListClaim(t *testing.T) {
+	claims := map[string]any{"empty": []any{}, "filters": []any{"a/#", "b"}}
+
+	if filters, err := topicListClaim(claims, "missing"); filters != nil || err != nil {
+		t.Errorf("Expected no restriction for a missing claim, but got: %v, %v", filters, err)
+	}
+	if filters, err := topicListClaim(claims, "empty"); filters == nil || len(filters) != 0 || err != nil {
+		t.Errorf("Expected an empty list to allow no topics, but got: %v, %v", filters, err)
+	}
+	if filters, err := topicListClaim(claims, "filters"); len(filters) != 2 || err != nil {
+		t.Errorf("Expected 2 topic filters, but got: %v, %v", filters, err)
+	}
+}
@@ -0,0 +1,146 @@
+package nixmq
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// ListenerLimits are the limits of the connections of a single listener, overriding the limits of the broker.
+// Zero values use the limits of the broker.
+type ListenerLimits struct {
+	MaxPacketSize        uint32 // largest packet accepted from connected clients
+	MaxConnectPacketSize uint32 // largest packet accepted before the client is connected
+	MaxConnections       int    // open connections of the listener, further connections are refused
+}
+
+// AddListenerWithLimits adds a listener whose connections have their own limits
+func (b *Broker) AddListenerWithLimits(listener listeners.Listener, limits ListenerLimits) {
+	b.AddListener(listener)
+	if b.listenerLimits == nil {
+		b.listenerLimits = make(map[string]ListenerLimits)
+	}
+	b.listenerLimits[listener.ID()] = limits
+}
+
+// limits returns the limits of the connections of the listener, the limits of the listener where they are set
+// and the limits of the broker otherwise. Packets sent before CONNECT are never allowed to be larger than later ones.
+func (b *Broker) limits(listenerID string) ListenerLimits {
+	limits := b.listenerLimits[listenerID]
+	if limits.MaxPacketSize == 0 {
+		limits.MaxPacketSize = b.MaxPacketSize
+	}
+	if limits.MaxConnectPacketSize == 0 {
+		limits.MaxConnectPacketSize = b.MaxConnectPacketSize
+	}
+	if limits.MaxPacketSize > 0 && (limits.MaxConnectPacketSize == 0 || limits.MaxConnectPacketSize > limits.MaxPacketSize) {
+		limits.MaxConnectPacketSize = limits.MaxPacketSize
+	}
+	return limits
+}
+
+// checkPacketSize refuses a packet larger than maximum before it is read, 0 allows packets of any size
+func (c *Client) checkPacketSize(fixedHeader *packets.FixedHeader, maximum uint32) error {
+	err := fixedHeader.CheckSize(maximum)
+	if err != nil {
+		atomic.AddUint64(&c.Broker.Info.PacketsTooLarge, 1)
+	}
+	return err
+}
+
+// exceedsMaximumPacketSize reports whether the message is larger than the MQTT 5.0 client accepts.
+// encoded is the shared encoding of the message, or nil.
+func (b *Broker) exceedsMaximumPacketSize(client *Client, packet *packets.Packet, encoded *packets.EncodedPublish) bool {
+	maximum := client.Properties.MaximumPacketSize
+	if maximum == 0 {
+		return false
+	}
+	if encoded != nil {
+		return uint32(encoded.Len()) > maximum
+	}
+
+	encodedPacket := *packet
+	encodedPacket.ProtocolVersion = client.Properties.ProtocolLevel
+	return uint32(len(encodedPacket.EncodePublish())) > maximum
+}
+
+// connectionRefusal is the connection limit a new connection exceeds
+type connectionRefusal byte
+
+const (
+	connectionAdmitted   connectionRefusal = iota
+	refusedBrokerLimit                     // the broker has MaxConnections open
+	refusedListenerLimit                   // the listener has its MaxConnections open
+	refusedAddressLimit                    // MaxConnectionsPerIP are open from the address
+)
+
+// connectionCounts are the open connections counted against the connection limits
+type connectionCounts struct {
+	mu         sync.Mutex
+	total      int
+	byListener map[string]int
+	byAddress  map[string]int
+}
+
+// admitConnection counts a new connection of the listener from the address against the connection limits.
+// Connections refused because of the broker or listener limits still count against the limit of their address
+// until they are closed, so a single address can't hold many of them open. release uncounts the connection.
+func (b *Broker) admitConnection(listenerID string, address string, limits ListenerLimits) (refusal connectionRefusal, release func()) {
+	c := &b.connections
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.byAddress == nil {
+		c.byListener = make(map[string]int)
+		c.byAddress = make(map[string]int)
+	}
+
+	if b.MaxConnectionsPerIP > 0 && c.byAddress[address] >= b.MaxConnectionsPerIP {
+		atomic.AddUint64(&b.Info.RefusedConnectionsPerIP, 1)
+		return refusedAddressLimit, func() {}
+	}
+	c.byAddress[address]++
+
+	switch {
+	case b.MaxConnections > 0 && c.total >= b.MaxConnections:
+		atomic.AddUint64(&b.Info.RefusedMaxConnections, 1)
+		refusal = refusedBrokerLimit
+	case limits.MaxConnections > 0 && c.byListener[listenerID] >= limits.MaxConnections:
+		atomic.AddUint64(&b.Info.RefusedListenerConnections, 1)
+		refusal = refusedListenerLimit
+	default:
+		c.total++
+		c.byListener[listenerID]++
+	}
+
+	return refusal, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if refusal == connectionAdmitted {
+			c.total--
+			c.byListener[listenerID]--
+		}
+		c.byAddress[address]--
+		if c.byAddress[address] == 0 {
+			delete(c.byAddress, address)
+		}
+	}
+}
+
+// remoteAddress returns the address the connection comes from without its port
+func remoteAddress(conn net.Conn) string {
+	address := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
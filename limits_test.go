@@ -0,0 +1,89 @@
+package nixmq
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// expectClientCounts fails the test unless the connected and disconnected clients reach the counts
+func expectClientCounts(t *testing.T, b *Broker, connected uint32, disconnected uint32) {
+	t.Helper()
+	eventually(t, func() bool {
+		return atomic.LoadUint32(&b.Info.ClientConnected) == connected && atomic.LoadUint32(&b.Info.ClientDisconnected) == disconnected
+	}, "Expected the client counts to be reached")
+}
+
+// refusedConnection connects over the connection limit and returns the CONNACK after checking the connection is closed
+func refusedConnection(t *testing.T, l *listeners.MemoryListener, protocolVersion byte) *packets.Packet {
+	t.Helper()
+	c := dial(t, l, protocolVersion)
+	connack := c.connect(connectOptions(protocolVersion, "refused"))
+	c.expectClosed()
+	return connack
+}
+
+func TestBroker_ConnectTimeout(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.ConnectTimeout = 50 * time.Millisecond
+
+	// a connection that never sends its CONNECT is closed without being counted as a client
+	dial(t, l, packets.MQTT311).expectClosed()
+	if timeouts := atomic.LoadUint64(&b.Info.ConnectTimeouts); timeouts != 1 {
+		t.Errorf("Expected 1 connect timeout, but got %d", timeouts)
+	}
+	expectClientCounts(t, b, 0, 0)
+
+	c := connect(t, l, connectOptions(packets.MQTT311, "client"))
+	expectClientCounts(t, b, 1, 0)
+	c.conn.Close()
+	expectClientCounts(t, b, 0, 0)
+}
+
+func TestBroker_MaxConnections(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.MaxConnections = 1
+	connect(t, l, connectOptions(packets.MQTT5, "client"))
+
+	if connack := refusedConnection(t, l, packets.MQTT5); connack.ReasonCode != packets.SERVER_UNAVAILABLE_V5.Code {
+		t.Errorf("Expected reason code Server unavailable, but got: 0x%02X", connack.ReasonCode)
+	}
+	if connack := refusedConnection(t, l, packets.MQTT311); connack.ReasonCode != packets.SERVER_UNAVAILABLE.Code {
+		t.Errorf("Expected return code Server unavailable, but got: 0x%02X", connack.ReasonCode)
+	}
+	if refused := atomic.LoadUint64(&b.Info.RefusedMaxConnections); refused != 2 {
+		t.Errorf("Expected 2 refused connections, but got %d", refused)
+	}
+	expectClientCounts(t, b, 1, 0)
+}
+
+func TestBroker_ListenerMaxConnections(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.listenerLimits = map[string]ListenerLimits{l.ID(): {MaxConnections: 1}}
+	c := connect(t, l, connectOptions(packets.MQTT311, "client"))
+
+	if connack := refusedConnection(t, l, packets.MQTT311); connack.ReasonCode != packets.SERVER_UNAVAILABLE.Code {
+		t.Errorf("Expected return code Server unavailable, but got: 0x%02X", connack.ReasonCode)
+	}
+
+	// the closed connection makes room for a new one
+	c.conn.Close()
+	expectClientCounts(t, b, 0, 0)
+	connect(t, l, connectOptions(packets.MQTT311, "client"))
+}
+
+func TestBroker_MaxConnectionsPerIP(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.MaxConnectionsPerIP = 1
+	connect(t, l, connectOptions(packets.MQTT311, "client"))
+
+	// connections over the limit of their address are closed before their CONNECT is read
+	dial(t, l, packets.MQTT311).expectClosed()
+	if refused := atomic.LoadUint64(&b.Info.RefusedConnectionsPerIP); refused != 1 {
+		t.Errorf("Expected 1 refused connection, but got %d", refused)
+	}
+	expectClientCounts(t, b, 1, 0)
+}
@@ -1,12 +1,16 @@
 package listeners
 
 import (
+	"errors"
 	"net"
 )
 
+var ErrListenerClosed = errors.New("listener closed")
+
 type BindFn func(net.Conn)
 
 type Listener interface {
+	ID() string // identifies the listener in logs and metrics
 	Serve(BindFn) error
 	Close()
 }
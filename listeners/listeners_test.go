@@ -1,9 +1,22 @@
 package listeners
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func mockBind(conn net.Conn) {
@@ -50,3 +63,330 @@ func TestTcpListener_Serve(t *testing.T) {
 	// Wait for a short time to allow the listener to close
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestWebsocketListener_Serve(t *testing.T) {
+	address := "127.0.0.1"
+	port := "18083"
+
+	listener := NewWebsocket(address, port, "/mqtt")
+	defer listener.Close()
+
+	// echo everything received back to the client
+	echoBind := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 16)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+		}
+	}
+
+	go listener.Serve(echoBind)
+
+	// Wait for a short time to allow the listener to start
+	time.Sleep(100 * time.Millisecond)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	conn, _, err := dialer.Dial("ws://"+address+":"+port+"/mqtt", nil)
+	if err != nil {
+		t.Fatalf("Failed to establish connection: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != "mqtt" {
+		t.Errorf("Expected subprotocol mqtt, but got %q", conn.Subprotocol())
+	}
+
+	packet := []byte{0xC0, 0x00} // PINGREQ
+	if err := conn.WriteMessage(websocket.BinaryMessage, packet); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	if messageType != websocket.BinaryMessage || !bytes.Equal(data, packet) {
+		t.Errorf("Expected binary message %v, but got type %d with %v", packet, messageType, data)
+	}
+}
+
+func TestWebsocketListener_RequiresSubprotocol(t *testing.T) {
+	address := "127.0.0.1"
+	port := "18084"
+
+	listener := NewWebsocket(address, port, "/mqtt")
+	defer listener.Close()
+
+	bound := make(chan bool, 1)
+	go listener.Serve(func(conn net.Conn) {
+		bound <- true
+	})
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+address+":"+port+"/mqtt", nil)
+	if err != nil {
+		t.Fatalf("Failed to establish connection: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-bound:
+		t.Errorf("Connection without mqtt subprotocol should not be bound")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebsocketListener_CloseBeforeServe(t *testing.T) {
+	listener := NewWebsocket("127.0.0.1", "18086", "/mqtt")
+	listener.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- listener.Serve(mockBind)
+	}()
+
+	select {
+	case err := <-served:
+		if err != ErrListenerClosed {
+			t.Errorf("Expected ErrListenerClosed, but got: %v", err)
+		}
+	case <-time.After(time.Second):
+		listener.Close()
+		t.Fatalf("Serve did not return for a closed listener")
+	}
+}
+
+func TestUnixListener_Serve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leafmq.sock")
+	listener := NewUnix(path, 0600)
+
+	bound := make(chan bool, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- listener.Serve(func(conn net.Conn) {
+			conn.Close()
+			bound <- true
+		})
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected socket file to exist: %v", err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket permissions 0600, but got %v", info.Mode().Perm())
+	}
+
+	// the private directory the socket was created in is removed
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected only the socket file in its directory, but got %d entries", len(entries))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to establish connection: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case <-bound:
+	case <-time.After(time.Second):
+		t.Fatalf("Connection was not bound")
+	}
+
+	listener.Close()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after Close")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected socket file to be removed after Close")
+	}
+}
+
+func TestUnixListener_ServeError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "leafmq.sock")
+	listener := NewUnix(path, 0600)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- listener.Serve(mockBind)
+	}()
+
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Errorf("Expected an error for a socket in a missing directory")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not fail")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected no socket file after the failure")
+	}
+}
+
+func TestMemoryListener_Serve(t *testing.T) {
+	listener := NewMemory()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- listener.Serve(func(conn net.Conn) {
+			defer conn.Close()
+			buf := make([]byte, 2)
+			n, _ := conn.Read(buf)
+			conn.Write(buf[:n])
+		})
+	}()
+
+	conn, err := listener.Dial()
+	if err != nil {
+		t.Fatalf("Failed to establish connection: %v", err)
+	}
+	defer conn.Close()
+
+	packet := []byte{0xC0, 0x00}
+	conn.Write(packet)
+
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil || !bytes.Equal(buf, packet) {
+		t.Errorf("Expected echo %v, but got %v (%v)", packet, buf, err)
+	}
+
+	listener.Close()
+
+	if err := <-served; err != ErrListenerClosed {
+		t.Errorf("Expected ErrListenerClosed, but got %v", err)
+	}
+
+	if _, err := listener.Dial(); err != ErrListenerClosed {
+		t.Errorf("Expected ErrListenerClosed when dialing closed listener, but got %v", err)
+	}
+}
+
+// writeCertificate creates a certificate signed by parent (self-signed if nil) and writes it and its key as PEM files
+func writeCertificate(t *testing.T, dir string, name string, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	issuer, signer := template, any(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0600)
+	os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600)
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return cert
+}
+
+func TestTlsListener_ClientCertificate(t *testing.T) {
+	address := "127.0.0.1"
+	port := "18883"
+	dir := t.TempDir()
+
+	ca := writeCertificate(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	writeCertificate(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "broker"},
+		IPAddresses: []net.IP{net.ParseIP(address)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := writeCertificate(t, dir, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "sensor-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	config, err := NewMutualTLSConfig(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt"))
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %v", err)
+	}
+
+	listener := NewTLS(address, port, config)
+	defer listener.Close()
+	identities := make(chan string, 1)
+	go listener.Serve(func(conn net.Conn) {
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		state := tlsConn.ConnectionState()
+		if len(state.VerifiedChains) > 0 {
+			identities <- state.PeerCertificates[0].Subject.CommonName
+		}
+	})
+
+	time.Sleep(100 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+
+	conn, err := tls.Dial("tcp", address+":"+port, &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{client},
+	})
+	if err != nil {
+		t.Fatalf("Failed to establish connection: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case identity := <-identities:
+		if identity != "sensor-1" {
+			t.Errorf("Expected client certificate of sensor-1, but got %s", identity)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Client certificate was not verified")
+	}
+
+	// without a client certificate the handshake fails
+	conn, err = tls.Dial("tcp", address+":"+port, &tls.Config{RootCAs: roots})
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		// TLS 1.3 reports the missing certificate on the first read
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Expected connection without client certificate to fail")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package listeners
+
+import (
+	"net"
+	"sync"
+)
+
+// MemoryListener hands out in-memory net.Pipe connections, useful for testing without network access
+type MemoryListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemory() *MemoryListener {
+	return &MemoryListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *MemoryListener) Serve(bind BindFn) error {
+	for {
+		select {
+		case conn := <-l.conns:
+			go bind(conn)
+		case <-l.done:
+			return ErrListenerClosed
+		}
+	}
+}
+
+// Dial creates a new connection, the server side is passed to the bind function of Serve.
+// Blocks until the listener is serving or closed.
+func (l *MemoryListener) Dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		server.Close()
+		client.Close()
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *MemoryListener) Close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+}
+
+func (l *MemoryListener) ID() string {
+	return "memory"
+}
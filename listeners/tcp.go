@@ -38,3 +38,7 @@ func (l *TcpListener) Serve(bind BindFn) error {
 func (l *TcpListener) Close() {
 	l.close <- true
 }
+
+func (l *TcpListener) ID() string {
+	return "tcp:" + l.address + ":" + l.port
+}
@@ -2,16 +2,49 @@ package listeners
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
 )
 
 type TlsListener struct {
 	address string
 	port    string
 	config  *tls.Config
+	ln      net.Listener
+	closed  bool
+	mu      sync.Mutex
 }
 
 func NewTLS(address string, port string, config *tls.Config) *TlsListener {
-	return &TlsListener{address, port, config}
+	return &TlsListener{address: address, port: port, config: config}
+}
+
+// NewMutualTLSConfig returns a TLS config serving the certificate in certFile and keyFile
+// that only accepts clients presenting a certificate signed by one of the CAs in caFile
+func NewMutualTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no CA certificates found in " + caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
 }
 
 func (l *TlsListener) Serve(bind BindFn) error {
@@ -19,7 +52,15 @@ func (l *TlsListener) Serve(bind BindFn) error {
 	if err != nil {
 		return err
 	}
-	defer ln.Close()
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		ln.Close()
+		return ErrListenerClosed
+	}
+	l.ln = ln
+	l.mu.Unlock()
 
 	for {
 		conn, err := ln.Accept()
@@ -31,5 +72,17 @@ func (l *TlsListener) Serve(bind BindFn) error {
 	}
 }
 
+// Close stops accepting connections
 func (l *TlsListener) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.ln != nil {
+		l.ln.Close()
+		l.ln = nil
+	}
+}
+
+func (l *TlsListener) ID() string {
+	return "tls:" + l.address + ":" + l.port
 }
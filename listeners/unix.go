@@ -0,0 +1,95 @@
+package listeners
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type UnixListener struct {
+	path   string
+	perm   os.FileMode // permissions of the socket file, controls which users can connect
+	ln     net.Listener
+	closed bool
+	mu     sync.Mutex
+}
+
+func NewUnix(path string, perm os.FileMode) *UnixListener {
+	return &UnixListener{path: path, perm: perm}
+}
+
+func (l *UnixListener) Serve(bind BindFn) error {
+	ln, err := l.listen()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		ln.Close()
+		os.Remove(l.path)
+		return ErrListenerClosed
+	}
+	l.ln = ln
+	l.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go bind(conn)
+	}
+}
+
+// listen creates the socket in a new directory only the broker's user can enter, so no other user can connect
+// before the permissions of the socket are set, and then moves the socket to its path
+func (l *UnixListener) listen() (*net.UnixListener, error) {
+	// remove socket left behind by a previous run
+	if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(l.path), ".leafmq-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is moved, Close removes it from its path
+	ln.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(path, l.perm); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if err := os.Rename(path, l.path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Close stops accepting connections and removes the socket file
+func (l *UnixListener) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.ln != nil {
+		l.ln.Close()
+		l.ln = nil
+		os.Remove(l.path)
+	}
+}
+
+func (l *UnixListener) ID() string {
+	return "unix:" + l.path
+}
@@ -0,0 +1,191 @@
+package listeners
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MQTT over WebSockets must use the "mqtt" subprotocol [MQTT-6.0.0-3]
+const websocketSubprotocol = "mqtt"
+
+type WebsocketListener struct {
+	address  string
+	port     string
+	path     string
+	config   *tls.Config // nil for plain WebSockets
+	server   *http.Server
+	upgrader websocket.Upgrader
+	closed   bool
+	mu       sync.Mutex
+}
+
+// NewWebsocket creates a listener accepting MQTT over WebSockets on the given HTTP path
+func NewWebsocket(address string, port string, path string) *WebsocketListener {
+	return NewWebsocketTLS(address, port, path, nil)
+}
+
+// NewWebsocketTLS creates a listener accepting MQTT over secure WebSockets (wss).
+// If config is nil, plain WebSockets are served.
+func NewWebsocketTLS(address string, port string, path string, config *tls.Config) *WebsocketListener {
+	return &WebsocketListener{
+		address: address,
+		port:    port,
+		path:    path,
+		config:  config,
+		upgrader: websocket.Upgrader{
+			Subprotocols: []string{websocketSubprotocol},
+			// browser dashboards are served from other origins
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+func (l *WebsocketListener) Serve(bind BindFn) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(l.path, func(w http.ResponseWriter, r *http.Request) {
+		l.handle(w, r, bind)
+	})
+
+	ln, err := net.Listen("tcp", l.address+":"+l.port)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		ln.Close()
+		return ErrListenerClosed
+	}
+	l.server = &http.Server{
+		Handler:   mux,
+		TLSConfig: l.config,
+	}
+	server := l.server
+	l.mu.Unlock()
+
+	if l.config != nil {
+		// certificates are taken from the tls.Config
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
+
+func (l *WebsocketListener) handle(w http.ResponseWriter, r *http.Request, bind BindFn) {
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	if ws.Subprotocol() != websocketSubprotocol {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "mqtt subprotocol required"),
+			time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+
+	bind(&wsConn{Conn: ws})
+}
+
+// Close stops accepting connections, a later Serve returns ErrListenerClosed
+func (l *WebsocketListener) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.server != nil {
+		l.server.Close()
+	}
+}
+
+// wsConn adapts a WebSocket connection to net.Conn.
+// MQTT packets may span multiple binary messages and a message may contain multiple packets [MQTT-6.0.0-2].
+type wsConn struct {
+	*websocket.Conn
+	reader        io.Reader
+	writeMu       sync.Mutex
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time // applied to every message, as the websocket.Conn resets the deadline for each of them
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			messageType, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			// data must be sent in binary frames [MQTT-6.0.0-1]
+			if messageType != websocket.BinaryMessage {
+				return 0, errors.New("websocket: expected binary message")
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.deadlineMu.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMu.Unlock()
+
+	c.Conn.SetWriteDeadline(deadline)
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetWriteDeadline can be called while a message is written, the deadline applies to the message being
+// written and the following ones
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	return c.NetConn().SetWriteDeadline(t)
+}
+
+// ConnectionState exposes the TLS state of secure WebSockets, used for client certificate authentication
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.NetConn().(*tls.Conn); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+var _ net.Conn = (*wsConn)(nil)
+
+func (l *WebsocketListener) ID() string {
+	scheme := "ws:"
+	if l.config != nil {
+		scheme = "wss:"
+	}
+	return scheme + l.address + ":" + l.port + l.path
+}
@@ -0,0 +1,94 @@
+package nixmq
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// expectDisconnect fails the test unless the broker closes the connection, after a DISCONNECT with the
+// reason code for MQTT 5.0 clients
+func (c *testClient) expectDisconnect(code packets.Code) {
+	c.t.Helper()
+	if c.protocolVersion == packets.MQTT5 {
+		if disconnect := c.expect(packets.DISCONNECT); disconnect.ReasonCode != code.Code {
+			c.t.Errorf("Expected DISCONNECT with reason code 0x%02X, but got 0x%02X", code.Code, disconnect.ReasonCode)
+		}
+	}
+	c.expectClosed()
+}
+
+func TestBroker_MalformedPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		code   packets.Code
+	}{
+		{"SUBSCRIBE with reserved flags", []byte{0x80, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x00}, packets.MALFORMED_PACKET},
+		{"PUBLISH with QoS 3", []byte{0x36, 0x06, 0x00, 0x01, 'a', 0x00, 0x01, 0x00}, packets.MALFORMED_PACKET},
+		{"SUBSCRIBE without topic filters", []byte{0x82, 0x03, 0x00, 0x01, 0x00}, packets.MALFORMED_PACKET},
+		{"PUBACK with data after the properties", []byte{0x40, 0x05, 0x00, 0x01, 0x00, 0x00, 0xFF}, packets.MALFORMED_PACKET},
+		{"Reserved packet type", []byte{0x00, 0x00}, packets.MALFORMED_PACKET},
+		{"Second CONNECT", connectOptions(packets.MQTT5, "client").Encode(), packets.PROTOCOL_ERROR},
+	}
+
+	_, l := newTestBroker(t)
+	for _, protocolVersion := range []byte{packets.MQTT311, packets.MQTT5} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s v%d", test.name, protocolVersion), func(t *testing.T) {
+				c := connect(t, l, connectOptions(protocolVersion, "client"))
+				c.write(test.packet)
+				c.expectDisconnect(test.code)
+			})
+		}
+	}
+
+	// the broker keeps serving other clients
+	connect(t, l, connectOptions(packets.MQTT311, "client")).publish("a", "x", 1, false)
+}
+
+func TestBroker_HostileInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"Remaining length of 5 bytes", []byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}},
+		{"Topic longer than the packet", []byte{0x30, 0x03, 0x00, 0x10, 'a'}},
+		{"Properties longer than the packet", []byte{0x30, 0x05, 0x00, 0x01, 'a', 0x10, 0x01}},
+		{"Packet identifier missing", []byte{0x32, 0x03, 0x00, 0x01, 'a'}},
+		{"Subscription options missing", []byte{0x82, 0x07, 0x00, 0x01, 0x00, 0x00, 0x02, 'a', 'b'}},
+	}
+
+	_, l := newTestBroker(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := connect(t, l, connectOptions(packets.MQTT5, "client"))
+			c.write(test.packet)
+			c.expectDisconnect(packets.MALFORMED_PACKET)
+		})
+	}
+
+	// random data before and after CONNECT never takes the broker down
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		data := make([]byte, 2+random.Intn(64))
+		random.Read(data)
+		data[1] = byte(len(data) - 2)
+
+		c := dial(t, l, packets.MQTT5)
+		if i%2 == 1 {
+			c.connect(connectOptions(packets.MQTT5, "client"))
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+		c.conn.Write(data)
+		c.conn.Close()
+	}
+
+	subscriber := connect(t, l, connectOptions(packets.MQTT5, "subscriber"))
+	subscriber.subscribe(1, "a", packets.SubscriptionOptions{QoS: 1})
+	connect(t, l, connectOptions(packets.MQTT5, "publisher")).publish("a", "x", 1, false)
+	subscriber.expectPublish("a", "x")
+}
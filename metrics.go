@@ -0,0 +1,181 @@
+package nixmq
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+const metricsNamespace = "leafmq_"
+
+var packetTypeNames = map[byte]string{
+	packets.CONNECT:     "connect",
+	packets.CONNACK:     "connack",
+	packets.PUBLISH:     "publish",
+	packets.PUBACK:      "puback",
+	packets.PUBREC:      "pubrec",
+	packets.PUBREL:      "pubrel",
+	packets.PUBCOMP:     "pubcomp",
+	packets.SUBSCRIBE:   "subscribe",
+	packets.SUBACK:      "suback",
+	packets.UNSUBSCRIBE: "unsubscribe",
+	packets.UNSUBACK:    "unsuback",
+	packets.PINGREQ:     "pingreq",
+	packets.PINGRES:     "pingresp",
+	packets.DISCONNECT:  "disconnect",
+	packets.AUTH:        "auth",
+}
+
+// MetricsHandler serves broker statistics in the Prometheus text exposition format
+func (b *Broker) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		b.WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes all broker metrics to w in the Prometheus text exposition format
+func (b *Broker) WriteMetrics(w io.Writer) {
+	info := b.Info
+	m := &metricsWriter{w: w}
+
+	m.metric("connections_total", "counter", "Total number of accepted connections.",
+		"", float64(atomic.LoadUint64(&info.Connections)))
+	m.metric("clients_connected", "gauge", "Number of currently connected clients.",
+		"", float64(atomic.LoadUint32(&info.ClientConnected)))
+	m.metric("clients_disconnected", "gauge", "Number of persistent sessions without a connection.",
+		"", float64(atomic.LoadUint32(&info.ClientDisconnected)))
+	m.metric("clients_total", "gauge", "Number of known client sessions.",
+		"", float64(atomic.LoadUint32(&info.Clients)))
+	m.metric("auth_failures_total", "counter", "Total number of connections refused because of authentication or authorization.",
+		"", float64(atomic.LoadUint64(&info.AuthFailures)))
+
+	m.header("packets_received_total", "counter", "Total number of received packets by type.")
+	for _, t := range sortedPacketTypes() {
+		label := `type="` + packetTypeNames[t] + `"`
+		m.sample("packets_received_total", label, float64(atomic.LoadUint64(&info.PacketsReceivedByType[t])))
+	}
+
+	m.header("packets_sent_total", "counter", "Total number of sent packets by type.")
+	for _, t := range sortedPacketTypes() {
+		label := `type="` + packetTypeNames[t] + `"`
+		m.sample("packets_sent_total", label, float64(atomic.LoadUint64(&info.PacketsSentByType[t])))
+	}
+
+	m.metric("bytes_received_total", "counter", "Total number of bytes received.",
+		"", float64(atomic.LoadUint64(&info.BytesReceived)))
+	m.metric("bytes_sent_total", "counter", "Total number of bytes sent.",
+		"", float64(atomic.LoadUint64(&info.BytesSent)))
+	m.metric("subscriptions", "gauge", "Number of active subscriptions.",
+		"", float64(atomic.LoadUint32(&info.Subscriptions)))
+	m.metric("retained_messages", "gauge", "Number of retained messages of clients.",
+		"", float64(b.Subscriptions.RetainedCount()))
+	m.metric("retained_bytes", "gauge", "Total size of the topics and payloads of retained messages of clients.",
+		"", float64(b.Subscriptions.RetainedBytes()))
+	m.metric("retained_messages_dropped_total", "counter", "Total number of retained messages evicted or refused because of the retained message limits.",
+		"", float64(atomic.LoadUint64(&info.RetainedDropped)))
+
+	inflight, queued, outbound := b.pendingMessages()
+	m.metric("inflight_messages", "gauge", "Number of unacknowledged QoS 1 and 2 messages.",
+		"", float64(inflight))
+	m.metric("queued_messages", "gauge", "Number of messages queued for disconnected sessions or waiting for room in the inflight window.",
+		"", float64(queued))
+	m.metric("messages_dropped_total", "counter", "Total number of messages dropped because the queue of a session was full.",
+		"", float64(atomic.LoadUint64(&info.MessagesDropped)))
+	m.metric("outbound_packets", "gauge", "Number of packets waiting to be written to connected clients.",
+		"", float64(outbound))
+	m.metric("outbound_dropped_total", "counter", "Total number of messages dropped because the outbound queue of a slow client was full.",
+		"", float64(atomic.LoadUint64(&info.OutboundDropped)))
+	m.metric("slow_consumer_disconnects_total", "counter", "Total number of clients disconnected because their outbound queue was full.",
+		"", float64(atomic.LoadUint64(&info.SlowConsumerDisconnects)))
+	m.metric("retransmissions_total", "counter", "Total number of unacknowledged packets resent to connected clients.",
+		"", float64(atomic.LoadUint64(&info.Retransmissions)))
+	m.metric("packets_too_large_total", "counter", "Total number of received packets refused because they exceed the maximum packet size.",
+		"", float64(atomic.LoadUint64(&info.PacketsTooLarge)))
+	m.metric("messages_too_large_total", "counter", "Total number of messages dropped because they exceed the maximum packet size of the client.",
+		"", float64(atomic.LoadUint64(&info.MessagesTooLarge)))
+
+	m.header("connections_refused_total", "counter", "Total number of connections refused or closed before they were connected by reason.")
+	m.sample("connections_refused_total", `reason="max_connections"`, float64(atomic.LoadUint64(&info.RefusedMaxConnections)))
+	m.sample("connections_refused_total", `reason="listener_max_connections"`, float64(atomic.LoadUint64(&info.RefusedListenerConnections)))
+	m.sample("connections_refused_total", `reason="max_connections_per_ip"`, float64(atomic.LoadUint64(&info.RefusedConnectionsPerIP)))
+	m.sample("connections_refused_total", `reason="connect_timeout"`, float64(atomic.LoadUint64(&info.ConnectTimeouts)))
+
+	m.header("listener_connections_total", "counter", "Total number of accepted connections by listener.")
+	b.Info.RangeListeners(func(id string, li *ListenerInfo) {
+		m.sample("listener_connections_total", listenerLabel(id), float64(atomic.LoadUint64(&li.Connections)))
+	})
+
+	m.header("listener_connections_active", "gauge", "Number of open connections by listener.")
+	b.Info.RangeListeners(func(id string, li *ListenerInfo) {
+		m.sample("listener_connections_active", listenerLabel(id), float64(atomic.LoadInt64(&li.ActiveConnections)))
+	})
+
+	m.histogram("publish_fanout_seconds", "Time spent delivering a published message to all subscribers.", &info.PublishFanout)
+}
+
+// pendingMessages returns the number of unacknowledged messages, the number of messages
+// queued for sessions of disconnected clients and the number of packets waiting to be written.
+func (b *Broker) pendingMessages() (inflight int, queued int, outbound int) {
+	b.clients.Each(func(client *Client) {
+		inflight += client.Session.Len()
+		queued += client.Session.QueueLen()
+		outbound += client.out.Len()
+	})
+	return inflight, queued, outbound
+}
+
+func sortedPacketTypes() []byte {
+	types := make([]byte, 0, len(packetTypeNames))
+	for t := range packetTypeNames {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m *metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsNamespace, name, help, metricsNamespace, name, kind)
+}
+
+func (m *metricsWriter) sample(name string, labels string, value float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(m.w, "%s%s%s %s\n", metricsNamespace, name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *metricsWriter) metric(name string, kind string, help string, labels string, value float64) {
+	m.header(name, kind, help)
+	m.sample(name, labels, value)
+}
+
+func (m *metricsWriter) histogram(name string, help string, h *Histogram) {
+	m.header(name, "histogram", help)
+
+	var cumulative uint64
+	for i, bound := range histogramBuckets {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		m.sample(name+"_bucket", `le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, float64(cumulative))
+	}
+
+	count := atomic.LoadUint64(&h.count)
+	m.sample(name+"_bucket", `le="+Inf"`, float64(count))
+	m.sample(name+"_sum", "", time.Duration(atomic.LoadUint64(&h.sum)).Seconds())
+	m.sample(name+"_count", "", float64(count))
+}
+
+func listenerLabel(id string) string {
+	// strconv.Quote escapes backslashes, quotes and newlines as required for label values
+	return "listener=" + strconv.Quote(id)
+}
@@ -0,0 +1,38 @@
+package nixmq
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+func TestMetrics_ClientsConnected(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.ConnectTimeout = 50 * time.Millisecond
+	b.MaxConnections = 1
+
+	// neither a timed out nor a refused connection is a connected client
+	dial(t, l, packets.MQTT311).expectClosed()
+	connect(t, l, connectOptions(packets.MQTT311, "client"))
+	refusedConnection(t, l, packets.MQTT311)
+	expectClientCounts(t, b, 1, 0)
+
+	recorder := httptest.NewRecorder()
+	b.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	samples := []string{
+		"clients_connected 1\n",
+		"clients_disconnected 0\n",
+		`connections_refused_total{reason="connect_timeout"} 1` + "\n",
+		`connections_refused_total{reason="max_connections"} 1` + "\n",
+	}
+	for _, sample := range samples {
+		if !strings.Contains(body, metricsNamespace+sample) {
+			t.Errorf("Expected sample %s%s, but got:\n%s", metricsNamespace, sample, body)
+		}
+	}
+}
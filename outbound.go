@@ -0,0 +1,230 @@
+package nixmq
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// SlowConsumerPolicy selects what happens when a client doesn't read its packets fast enough
+// and its outbound queue is full
+type SlowConsumerPolicy byte
+
+const (
+	SlowConsumerDropOldest SlowConsumerPolicy = iota // drop the oldest queued PUBLISH, dropped QoS 1 and 2 messages stay unacknowledged
+	SlowConsumerDropQoS0                             // drop QoS 0 messages, QoS 1 and 2 messages are still queued
+	SlowConsumerDisconnect                           // disconnect the client
+)
+
+// how long the packets queued when a connection is closed may take to be written
+const closeWriteTimeout = time.Second
+
+// buffers larger than this are left to the garbage collector instead of being pooled
+const maxPooledBuffer = 64 << 10
+
+// publishBuffers holds the buffers PUBLISH packets are encoded into for a single client
+var publishBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// outboundPacket is an encoded packet waiting to be written
+type outboundPacket struct {
+	data   []byte
+	pooled *[]byte // returned to publishBuffers once written, nil if data isn't pooled
+}
+
+func (p outboundPacket) release() {
+	if p.pooled != nil && cap(*p.pooled) <= maxPooledBuffer {
+		publishBuffers.Put(p.pooled)
+	}
+}
+
+// outbound is the queue of packets waiting to be written to the connection of a client
+type outbound struct {
+	mu         sync.Mutex
+	packets    []outboundPacket
+	size       int           // total size of the queued packets
+	wake       chan struct{} // signals the writer that packets were queued or the queue was closed
+	running    bool          // a writer drains the queue
+	closing    bool          // the writer closes the connection once the queue is written
+	overflowed bool          // the queue overflowed with SlowConsumerDisconnect, the client is being disconnected
+}
+
+func newOutbound() *outbound {
+	return &outbound{wake: make(chan struct{}, 1)}
+}
+
+func (o *outbound) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of packets waiting to be written
+func (o *outbound) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.packets)
+}
+
+// push queues the packet. If the queue holds limit packets or adding the packet exceeds maxBytes,
+// the policy decides which PUBLISHes are dropped, other packets are always queued. 0 disables a limit.
+// Returns the number of dropped packets, and false once, when the client has to be disconnected.
+// Packets that don't fit while it is being disconnected are dropped.
+func (o *outbound) push(packet outboundPacket, limit int, maxBytes int, policy SlowConsumerPolicy) (int, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	full := func() bool {
+		return (limit > 0 && len(o.packets) >= limit) || (maxBytes > 0 && o.size+len(packet.data) > maxBytes)
+	}
+
+	dropped := 0
+	if full() {
+		publish := packet.data[0]>>4 == packets.PUBLISH
+		switch policy {
+		case SlowConsumerDisconnect:
+			packet.release()
+			if o.overflowed {
+				return 0, true
+			}
+			o.overflowed = true
+			return 0, false
+		case SlowConsumerDropQoS0:
+			if publish && publishQoS(packet.data) == 0 {
+				packet.release()
+				return 1, true
+			}
+			for full() && o.drop(func(p []byte) bool { return p[0]>>4 == packets.PUBLISH && publishQoS(p) == 0 }) {
+				dropped++
+			}
+		case SlowConsumerDropOldest:
+			for full() && o.drop(func(p []byte) bool { return p[0]>>4 == packets.PUBLISH }) {
+				dropped++
+			}
+		}
+	}
+
+	o.packets = append(o.packets, packet)
+	o.size += len(packet.data)
+	o.signal()
+	return dropped, true
+}
+
+// drop removes the oldest packet matching, called while holding the lock
+func (o *outbound) drop(match func([]byte) bool) bool {
+	for i, p := range o.packets {
+		if match(p.data) {
+			o.size -= len(p.data)
+			p.release()
+			copy(o.packets[i:], o.packets[i+1:])
+			o.packets[len(o.packets)-1] = outboundPacket{}
+			o.packets = o.packets[:len(o.packets)-1]
+			return true
+		}
+	}
+	return false
+}
+
+func publishQoS(packet []byte) byte {
+	return (packet[0] >> 1) & 0x03
+}
+
+// take waits for queued packets and returns all of them, closing is true once the queue was closed
+func (o *outbound) take() ([]outboundPacket, bool) {
+	for {
+		o.mu.Lock()
+		if len(o.packets) > 0 || o.closing {
+			batch, closing := o.packets, o.closing
+			o.packets = nil
+			o.size = 0
+			o.mu.Unlock()
+			return batch, closing
+		}
+		o.mu.Unlock()
+		<-o.wake
+	}
+}
+
+// close makes the writer close the connection after writing the queued packets.
+// Returns false if there is no writer.
+func (o *outbound) close() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closing = true
+	o.signal()
+	return o.running
+}
+
+// startWriter starts the goroutine writing the queued packets to the connection
+func (c *Client) startWriter() {
+	c.out.mu.Lock()
+	c.out.running = true
+	c.out.mu.Unlock()
+
+	go c.writePackets()
+}
+
+// writePackets writes the queued packets in batches until the client is closed
+func (c *Client) writePackets() {
+	failed := false
+	for {
+		batch, closing := c.out.take()
+
+		if !failed && len(batch) > 0 {
+			if err := c.write(batch); err != nil {
+				failed = true
+				c.Close()
+			}
+		} else {
+			for _, packet := range batch {
+				packet.release()
+			}
+		}
+
+		if closing {
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+// write sends the packets with a single write where the connection supports it
+func (c *Client) write(batch []outboundPacket) error {
+	buffers := make(net.Buffers, len(batch))
+	for i, packet := range batch {
+		buffers[i] = packet.data
+	}
+
+	_, err := buffers.WriteTo(c.Conn)
+	for _, packet := range batch {
+		if err == nil {
+			c.Broker.Info.AddPacketSent(packet.data[0]>>4, int64(len(packet.data)))
+		}
+		packet.release()
+	}
+	return err
+}
+
+// sendPublish sends the shared encoding of a PUBLISH with the packet identifier of the client
+// patched into a pooled buffer
+func (c *Client) sendPublish(encoded *packets.EncodedPublish, packetID uint16) {
+	buf := publishBuffers.Get().(*[]byte)
+	*buf = encoded.AppendTo((*buf)[:0], packetID, false)
+	c.push(outboundPacket{data: *buf, pooled: buf})
+}
+
+// slowConsumer disconnects a client whose outbound queue is full
+func (b *Broker) slowConsumer(client *Client) {
+	atomic.AddUint64(&b.Info.SlowConsumerDisconnects, 1)
+	b.Log.Println("Disconnecting slow consumer:", client.Properties.ClientID)
+
+	// the DISCONNECT is queued beyond the limit
+	if client.Properties.ProtocolLevel == packets.MQTT5 {
+		client.out.push(outboundPacket{data: packets.NewDisconnect(packets.QUOTA_EXCEEDED, packets.MQTT5).EncodeDisconnect()}, 0, 0, b.SlowConsumerPolicy)
+	}
+	// messages are sent while holding the session lock, which closing the client takes as well
+	go client.Close()
+}
@@ -0,0 +1,64 @@
+package nixmq
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// publishToStalledSubscriber publishes QoS 1 messages 1 to n to a subscriber that doesn't read until all
+// of them are published, so the publisher must never wait for the subscriber
+func publishToStalledSubscriber(t *testing.T, l *listeners.MemoryListener, subscriber *testClient, n int) {
+	t.Helper()
+	subscriber.subscribe(1, "a", packets.SubscriptionOptions{QoS: 0})
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+	for i := 1; i <= n; i++ {
+		publisher.publish("a", strconv.Itoa(i), 1, false)
+	}
+}
+
+func TestOutbound_SlowConsumerDropOldest(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.MaxOutboundPackets = 3
+	subscriber := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	publishToStalledSubscriber(t, l, subscriber, 20)
+
+	// the newest messages are kept and every message is either received or counted as dropped
+	received := subscriber.received()
+	if len(received) == 0 || received[len(received)-1] != "20" {
+		t.Fatalf("Expected the newest message to be received, but got: %v", received)
+	}
+	if dropped := atomic.LoadUint64(&b.Info.OutboundDropped); dropped == 0 || int(dropped)+len(received) != 20 {
+		t.Errorf("Expected the %d messages not received to be dropped, but %d were", 20-len(received), dropped)
+	}
+}
+
+func TestOutbound_SlowConsumerDisconnect(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.MaxOutboundPackets = 3
+	b.SlowConsumerPolicy = SlowConsumerDisconnect
+	subscriber := connect(t, l, connectOptions(packets.MQTT5, "subscriber"))
+	publishToStalledSubscriber(t, l, subscriber, 20)
+
+	// the queued messages are written before the DISCONNECT
+	var last *packets.Packet
+	for {
+		packet, err := subscriber.read(testTimeout)
+		if err != nil {
+			if isTimeout(err) {
+				t.Fatalf("Expected the connection to be closed")
+			}
+			break
+		}
+		last = packet
+	}
+	if last == nil || last.FixedHeader.MessageType != packets.DISCONNECT || last.ReasonCode != packets.QUOTA_EXCEEDED.Code {
+		t.Errorf("Expected DISCONNECT with reason code Quota exceeded, but got: %+v", last)
+	}
+	if disconnects := atomic.LoadUint64(&b.Info.SlowConsumerDisconnects); disconnects != 1 {
+		t.Errorf("Expected 1 slow consumer disconnect, but got %d", disconnects)
+	}
+}
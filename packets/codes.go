@@ -13,3 +13,69 @@ var (
 	BAD_USERNAME_OR_PASSWORD      = Code{0x04, "Connection Refused, bad user name or password"}
 	NOT_AUTHORIZED                = Code{0x05, "Connection Refused, not authorized"}
 )
+
+// MQTT 5.0 reason codes [MQTT-2.4]
+var (
+	SUCCESS                                = Code{0x00, "Success"}
+	GRANTED_QOS_1                          = Code{0x01, "Granted QoS 1"}
+	GRANTED_QOS_2                          = Code{0x02, "Granted QoS 2"}
+	DISCONNECT_WITH_WILL_MESSAGE           = Code{0x04, "Disconnect with Will Message"}
+	NO_MATCHING_SUBSCRIBERS                = Code{0x10, "No matching subscribers"}
+	NO_SUBSCRIPTION_EXISTED                = Code{0x11, "No subscription existed"}
+	CONTINUE_AUTHENTICATION                = Code{0x18, "Continue authentication"}
+	RE_AUTHENTICATE                        = Code{0x19, "Re-authenticate"}
+	UNSPECIFIED_ERROR                      = Code{0x80, "Unspecified error"}
+	MALFORMED_PACKET                       = Code{0x81, "Malformed Packet"}
+	PROTOCOL_ERROR                         = Code{0x82, "Protocol Error"}
+	IMPLEMENTATION_SPECIFIC_ERROR          = Code{0x83, "Implementation specific error"}
+	UNSUPPORTED_PROTOCOL_VERSION           = Code{0x84, "Unsupported Protocol Version"}
+	CLIENT_IDENTIFIER_NOT_VALID            = Code{0x85, "Client Identifier not valid"}
+	BAD_USER_NAME_OR_PASSWORD              = Code{0x86, "Bad User Name or Password"}
+	NOT_AUTHORIZED_V5                      = Code{0x87, "Not authorized"}
+	SERVER_UNAVAILABLE_V5                  = Code{0x88, "Server unavailable"}
+	SERVER_BUSY                            = Code{0x89, "Server busy"}
+	BANNED                                 = Code{0x8A, "Banned"}
+	SERVER_SHUTTING_DOWN                   = Code{0x8B, "Server shutting down"}
+	BAD_AUTHENTICATION_METHOD              = Code{0x8C, "Bad authentication method"}
+	KEEP_ALIVE_TIMEOUT                     = Code{0x8D, "Keep Alive timeout"}
+	SESSION_TAKEN_OVER                     = Code{0x8E, "Session taken over"}
+	TOPIC_FILTER_INVALID                   = Code{0x8F, "Topic Filter invalid"}
+	TOPIC_NAME_INVALID                     = Code{0x90, "Topic Name invalid"}
+	PACKET_IDENTIFIER_IN_USE               = Code{0x91, "Packet Identifier in use"}
+	PACKET_IDENTIFIER_NOT_FOUND            = Code{0x92, "Packet Identifier not found"}
+	RECEIVE_MAXIMUM_EXCEEDED               = Code{0x93, "Receive Maximum exceeded"}
+	TOPIC_ALIAS_INVALID                    = Code{0x94, "Topic Alias invalid"}
+	PACKET_TOO_LARGE                       = Code{0x95, "Packet too large"}
+	MESSAGE_RATE_TOO_HIGH                  = Code{0x96, "Message rate too high"}
+	QUOTA_EXCEEDED                         = Code{0x97, "Quota exceeded"}
+	ADMINISTRATIVE_ACTION                  = Code{0x98, "Administrative action"}
+	PAYLOAD_FORMAT_INVALID                 = Code{0x99, "Payload format invalid"}
+	RETAIN_NOT_SUPPORTED                   = Code{0x9A, "Retain not supported"}
+	QOS_NOT_SUPPORTED                      = Code{0x9B, "QoS not supported"}
+	USE_ANOTHER_SERVER                     = Code{0x9C, "Use another server"}
+	SERVER_MOVED                           = Code{0x9D, "Server moved"}
+	SHARED_SUBSCRIPTIONS_NOT_SUPPORTED     = Code{0x9E, "Shared Subscriptions not supported"}
+	CONNECTION_RATE_EXCEEDED               = Code{0x9F, "Connection rate exceeded"}
+	MAXIMUM_CONNECT_TIME                   = Code{0xA0, "Maximum connect time"}
+	SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED = Code{0xA1, "Subscription Identifiers not supported"}
+	WILDCARD_SUBSCRIPTIONS_NOT_SUPPORTED   = Code{0xA2, "Wildcard Subscriptions not supported"}
+)
+
+// connackV5Codes translates MQTT 3.1.1 CONNACK return codes to their MQTT 5.0 reason codes
+var connackV5Codes = map[byte]Code{
+	ACCEPTED.Code:                      SUCCESS,
+	UNACCEPTABLE_PROTOCOL_VERSION.Code: UNSUPPORTED_PROTOCOL_VERSION,
+	IDENTIFIER_REJECTED.Code:           CLIENT_IDENTIFIER_NOT_VALID,
+	SERVER_UNAVAILABLE.Code:            SERVER_UNAVAILABLE_V5,
+	BAD_USERNAME_OR_PASSWORD.Code:      BAD_USER_NAME_OR_PASSWORD,
+	NOT_AUTHORIZED.Code:                NOT_AUTHORIZED_V5,
+}
+
+// V5 returns the MQTT 5.0 reason code for a MQTT 3.1.1 CONNACK return code.
+// Codes that are already MQTT 5.0 reason codes are returned unchanged.
+func (c Code) V5() Code {
+	if v5, ok := connackV5Codes[c.Code]; ok {
+		return v5
+	}
+	return c
+}
@@ -1,9 +1,13 @@
 package packets
 
+import "fmt"
+
 type Connack struct {
-	FixedHeader    *FixedHeader
-	SessionPresent bool
-	ReturnCode     Code
+	FixedHeader     *FixedHeader
+	SessionPresent  bool
+	ReturnCode      Code
+	ProtocolVersion byte
+	Properties      *Properties // MQTT 5.0 only
 }
 
 func NewConnack(code Code, sessionPresent bool) *Connack {
@@ -18,12 +22,17 @@ func NewConnack(code Code, sessionPresent bool) *Connack {
 }
 
 func (cack *Connack) Encode() []byte {
+	if cack.ProtocolVersion == MQTT5 {
+		return cack.encodeV5()
+	}
+
 	buffer := make([]byte, 4)
 	buffer[0] = 0x2 << 4
 	buffer[1] = 0x2
 
 	// ugly but go is kinda stupid when it comes to booleans
-	if cack.SessionPresent {
+	// MQTT 3.1 has no session present flag, the byte is reserved
+	if cack.SessionPresent && cack.ProtocolVersion != MQTT31 {
 		buffer[2] = 0x1
 	} else {
 		buffer[2] = 0x0
@@ -32,3 +41,51 @@ func (cack *Connack) Encode() []byte {
 	buffer[3] = cack.ReturnCode.Code
 	return buffer
 }
+
+// encodeV5 encodes the CONNACK with a MQTT 5.0 reason code and properties
+func (cack *Connack) encodeV5() []byte {
+	var variableHeader []byte
+	if cack.SessionPresent {
+		variableHeader = append(variableHeader, 0x1)
+	} else {
+		variableHeader = append(variableHeader, 0x0)
+	}
+	variableHeader = append(variableHeader, cack.ReturnCode.V5().Code)
+	variableHeader = append(variableHeader, cack.Properties.Encode()...)
+
+	cack.FixedHeader.RemainingLength = uint32(len(variableHeader))
+	return append(cack.FixedHeader.Encode(), variableHeader...)
+}
+
+// DecodeConnack reads the session present flag, the return code and the MQTT 5.0 properties of a CONNACK
+func (p *Packet) DecodeConnack(buf []byte) error {
+	// all but the session present bit are reserved [MQTT-3.2.2-1]
+	if buf[0]&0xFE != 0 {
+		return &ErrMalformedPacket{CONNACK, "reserved connect acknowledge flags set"}
+	}
+	p.SessionPresent = buf[0] == 0x01
+	p.ReasonCode = buf[1]
+
+	// a refused connection has no session [MQTT-3.2.2-4]
+	if p.SessionPresent && p.ReasonCode != ACCEPTED.Code {
+		return &ErrMalformedPacket{CONNACK, "session present on a refused connection"}
+	}
+
+	if p.ProtocolVersion != MQTT5 {
+		if p.ReasonCode > NOT_AUTHORIZED.Code {
+			return &ErrMalformedPacket{CONNACK, fmt.Sprintf("reserved return code 0x%02X", p.ReasonCode)}
+		}
+		return nil
+	}
+
+	var err error
+	var rest []byte
+	p.Properties, rest, err = DecodeProperties(buf[2:])
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return &ErrMalformedPacket{CONNACK, "unexpected data after the properties"}
+	}
+	return nil
+}
@@ -2,6 +2,20 @@ package packets
 
 const UTF8BytesLength = 2
 
+// supported protocol levels
+const (
+	MQTT31  byte = 0x03
+	MQTT311 byte = 0x04
+	MQTT5   byte = 0x05
+)
+
+// protocol name used by each protocol level
+var protocolNames = map[byte]string{
+	MQTT31:  "MQIsdp",
+	MQTT311: "MQTT",
+	MQTT5:   "MQTT",
+}
+
 type ConnectFlags struct {
 	usernameFlag bool
 	passwordFlag bool
@@ -13,20 +27,27 @@ type ConnectFlags struct {
 }
 
 type ConnectOptions struct {
-	ProtocolLevel byte
-	ClientID      string
-	Username      string
-	Password      string
-	WillTopic     string
-	WillMessage   string
-	WillRetain    bool
-	WillQoS       byte
-	CleanSession  bool
-	Keepalive     uint16
+	ProtocolLevel  byte
+	ClientID       string
+	Username       string
+	Password       string
+	WillTopic      string
+	WillMessage    string
+	WillRetain     bool
+	WillQoS        byte
+	CleanSession   bool
+	Keepalive      uint16
+	Properties     *Properties // MQTT 5.0 CONNECT properties
+	WillProperties *Properties // MQTT 5.0 will properties
 }
 
 func (co *ConnectOptions) Copy() *ConnectOptions {
+	if co == nil {
+		return nil
+	}
 	connectionOptions := *co
+	connectionOptions.Properties = co.Properties.Copy()
+	connectionOptions.WillProperties = co.WillProperties.Copy()
 	return &connectionOptions
 }
 
@@ -34,35 +55,101 @@ type ErrWrongProtocolName struct{}
 type ErrWrongProtocolLevel struct{}
 
 func (e *ErrWrongProtocolName) Error() string {
-	return "Reserved bit of flag byte in CONNECT packet is not 0"
+	return "Wrong protocol name"
 }
 
 func (e *ErrWrongProtocolLevel) Error() string {
 	return "Wrong protocol level"
 }
 
+// ErrMalformedConnect is returned for a CONNECT packet that can't be accepted once its protocol level is known,
+// so the refusal can be sent in the encoding of the protocol level
+type ErrMalformedConnect struct {
+	ProtocolLevel byte
+	Err           error
+}
+
+func (e *ErrMalformedConnect) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ErrMalformedConnect) Unwrap() error {
+	return e.Err
+}
+
 func DecodeConnect(buffer []byte) (*ConnectOptions, error) {
-	if protocolName, _ := DecodeUTF8String(buffer[0:]); protocolName != "MQTT" {
+	protocolName, buffer, err := decodeString(buffer, CONNECT)
+	if err != nil {
+		return nil, err
+	}
+	if protocolName != "MQTT" && protocolName != "MQIsdp" {
 		return nil, &ErrWrongProtocolName{}
 	}
 
-	if buffer[6] != 0x04 {
+	// protocol level, connect flags and keep alive
+	if len(buffer) < 4 {
+		return nil, &ErrMalformedPacket{CONNECT, "truncated variable header"}
+	}
+
+	protocolLevel := buffer[0]
+	if name, ok := protocolNames[protocolLevel]; !ok || name != protocolName {
 		return nil, &ErrWrongProtocolLevel{}
 	}
 
-	connectFlags := buffer[7]
+	co, err := decodeConnectFlagsAndPayload(protocolLevel, buffer[1:])
+	if err != nil {
+		return nil, &ErrMalformedConnect{protocolLevel, err}
+	}
+	return co, nil
+}
+
+// decodeConnectFlagsAndPayload reads the rest of the CONNECT packet following the protocol level
+func decodeConnectFlagsAndPayload(protocolLevel byte, buffer []byte) (*ConnectOptions, error) {
+	connectFlags := buffer[0]
+	// [MQTT-3.1.2-3]
 	if connectFlags&0x1 != 0 {
-		return nil, &ErrWrongProtocolName{}
+		return nil, &ErrMalformedPacket{CONNECT, "reserved connect flag set"}
 	}
 
 	cf := DecodeConnectFlags(connectFlags)
-	cf.keepalive = uint16(buffer[8])<<8 | uint16(buffer[9])
+	if err := cf.validate(protocolLevel); err != nil {
+		return nil, err
+	}
+	cf.keepalive = uint16(buffer[1])<<8 | uint16(buffer[2])
 
-	co := DecodeConnectOptions(cf, buffer[10:])
-	co.ProtocolLevel = buffer[6]
+	if protocolLevel == MQTT5 {
+		return decodeConnectV5(cf, buffer[3:])
+	}
+
+	co, err := DecodeConnectOptions(cf, buffer[3:])
+	if err != nil {
+		return nil, err
+	}
+	co.ProtocolLevel = protocolLevel
 	return co, nil
 }
 
+// decodeConnectV5 reads the MQTT 5.0 CONNECT properties and payload.
+// Unlike 3.1.1, the will is preceded by will properties and a password may be sent without a username.
+func decodeConnectV5(cf *ConnectFlags, buffer []byte) (*ConnectOptions, error) {
+	var err error
+	copts := &ConnectOptions{
+		ProtocolLevel: MQTT5,
+		CleanSession:  cf.cleanSession,
+		Keepalive:     cf.keepalive,
+	}
+
+	copts.Properties, buffer, err = DecodeProperties(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := copts.decodePayload(cf, buffer); err != nil {
+		return nil, err
+	}
+	return copts, nil
+}
+
 func DecodeConnectFlags(flags byte) *ConnectFlags {
 	cf := &ConnectFlags{}
 	cf.usernameFlag = flags&0x80 != 0
@@ -74,34 +161,136 @@ func DecodeConnectFlags(flags byte) *ConnectFlags {
 	return cf
 }
 
+// validate checks the combinations of connect flags that are not allowed
+func (cf *ConnectFlags) validate(protocolLevel byte) error {
+	// [MQTT-3.1.2-14]
+	if cf.willQoS > 2 {
+		return &ErrInvalidQoS{}
+	}
+	// [MQTT-3.1.2-11] [MQTT-3.1.2-13] [MQTT-3.1.2-15]
+	if !cf.willFlag && (cf.willQoS != 0 || cf.willRetain) {
+		return &ErrMalformedPacket{CONNECT, "will QoS or will retain set without a will"}
+	}
+	// MQTT 5.0 allows a password without a username [MQTT-3.1.2-22]
+	if protocolLevel != MQTT5 && cf.passwordFlag && !cf.usernameFlag {
+		return &ErrMalformedPacket{CONNECT, "password without a username"}
+	}
+	return nil
+}
+
 // DecodeConnectOptions reads the payload of the connect packet
-func DecodeConnectOptions(cf *ConnectFlags, buffer []byte) *ConnectOptions {
+func DecodeConnectOptions(cf *ConnectFlags, buffer []byte) (*ConnectOptions, error) {
 	copts := &ConnectOptions{
 		CleanSession: cf.cleanSession,
 		Keepalive:    cf.keepalive,
 	}
 
-	copts.ClientID, buffer = DecodeUTF8StringInc(buffer)
+	if err := copts.decodePayload(cf, buffer); err != nil {
+		return nil, err
+	}
+	return copts, nil
+}
+
+// decodePayload reads the client identifier, will, username and password the connect flags announce.
+// The will properties of MQTT 5.0 precede the will topic.
+func (co *ConnectOptions) decodePayload(cf *ConnectFlags, buffer []byte) error {
+	var err error
+	co.ClientID, buffer, err = decodeString(buffer, CONNECT)
+	if err != nil {
+		return err
+	}
 
 	if cf.willFlag {
-		copts.WillTopic, buffer = DecodeUTF8StringInc(buffer)
-		copts.WillMessage, buffer = DecodeUTF8StringInc(buffer)
-		copts.WillQoS = cf.willQoS
-		copts.WillRetain = cf.willRetain
+		if co.ProtocolLevel == MQTT5 {
+			co.WillProperties, buffer, err = DecodeProperties(buffer)
+			if err != nil {
+				return err
+			}
+		}
+		co.WillTopic, buffer, err = decodeString(buffer, CONNECT)
+		if err != nil {
+			return err
+		}
+		if !IsValidTopicName(co.WillTopic) {
+			return &ErrMalformedPacket{CONNECT, "invalid will topic"}
+		}
+		var willMessage []byte
+		willMessage, buffer, err = decodeBinary(buffer, CONNECT)
+		if err != nil {
+			return err
+		}
+		co.WillMessage = string(willMessage)
+		co.WillQoS = cf.willQoS
+		co.WillRetain = cf.willRetain
 	}
 
 	if cf.usernameFlag {
-		copts.Username, buffer = DecodeUTF8StringInc(buffer)
+		co.Username, buffer, err = decodeString(buffer, CONNECT)
+		if err != nil {
+			return err
+		}
 	}
 
 	if cf.passwordFlag {
-		copts.Password, _ = DecodeUTF8StringInc(buffer)
+		var password []byte
+		password, buffer, err = decodeBinary(buffer, CONNECT)
+		if err != nil {
+			return err
+		}
+		co.Password = string(password)
 	}
 
-	if cf.passwordFlag && !cf.usernameFlag {
-		// TODO: send connack packet with the proper fail return code
-		panic("Password flag set but username flag not set")
+	if len(buffer) > 0 {
+		return &ErrMalformedPacket{CONNECT, "unexpected data after the payload"}
+	}
+	return nil
+}
+
+// Encode encodes a CONNECT packet with the options.
+// The will, username and password are only included if they are not empty,
+// an empty username is included with a password before MQTT 5.0 [MQTT-3.1.2-22].
+func (co *ConnectOptions) Encode() []byte {
+	usernameFlag := co.Username != "" || (co.Password != "" && co.ProtocolLevel != MQTT5)
+
+	var flags byte
+	if usernameFlag {
+		flags |= 0x80
+	}
+	if co.Password != "" {
+		flags |= 0x40
+	}
+	if co.WillTopic != "" {
+		flags |= 0x04 | co.WillQoS<<3
+		if co.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if co.CleanSession {
+		flags |= 0x02
+	}
+
+	var buffer []byte
+	buffer = append(buffer, EncodeUTF8String(protocolNames[co.ProtocolLevel])...)
+	buffer = append(buffer, co.ProtocolLevel, flags, byte(co.Keepalive>>8), byte(co.Keepalive))
+	if co.ProtocolLevel == MQTT5 {
+		buffer = append(buffer, co.Properties.Encode()...)
+	}
+
+	buffer = append(buffer, EncodeUTF8String(co.ClientID)...)
+	if co.WillTopic != "" {
+		if co.ProtocolLevel == MQTT5 {
+			buffer = append(buffer, co.WillProperties.Encode()...)
+		}
+		buffer = append(buffer, EncodeUTF8String(co.WillTopic)...)
+		buffer = append(buffer, EncodeUTF8String(co.WillMessage)...)
+	}
+	if usernameFlag {
+		buffer = append(buffer, EncodeUTF8String(co.Username)...)
+	}
+	if co.Password != "" {
+		buffer = append(buffer, EncodeUTF8String(co.Password)...)
 	}
 
-	return copts
+	fixedHeader := &FixedHeader{MessageType: CONNECT, RemainingLength: uint32(len(buffer))}
+	return append(fixedHeader.Encode(), buffer...)
 }
@@ -0,0 +1,136 @@
+package packets
+
+import "testing"
+
+func TestDecodeConnect_V5(t *testing.T) {
+	buffer := []byte{
+		0x00, 0x04, 'M', 'Q', 'T', 'T', // protocol name
+		0x05,       // protocol level
+		0xC2,       // username, password, clean start
+		0x00, 0x3C, // keepalive
+		0x05, 0x11, 0x00, 0x00, 0x00, 0x78, // session expiry interval 120
+		0x00, 0x02, 'i', 'd', // client id
+		0x00, 0x02, 'u', 'n', // username
+		0x00, 0x02, 'p', 'w', // password
+	}
+
+	co, err := DecodeConnect(buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if co.ProtocolLevel != MQTT5 || co.ClientID != "id" || co.Username != "un" || co.Password != "pw" || !co.CleanSession || co.Keepalive != 60 {
+		t.Errorf("Unexpected connect options: %+v", co)
+	}
+
+	if co.Properties.SessionExpiryInterval == nil || *co.Properties.SessionExpiryInterval != 120 {
+		t.Errorf("Expected session expiry interval 120, got: %v", co.Properties.SessionExpiryInterval)
+	}
+}
+
+func TestDecodeConnect_UnsupportedLevel(t *testing.T) {
+	buffer := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x06, 0x02, 0x00, 0x3C, 0x00, 0x00}
+
+	if _, err := DecodeConnect(buffer); err == nil {
+		t.Errorf("Expected error for protocol level 6")
+	} else if _, ok := err.(*ErrWrongProtocolLevel); !ok {
+		t.Errorf("Expected ErrWrongProtocolLevel, but got: %v", err)
+	}
+}
+
+func TestDecodeConnect_V31(t *testing.T) {
+	buffer := []byte{
+		0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', // protocol name
+		0x03,       // protocol level
+		0x02,       // clean session
+		0x00, 0x0A, // keepalive
+		0x00, 0x02, 'i', 'd', // client id
+	}
+
+	co, err := DecodeConnect(buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if co.ProtocolLevel != MQTT31 || co.ClientID != "id" || !co.CleanSession || co.Keepalive != 10 {
+		t.Errorf("Unexpected connect options: %+v", co)
+	}
+}
+
+func TestDecodeConnect_ProtocolNameMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+	}{
+		{
+			name:   "MQIsdp with level 4",
+			buffer: []byte{0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', 0x04, 0x02, 0x00, 0x0A, 0x00, 0x00},
+		},
+		{
+			name:   "MQTT with level 3",
+			buffer: []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x03, 0x02, 0x00, 0x0A, 0x00, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeConnect(test.buffer); err == nil {
+				t.Errorf("Expected error")
+			} else if _, ok := err.(*ErrWrongProtocolLevel); !ok {
+				t.Errorf("Expected ErrWrongProtocolLevel, but got: %v", err)
+			}
+		})
+	}
+}
+
+func TestConnack_EncodeV31(t *testing.T) {
+	connack := NewConnack(ACCEPTED, true)
+	connack.ProtocolVersion = MQTT31
+
+	expected := []byte{0x20, 0x02, 0x00, 0x00}
+	if got := connack.Encode(); string(got) != string(expected) {
+		t.Errorf("Expected: %v, but got: %v", expected, got)
+	}
+}
+
+func TestDecodeConnect_Malformed(t *testing.T) {
+	tests := []struct {
+		name          string
+		buffer        []byte
+		protocolLevel byte
+	}{
+		{
+			name:          "MQTT 3.1.1 without client identifier",
+			buffer:        []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C},
+			protocolLevel: MQTT311,
+		},
+		{
+			name:          "MQTT 5.0 with truncated properties",
+			buffer:        []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x3C, 0x05, 0x11, 0x00},
+			protocolLevel: MQTT5,
+		},
+		{
+			name:          "MQTT 5.0 with truncated will",
+			buffer:        []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x06, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 'w'},
+			protocolLevel: MQTT5,
+		},
+		{
+			name:          "MQTT 5.0 with invalid UTF-8 username",
+			buffer:        []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x82, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x00, 0x02, 0xC3, 0x28},
+			protocolLevel: MQTT5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeConnect(test.buffer)
+			connectErr, ok := err.(*ErrMalformedConnect)
+			if !ok {
+				t.Fatalf("Expected ErrMalformedConnect, but got: %v", err)
+			}
+			if connectErr.ProtocolLevel != test.protocolLevel {
+				t.Errorf("Expected protocol level %d, but got: %d", test.protocolLevel, connectErr.ProtocolLevel)
+			}
+		})
+	}
+}
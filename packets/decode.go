@@ -1,7 +1,12 @@
 package packets
 
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
 func DecodeUTF8String(buf []byte) (string, uint16) {
-	if len(buf) == 0 {
+	if len(buf) < 2 {
 		return "", 0
 	}
 	// first two bytes are the length of the string
@@ -12,9 +17,47 @@ func DecodeUTF8String(buf []byte) (string, uint16) {
 	return string(buf[2 : length+2]), length
 }
 
+// DecodeUTF8StringInc reads a length prefixed string and returns the rest of the buffer,
+// an empty string and no remaining data if the string doesn't fit in the buffer
 func DecodeUTF8StringInc(buf []byte) (string, []byte) {
-	rez, length := DecodeUTF8String(buf)
-	return rez, buf[length+2:]
+	data, rest, err := decodeBinary(buf, RESERVED)
+	if err != nil {
+		return "", nil
+	}
+	return string(data), rest
+}
+
+// decodeString reads a length prefixed string, which must be well-formed UTF-8 without
+// null characters [MQTT-1.5.4-1] [MQTT-1.5.4-2]. Returns the rest of the buffer.
+func decodeString(buf []byte, messageType byte) (string, []byte, error) {
+	data, rest, err := decodeBinary(buf, messageType)
+	if err != nil {
+		return "", nil, err
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return "", nil, &ErrMalformedPacket{messageType, "invalid UTF-8 string"}
+	}
+	return string(data), rest, nil
+}
+
+// decodeBinary reads length prefixed binary data and returns the rest of the buffer
+func decodeBinary(buf []byte, messageType byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, &ErrMalformedPacket{messageType, "truncated string length"}
+	}
+	length := int(buf[0])<<8 | int(buf[1])
+	if length > len(buf)-2 {
+		return nil, nil, &ErrMalformedPacket{messageType, "string longer than the packet"}
+	}
+	return buf[2 : length+2], buf[length+2:], nil
+}
+
+// decodeUint16 reads a two byte integer and returns the rest of the buffer
+func decodeUint16(buf []byte, messageType byte) (uint16, []byte, error) {
+	if len(buf) < 2 {
+		return 0, nil, &ErrMalformedPacket{messageType, "truncated two byte integer"}
+	}
+	return uint16(buf[0])<<8 | uint16(buf[1]), buf[2:], nil
 }
 
 func (p *Packet) DecodePacketIdentifier(buf []byte) []byte {
@@ -0,0 +1,54 @@
+package packets
+
+// NewDisconnect builds a DISCONNECT packet. Reason code is only encoded for MQTT 5.0 connections.
+func NewDisconnect(code Code, protocolVersion byte) *Packet {
+	return &Packet{
+		FixedHeader: &FixedHeader{
+			MessageType: DISCONNECT,
+		},
+		ProtocolVersion: protocolVersion,
+		ReasonCode:      code.Code,
+	}
+}
+
+// DecodeDisconnect reads the optional MQTT 5.0 reason code and properties.
+// A remaining length of 0 means reason code 0x00 (Normal disconnection).
+func (p *Packet) DecodeDisconnect(buf []byte) error {
+	if p.ProtocolVersion != MQTT5 || len(buf) == 0 {
+		return nil
+	}
+
+	return p.decodeReasonCodeAndProperties(buf)
+}
+
+// DecodeAuth reads the reason code and properties of a MQTT 5.0 AUTH packet
+func (p *Packet) DecodeAuth(buf []byte) error {
+	return p.DecodeDisconnect(buf)
+}
+
+func (p *Packet) EncodeDisconnect() []byte {
+	var variableHeader []byte
+	if p.ProtocolVersion == MQTT5 && (p.ReasonCode != SUCCESS.Code || p.Properties != nil) {
+		variableHeader = append(variableHeader, p.ReasonCode)
+		variableHeader = append(variableHeader, p.Properties.Encode()...)
+	}
+	p.FixedHeader.RemainingLength = uint32(len(variableHeader))
+	return append(p.FixedHeader.Encode(), variableHeader...)
+}
+
+// NewAuth builds a MQTT 5.0 AUTH packet
+func NewAuth(code Code, properties *Properties) *Packet {
+	return &Packet{
+		FixedHeader: &FixedHeader{
+			MessageType: AUTH,
+		},
+		ProtocolVersion: MQTT5,
+		ReasonCode:      code.Code,
+		Properties:      properties,
+	}
+}
+
+// EncodeAuth encodes a MQTT 5.0 AUTH packet, which has the same layout as DISCONNECT
+func (p *Packet) EncodeAuth() []byte {
+	return p.EncodeDisconnect()
+}
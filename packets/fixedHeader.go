@@ -2,10 +2,12 @@ package packets
 
 import (
 	"bufio"
-	"fmt"
+	"errors"
 	"io"
 )
 
+var errMalformedRemainingLength = errors.New("malformed remaining length")
+
 type FixedHeader struct {
 	MessageType     byte
 	Dup             bool   // duplicate delivery flag
@@ -29,14 +31,34 @@ func (f *FixedHeader) Encode() []byte {
 	if f.Retain {
 		buf[0] |= 0x01
 	}
-	buf = append(buf, f.encodeRemainingLength()...)
+	buf = append(buf, encodeVarint(f.RemainingLength)...)
 	return buf
 }
 
-func (f *FixedHeader) encodeRemainingLength() []byte {
+// PacketSize returns the size of the whole packet, the fixed header and the remaining length
+func (f *FixedHeader) PacketSize() uint32 {
+	size := 1 + f.RemainingLength
+	for length := f.RemainingLength; ; length /= 128 {
+		size++
+		if length < 128 {
+			return size
+		}
+	}
+}
+
+// CheckSize returns ErrPacketTooLarge if the packet exceeds maximum bytes, 0 allows packets of any size
+func (f *FixedHeader) CheckSize(maximum uint32) error {
+	if maximum > 0 && f.PacketSize() > maximum {
+		return &ErrPacketTooLarge{f.MessageType, f.PacketSize(), maximum}
+	}
+	return nil
+}
+
+// encodeVarint encodes a variable byte integer as used by the remaining length
+// and MQTT 5.0 property lengths
+func encodeVarint(remainingLength uint32) []byte {
 	var encodedByte byte
 	var buffer []byte
-	remainingLength := f.RemainingLength
 
 	for {
 		encodedByte = byte(remainingLength % 128)
@@ -66,6 +88,9 @@ func DecodeFixedHeader(byteReader *bufio.Reader) (*FixedHeader, error) {
 
 	fixedHeader.RemainingLength, err = decodeRemainingLength(byteReader)
 
+	if err == errMalformedRemainingLength {
+		return nil, &ErrMalformedPacket{fixedHeader.MessageType, err.Error()}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -79,27 +104,19 @@ func decodeFirstByte(fh *FixedHeader, b byte) {
 	fh.Retain = b&0x01 == 0x01
 }
 
-// decodes the remaining length from the fixed header
+// decodes the remaining length from the fixed header, a variable byte integer of at most 4 bytes [MQTT-1.5.5]
 func decodeRemainingLength(byteReader io.ByteReader) (uint32, error) {
-	var multiplier uint32 = 1
-	var value uint32 = 0
-	var encodedByte byte
-	var err error
+	var value uint32
 
-	for {
-		encodedByte, err = byteReader.ReadByte()
+	for i := 0; i < 4; i++ {
+		encodedByte, err := byteReader.ReadByte()
 		if err != nil {
 			return 0, err
 		}
-		value += uint32(encodedByte&127) * multiplier
-		multiplier *= 128
-		if value > 128*128*128 {
-			return 0, fmt.Errorf("malformed remaining length")
-		}
+		value |= uint32(encodedByte&127) << (7 * i)
 		if encodedByte&128 == 0 {
-			break
+			return value, nil
 		}
 	}
-	return value, nil
+	return 0, errMalformedRemainingLength
 }
-
@@ -39,6 +39,12 @@ func TestDecodeRemainingLength(t *testing.T) {
 			expectedValue: 2097152,
 			expectedError: nil,
 		},
+		{
+			name:          "Valid remaining length - maximum",
+			readData:      []byte{0xFF, 0xFF, 0xFF, 0x7F},
+			expectedValue: 268435455,
+			expectedError: nil,
+		},
 		{
 			name:          "Invalid remaining length - exceeds maximum",
 			readData:      []byte{0x80, 0x80, 0x80, 0x80, 0x01},
@@ -128,3 +134,47 @@ func TestFixedHeader_Encode(t *testing.T) {
 		})
 	}
 }
+
+func TestFixedHeader_PacketSize(t *testing.T) {
+	tests := []struct {
+		remainingLength uint32
+		expectedSize    uint32
+	}{
+		{0, 2},
+		{127, 129},
+		{128, 131},
+		{16383, 16386},
+		{16384, 16388},
+		{268435455, 268435460},
+	}
+
+	for _, test := range tests {
+		fh := &FixedHeader{MessageType: PUBLISH, RemainingLength: test.remainingLength}
+		if size := fh.PacketSize(); size != test.expectedSize {
+			t.Errorf("Expected size %d for remaining length %d, but got: %d", test.expectedSize, test.remainingLength, size)
+		}
+		if size := uint32(len(fh.Encode())) + test.remainingLength; size != test.expectedSize {
+			t.Errorf("Expected encoded size %d for remaining length %d, but got: %d", test.expectedSize, test.remainingLength, size)
+		}
+	}
+}
+
+func TestFixedHeader_CheckSize(t *testing.T) {
+	fh := &FixedHeader{MessageType: PUBLISH, RemainingLength: 200}
+
+	if err := fh.CheckSize(0); err != nil {
+		t.Errorf("Expected no limit for maximum 0, but got: %v", err)
+	}
+	if err := fh.CheckSize(203); err != nil {
+		t.Errorf("Expected packet of 203 bytes to fit, but got: %v", err)
+	}
+
+	err := fh.CheckSize(202)
+	tooLarge, ok := err.(*ErrPacketTooLarge)
+	if !ok {
+		t.Fatalf("Expected ErrPacketTooLarge, but got: %v", err)
+	}
+	if tooLarge.Size != 203 || tooLarge.Maximum != 202 {
+		t.Errorf("Unexpected error: %+v", tooLarge)
+	}
+}
@@ -0,0 +1,188 @@
+package packets
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var fuzzProtocolVersions = []byte{MQTT31, MQTT311, MQTT5}
+
+// fuzzSeeds returns valid packets of the type in every protocol version, used to seed the fuzz targets
+func fuzzSeeds(messageType byte) []*Packet {
+	expiry := uint32(30)
+	props := &Properties{ReasonString: "because", UserProperties: []UserProperty{{"k", "v"}}}
+	subscriptions := &Subscriptions{
+		Subscriptions:        map[string]byte{"a/+": 1, "$share/g/b/#": 2},
+		OrderedSubscriptions: []string{"a/+", "$share/g/b/#"},
+		Options: map[string]SubscriptionOptions{
+			"a/+":          {QoS: 1, NoLocal: true, RetainHandling: 2},
+			"$share/g/b/#": {QoS: 2, RetainAsPublished: true},
+		},
+	}
+
+	var seeds []*Packet
+	for _, protocolVersion := range fuzzProtocolVersions {
+		var packet *Packet
+		switch messageType {
+		case CONNECT:
+			packet = &Packet{FixedHeader: &FixedHeader{MessageType: CONNECT}, ConnectOptions: &ConnectOptions{
+				ProtocolLevel: protocolVersion, ClientID: "client", Username: "user", Password: "pass",
+				WillTopic: "will", WillMessage: "gone", WillQoS: 1, WillRetain: true, CleanSession: true, Keepalive: 60,
+			}}
+			if protocolVersion == MQTT5 {
+				packet.ConnectOptions.Properties = &Properties{SessionExpiryInterval: &expiry}
+				packet.ConnectOptions.WillProperties = props
+			}
+		case CONNACK:
+			packet = &Packet{FixedHeader: &FixedHeader{MessageType: CONNACK}, SessionPresent: true}
+		case PUBLISH:
+			packet = &Packet{FixedHeader: &FixedHeader{MessageType: PUBLISH, Qos: 1, Retain: true}, PublishTopic: "a/b", PacketIdentifier: 7, Payload: []byte("data")}
+		case PUBREL, SUBSCRIBE, UNSUBSCRIBE:
+			packet = &Packet{FixedHeader: &FixedHeader{MessageType: messageType, Qos: 1}, PacketIdentifier: 3, Subscriptions: subscriptions}
+		case SUBACK, UNSUBACK:
+			packet = &Packet{FixedHeader: &FixedHeader{MessageType: messageType}, PacketIdentifier: 3, ReasonCodes: []byte{1, 0x80}}
+		case AUTH:
+			packet = NewAuth(CONTINUE_AUTHENTICATION, &Properties{AuthenticationMethod: "SCRAM-SHA-1"})
+		default:
+			packet = &Packet{FixedHeader: &FixedHeader{MessageType: messageType}, PacketIdentifier: 3}
+		}
+		packet.ProtocolVersion = protocolVersion
+		if protocolVersion == MQTT5 && packet.Properties == nil && messageType != CONNECT {
+			packet.Properties = props
+		}
+		seeds = append(seeds, packet)
+	}
+	return seeds
+}
+
+// fuzzDecoder fuzzes the decoding of the variable header and payload of a packet type. Packets that are
+// accepted must encode to a packet that decodes to the same encoding again.
+func fuzzDecoder(f *testing.F, messageType byte) {
+	for _, seed := range fuzzSeeds(messageType) {
+		encoded := seed.Encode()
+		reader := bufio.NewReader(bytes.NewReader(encoded))
+		fh, err := DecodeFixedHeader(reader)
+		if err != nil {
+			f.Fatalf("Unexpected error: %v", err)
+		}
+		f.Add(encoded[0]&0x0F, encoded[len(encoded)-int(fh.RemainingLength):], seed.ProtocolVersion)
+	}
+
+	f.Fuzz(func(t *testing.T, flags byte, buf []byte, protocolVersion byte) {
+		fh := new(FixedHeader)
+		decodeFirstByte(fh, messageType<<4|flags&0x0F)
+		fh.RemainingLength = uint32(len(buf))
+
+		packet, err := DecodePacket(fh, buf, protocolVersion)
+		if err != nil {
+			if packet != nil {
+				t.Errorf("Expected no packet on error, but got: %+v", packet)
+			}
+			return
+		}
+		checkReencoded(t, packet)
+	})
+}
+
+// checkReencoded checks the encoding of a decoded packet can be decoded and encodes the same way again.
+// The encoding may differ from the decoded one, e.g. the options of a topic filter requested twice are merged.
+func checkReencoded(t *testing.T, packet *Packet) {
+	t.Helper()
+	encoded := packet.Encode()
+	reader := bufio.NewReader(bytes.NewReader(encoded))
+	fh, err := DecodeFixedHeader(reader)
+	if err != nil {
+		t.Fatalf("Encoded packet %x has an invalid fixed header: %v", encoded, err)
+	}
+	decoded, err := ParsePacket(fh, reader, packet.ProtocolVersion)
+	if err != nil {
+		t.Fatalf("Encoded packet %x can't be decoded: %v", encoded, err)
+	}
+	if reencoded := decoded.Encode(); !bytes.Equal(reencoded, encoded) {
+		t.Errorf("Expected %x after decoding, but got: %x", encoded, reencoded)
+	}
+}
+
+func FuzzDecodeFixedHeader(f *testing.F) {
+	f.Add([]byte{0x30, 0x00})
+	f.Add([]byte{0x82, 0x80, 0x01})
+	f.Add([]byte{0xE0, 0xFF, 0xFF, 0xFF, 0x7F})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		fh, err := DecodeFixedHeader(bufio.NewReader(bytes.NewReader(buf)))
+		if err != nil {
+			return
+		}
+		decoded, err := DecodeFixedHeader(bufio.NewReader(bytes.NewReader(fh.Encode())))
+		if err != nil {
+			t.Fatalf("Encoded fixed header %x can't be decoded: %v", fh.Encode(), err)
+		}
+		if *decoded != *fh {
+			t.Errorf("Expected %+v after decoding, but got: %+v", fh, decoded)
+		}
+	})
+}
+
+// FuzzParsePacket reads a stream of packets as they arrive from a connection
+func FuzzParsePacket(f *testing.F) {
+	for messageType := CONNECT; messageType <= AUTH; messageType++ {
+		for _, seed := range fuzzSeeds(messageType) {
+			f.Add(seed.Encode(), seed.ProtocolVersion)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, buf []byte, protocolVersion byte) {
+		reader := bufio.NewReader(bytes.NewReader(buf))
+		for {
+			fh, err := DecodeFixedHeader(reader)
+			if err != nil {
+				return
+			}
+			packet, err := ParsePacket(fh, reader, protocolVersion)
+			if err != nil {
+				return
+			}
+			protocolVersion = packet.ProtocolVersion
+		}
+	})
+}
+
+func FuzzDecodeConnect(f *testing.F)     { fuzzDecoder(f, CONNECT) }
+func FuzzDecodeConnack(f *testing.F)     { fuzzDecoder(f, CONNACK) }
+func FuzzDecodePublish(f *testing.F)     { fuzzDecoder(f, PUBLISH) }
+func FuzzDecodePuback(f *testing.F)      { fuzzDecoder(f, PUBACK) }
+func FuzzDecodePubrec(f *testing.F)      { fuzzDecoder(f, PUBREC) }
+func FuzzDecodePubrel(f *testing.F)      { fuzzDecoder(f, PUBREL) }
+func FuzzDecodePubcomp(f *testing.F)     { fuzzDecoder(f, PUBCOMP) }
+func FuzzDecodeSubscribe(f *testing.F)   { fuzzDecoder(f, SUBSCRIBE) }
+func FuzzDecodeSuback(f *testing.F)      { fuzzDecoder(f, SUBACK) }
+func FuzzDecodeUnsubscribe(f *testing.F) { fuzzDecoder(f, UNSUBSCRIBE) }
+func FuzzDecodeUnsuback(f *testing.F)    { fuzzDecoder(f, UNSUBACK) }
+func FuzzDecodePingreq(f *testing.F)     { fuzzDecoder(f, PINGREQ) }
+func FuzzDecodePingresp(f *testing.F)    { fuzzDecoder(f, PINGRES) }
+func FuzzDecodeDisconnect(f *testing.F)  { fuzzDecoder(f, DISCONNECT) }
+func FuzzDecodeAuth(f *testing.F)        { fuzzDecoder(f, AUTH) }
+
+func FuzzDecodeProperties(f *testing.F) {
+	expiry := uint32(30)
+	alias := uint16(2)
+	f.Add((&Properties{ReasonString: "because", UserProperties: []UserProperty{{"k", "v"}}}).Encode())
+	f.Add((&Properties{SessionExpiryInterval: &expiry, TopicAlias: &alias, CorrelationData: []byte{1, 2}}).Encode())
+	f.Add([]byte{0x00})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		props, _, err := DecodeProperties(buf)
+		if err != nil {
+			return
+		}
+		decoded, rest, err := DecodeProperties(props.Encode())
+		if err != nil {
+			t.Fatalf("Encoded properties %x can't be decoded: %v", props.Encode(), err)
+		}
+		if len(rest) != 0 || !reflect.DeepEqual(decoded.Encode(), props.Encode()) {
+			t.Errorf("Expected %+v after decoding, but got: %+v", props, decoded)
+		}
+	})
+}
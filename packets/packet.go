@@ -3,6 +3,8 @@ package packets
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"slices"
 )
 
 const (
@@ -32,6 +34,51 @@ type Packet struct {
 	PacketIdentifier uint16
 	Size             uint32
 	Payload          []byte
+	ProtocolVersion  byte        // protocol level of the connection the packet is read from or written to
+	Properties       *Properties // MQTT 5.0 properties
+	ReasonCode       byte        // MQTT 5.0 reason code of acknowledgement, DISCONNECT and AUTH packets, return code of CONNACK
+	ReasonCodes      []byte      // return codes of a decoded SUBACK or UNSUBACK, one per topic filter
+	SessionPresent   bool        // CONNACK
+}
+
+// ErrMalformedPacket is returned for packets that don't follow the encoding rules of their type
+type ErrMalformedPacket struct {
+	Type   byte
+	Reason string
+}
+
+func (e *ErrMalformedPacket) Error() string {
+	return fmt.Sprintf("Malformed %s packet: %s", PacketName(e.Type), e.Reason)
+}
+
+// ErrUnknownPacketType is returned for reserved packet types and AUTH packets before MQTT 5.0
+type ErrUnknownPacketType struct {
+	Type byte
+}
+
+func (e *ErrUnknownPacketType) Error() string {
+	return fmt.Sprintf("Unknown packet type %d", e.Type)
+}
+
+// ErrPacketTooLarge is returned for packets exceeding the maximum packet size, before they are read
+type ErrPacketTooLarge struct {
+	Type    byte
+	Size    uint32 // size of the whole packet including the fixed header
+	Maximum uint32
+}
+
+func (e *ErrPacketTooLarge) Error() string {
+	return fmt.Sprintf("%s packet of %d bytes exceeds the maximum packet size of %d bytes", PacketName(e.Type), e.Size, e.Maximum)
+}
+
+var packetNames = [16]string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+// PacketName returns the name of the packet type
+func PacketName(messageType byte) string {
+	return packetNames[messageType&0x0F]
 }
 
 // Make a deep copy of a packet
@@ -44,45 +91,194 @@ func (p *Packet) Copy() *Packet {
 	packet.PacketIdentifier = p.PacketIdentifier
 	packet.Size = p.Size
 	packet.Payload = p.Payload
+	packet.ProtocolVersion = p.ProtocolVersion
+	packet.Properties = p.Properties.Copy()
+	packet.ReasonCode = p.ReasonCode
+	if p.ReasonCodes != nil {
+		packet.ReasonCodes = append([]byte{}, p.ReasonCodes...)
+	}
+	packet.SessionPresent = p.SessionPresent
 	return packet
 }
 
-func ParsePacket(fh *FixedHeader, conn *bufio.Reader) (*Packet, error) {
+// ParsePacket reads the rest of the packet described by the fixed header.
+// protocolVersion is the protocol level negotiated for the connection, it is ignored for CONNECT packets.
+func ParsePacket(fh *FixedHeader, conn *bufio.Reader, protocolVersion byte) (*Packet, error) {
+	buf, err := readRemaining(conn, fh.RemainingLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodePacket(fh, buf, protocolVersion)
+}
+
+// packets larger than this are read in chunks of this size
+const readChunkSize = 64 << 10
+
+// readRemaining reads the variable header and payload of a packet. Large packets are read in chunks,
+// so memory is only allocated for data that arrived and not for the length a client claims.
+func readRemaining(r io.Reader, length uint32) ([]byte, error) {
+	// a single read may return only part of a packet split over several TCP segments
+	if length <= readChunkSize {
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+
+	var buf []byte
+	for uint32(len(buf)) < length {
+		n := int(min(length-uint32(len(buf)), readChunkSize))
+		buf = slices.Grow(buf, n)
+		if _, err := io.ReadFull(r, buf[len(buf):len(buf)+n]); err != nil {
+			return nil, err
+		}
+		buf = buf[:len(buf)+n]
+	}
+	return buf, nil
+}
+
+// DecodePacket decodes the variable header and payload of the packet described by the fixed header.
+// The reserved flags of the fixed header and the length of the packet are validated before decoding.
+func DecodePacket(fh *FixedHeader, buf []byte, protocolVersion byte) (*Packet, error) {
 	packet := new(Packet)
 	packet.FixedHeader = fh
-	var err error
+	packet.ProtocolVersion = protocolVersion
+	packet.Size = fh.PacketSize()
 
-	buf := make([]byte, fh.RemainingLength)
-	_, err = conn.Read(buf)
-	if err != nil {
+	if err := validateFixedHeader(fh, protocolVersion); err != nil {
+		return nil, err
+	}
+	if err := validateLength(fh.MessageType, len(buf), protocolVersion); err != nil {
 		return nil, err
 	}
 
+	var err error
 	switch packet.FixedHeader.MessageType {
 	case CONNECT:
 		packet.ConnectOptions, err = DecodeConnect(buf)
+		if err == nil {
+			packet.ProtocolVersion = packet.ConnectOptions.ProtocolLevel
+		}
+	case CONNACK:
+		err = packet.DecodeConnack(buf)
 	case SUBSCRIBE:
 		err = packet.DecodeSubscribe(buf)
+	case SUBACK:
+		err = packet.DecodeSuback(buf)
 	case UNSUBSCRIBE:
 		err = packet.DecodeUnsubscribe(buf)
+	case UNSUBACK:
+		err = packet.DecodeUnsuback(buf)
 	case PUBLISH:
 		err = packet.DecodePublish(buf)
-	case PUBACK:
-		err = packet.DecodePuback(buf)
-	case PUBREC:
-		err = packet.DecodePuback(buf)
-	case PUBREL:
-		err = packet.DecodePuback(buf)
-	case PUBCOMP:
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
 		err = packet.DecodePuback(buf)
-	case PINGREQ:
+	case PINGREQ, PINGRES:
 	case DISCONNECT:
-	default:
-		fmt.Println("Unknown packet type: ", packet.FixedHeader.MessageType)
+		err = packet.DecodeDisconnect(buf)
+	case AUTH:
+		err = packet.DecodeAuth(buf)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// fixedHeaderFlags are the flags packets other than PUBLISH must have [MQTT-2.2.2-1]
+var fixedHeaderFlags = [16]byte{PUBREL: 0x02, SUBSCRIBE: 0x02, UNSUBSCRIBE: 0x02}
+
+// validateFixedHeader checks the packet type and the reserved flags of the fixed header [MQTT-2.2.2-2]
+func validateFixedHeader(fh *FixedHeader, protocolVersion byte) error {
+	if fh.MessageType == RESERVED || fh.MessageType > AUTH || (fh.MessageType == AUTH && protocolVersion != MQTT5) {
+		return &ErrUnknownPacketType{fh.MessageType}
+	}
+
+	if fh.MessageType == PUBLISH {
+		// [MQTT-3.3.1-4]
+		if fh.Qos > 2 {
+			return &ErrInvalidQoS{}
+		}
+		// [MQTT-3.3.1-2]
+		if fh.Dup && fh.Qos == 0 {
+			return &ErrMalformedPacket{PUBLISH, "DUP flag set on a QoS 0 message"}
+		}
+		return nil
+	}
+
+	if fh.flags() != fixedHeaderFlags[fh.MessageType] {
+		return &ErrInvalidFixedHeader{}
+	}
+	return nil
+}
+
+// flags returns the lower four bits of the first byte of the fixed header
+func (f *FixedHeader) flags() byte {
+	flags := f.Qos << 1
+	if f.Dup {
+		flags |= 0x08
+	}
+	if f.Retain {
+		flags |= 0x01
+	}
+	return flags
+}
+
+// validateLength checks the remaining length of packets whose length is fixed or has a minimum
+func validateLength(messageType byte, length int, protocolVersion byte) error {
+	min, max := 0, -1
+	switch messageType {
+	case CONNECT:
+		// protocol name, protocol level, connect flags and keep alive
+		min = 10
+	case CONNACK:
+		min, max = 2, 2
+	case PUBLISH:
+		// topic name length
+		min = 2
+	case PUBACK, PUBREC, PUBREL, PUBCOMP:
+		min, max = 2, 2
+	case SUBSCRIBE:
+		// packet identifier and at least one topic filter with its options [MQTT-3.8.3-3]
+		min = 5
+	case UNSUBSCRIBE:
+		// packet identifier and at least one topic filter [MQTT-3.10.3-2]
+		min = 4
+	case SUBACK:
+		// packet identifier and at least one return code
+		min = 3
+	case UNSUBACK:
+		min, max = 2, 2
+	case PINGREQ, PINGRES:
+		max = 0
+	case DISCONNECT:
+		max = 0
 	}
 
-	packet.Size = uint32(fh.RemainingLength) + 2
-	return packet, err
+	// MQTT 5.0 acknowledgements and DISCONNECT may carry a reason code and properties
+	if protocolVersion == MQTT5 {
+		switch messageType {
+		case CONNACK:
+			// flags, reason code and property length
+			min, max = 3, -1
+		case PUBACK, PUBREC, PUBREL, PUBCOMP, DISCONNECT:
+			max = -1
+		case SUBSCRIBE, UNSUBSCRIBE:
+			min++
+		case SUBACK:
+			min++
+		case UNSUBACK:
+			min, max = 4, -1
+		}
+	}
+
+	if length < min || (max >= 0 && length > max) {
+		return &ErrMalformedPacket{messageType, fmt.Sprintf("invalid remaining length %d", length)}
+	}
+	return nil
 }
 
 func EncodePingresp() []byte {
@@ -92,18 +288,39 @@ func EncodePingresp() []byte {
 	return buffer
 }
 
-// this is used when resending pending QoS 1 and 2 messages
-// needed because its unsure what type of packet it is
-// in the future this can be reimplemented to include all packet types
+func EncodePingreq() []byte {
+	return []byte{PINGREQ << 4, 0}
+}
+
+// Encode encodes a packet of any type, the fixed header flags are taken from the packet
 func (p *Packet) Encode() []byte {
 	switch p.FixedHeader.MessageType {
+	case CONNECT:
+		return p.ConnectOptions.Encode()
+	case CONNACK:
+		connack := NewConnack(Code{Code: p.ReasonCode}, p.SessionPresent)
+		connack.ProtocolVersion = p.ProtocolVersion
+		connack.Properties = p.Properties
+		return connack.Encode()
 	case PUBLISH:
 		return p.EncodePublish()
 	case PUBACK, PUBREC, PUBREL, PUBCOMP:
-		return p.EncodePuback()
+		return p.EncodeResp()
+	case SUBSCRIBE:
+		return p.EncodeSubscribe()
+	case SUBACK:
+		return p.EncodeSuback()
+	case UNSUBSCRIBE:
+		return p.EncodeUnsubscribe()
+	case UNSUBACK:
+		return p.EncodeUnsuback()
+	case PINGREQ:
+		return EncodePingreq()
+	case PINGRES:
+		return EncodePingresp()
+	case DISCONNECT, AUTH:
+		return p.EncodeDisconnect()
 	default:
-		fmt.Println("Unknown packet type: ", p.FixedHeader.MessageType)
 		return nil
 	}
-
 }
@@ -1,8 +1,14 @@
 package packets
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
 	"testing"
+	"testing/iotest"
 )
 
 func TestCopy(t *testing.T) {
@@ -72,3 +78,201 @@ func TestCopy(t *testing.T) {
 
 	}
 }
+
+func decodeEncoded(t *testing.T, buf []byte, protocolVersion byte) (*Packet, error) {
+	t.Helper()
+	reader := bufio.NewReader(bytes.NewReader(buf))
+	fh, err := DecodeFixedHeader(reader)
+	if err != nil {
+		t.Fatalf("Unexpected fixed header error: %v", err)
+	}
+	return ParsePacket(fh, reader, protocolVersion)
+}
+
+func TestPacket_RoundTrip(t *testing.T) {
+	expiry := uint32(30)
+	props := &Properties{ReasonString: "because", UserProperties: []UserProperty{{"k", "v"}}}
+	subscriptions := &Subscriptions{
+		Subscriptions:        map[string]byte{"a/+": 1, "b/#": 2},
+		OrderedSubscriptions: []string{"a/+", "b/#"},
+		Options: map[string]SubscriptionOptions{
+			"a/+": {QoS: 1},
+			"b/#": {QoS: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: 1},
+		},
+	}
+
+	packets := map[string]*Packet{
+		"CONNECT": {FixedHeader: &FixedHeader{MessageType: CONNECT}, ConnectOptions: &ConnectOptions{
+			ClientID: "client", Username: "user", Password: "pass", WillTopic: "will", WillMessage: "gone",
+			WillQoS: 1, WillRetain: true, CleanSession: true, Keepalive: 60,
+		}},
+		"CONNACK":     {FixedHeader: &FixedHeader{MessageType: CONNACK}, SessionPresent: true},
+		"PUBLISH":     {FixedHeader: &FixedHeader{MessageType: PUBLISH, Qos: 2, Dup: true, Retain: true}, PublishTopic: "a/b", PacketIdentifier: 9, Payload: []byte("data")},
+		"PUBACK":      {FixedHeader: &FixedHeader{MessageType: PUBACK}, PacketIdentifier: 1},
+		"PUBREC":      {FixedHeader: &FixedHeader{MessageType: PUBREC}, PacketIdentifier: 2},
+		"PUBREL":      {FixedHeader: &FixedHeader{MessageType: PUBREL, Qos: 1}, PacketIdentifier: 3},
+		"PUBCOMP":     {FixedHeader: &FixedHeader{MessageType: PUBCOMP}, PacketIdentifier: 4},
+		"SUBSCRIBE":   {FixedHeader: &FixedHeader{MessageType: SUBSCRIBE, Qos: 1}, PacketIdentifier: 5, Subscriptions: subscriptions},
+		"SUBACK":      {FixedHeader: &FixedHeader{MessageType: SUBACK}, PacketIdentifier: 5, ReasonCodes: []byte{1, 0x80}},
+		"UNSUBSCRIBE": {FixedHeader: &FixedHeader{MessageType: UNSUBSCRIBE, Qos: 1}, PacketIdentifier: 6, Subscriptions: subscriptions},
+		"UNSUBACK":    {FixedHeader: &FixedHeader{MessageType: UNSUBACK}, PacketIdentifier: 6, ReasonCodes: []byte{0, 0x11}},
+		"PINGREQ":     {FixedHeader: &FixedHeader{MessageType: PINGREQ}},
+		"PINGRESP":    {FixedHeader: &FixedHeader{MessageType: PINGRES}},
+		"DISCONNECT":  {FixedHeader: &FixedHeader{MessageType: DISCONNECT}},
+	}
+
+	for _, protocolVersion := range []byte{MQTT311, MQTT5} {
+		for name, packet := range packets {
+			packet.ProtocolVersion = protocolVersion
+			if packet.ConnectOptions != nil {
+				packet.ConnectOptions.ProtocolLevel = protocolVersion
+			}
+			if protocolVersion == MQTT5 && packet.FixedHeader.MessageType != PINGREQ && packet.FixedHeader.MessageType != PINGRES {
+				packet.Properties = props
+				if packet.FixedHeader.MessageType == CONNECT {
+					packet.Properties = &Properties{SessionExpiryInterval: &expiry}
+				}
+			}
+
+			t.Run(fmt.Sprintf("%s v%d", name, protocolVersion), func(t *testing.T) {
+				encoded := packet.Encode()
+				decoded, err := decodeEncoded(t, encoded, protocolVersion)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if decoded.FixedHeader.MessageType != packet.FixedHeader.MessageType {
+					t.Fatalf("Expected type %d, but got: %d", packet.FixedHeader.MessageType, decoded.FixedHeader.MessageType)
+				}
+				if reencoded := decoded.Encode(); !bytes.Equal(reencoded, encoded) {
+					t.Errorf("Expected %x after decoding, but got: %x", encoded, reencoded)
+				}
+			})
+		}
+	}
+
+	auth := NewAuth(CONTINUE_AUTHENTICATION, &Properties{AuthenticationMethod: "SCRAM-SHA-1"})
+	decoded, err := decodeEncoded(t, auth.EncodeAuth(), MQTT5)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.ReasonCode != CONTINUE_AUTHENTICATION.Code || decoded.Properties.AuthenticationMethod != "SCRAM-SHA-1" {
+		t.Errorf("Unexpected AUTH packet: %+v", decoded)
+	}
+}
+
+func TestDecodePacket_Invalid(t *testing.T) {
+	tests := []struct {
+		name            string
+		buffer          []byte
+		protocolVersion byte
+		expected        error
+	}{
+		{"Reserved packet type", []byte{0x00, 0x00}, MQTT311, &ErrUnknownPacketType{}},
+		{"AUTH before MQTT 5.0", []byte{0xF0, 0x00}, MQTT311, &ErrUnknownPacketType{}},
+		{"PINGREQ with flags", []byte{0xC1, 0x00}, MQTT311, &ErrInvalidFixedHeader{}},
+		{"PUBREL without flags", []byte{0x60, 0x02, 0x00, 0x01}, MQTT311, &ErrInvalidFixedHeader{}},
+		{"PUBLISH with QoS 3", []byte{0x36, 0x05, 0x00, 0x01, 'a', 0x00, 0x01}, MQTT311, &ErrInvalidQoS{}},
+		{"PUBLISH QoS 0 with DUP", []byte{0x38, 0x03, 0x00, 0x01, 'a'}, MQTT311, &ErrMalformedPacket{}},
+		{"PUBLISH with packet identifier 0", []byte{0x32, 0x05, 0x00, 0x01, 'a', 0x00, 0x00}, MQTT311, &ErrMalformedPacket{}},
+		{"PUBLISH to wildcard topic", []byte{0x30, 0x03, 0x00, 0x01, '#'}, MQTT311, &ErrMalformedPacket{}},
+		{"PUBACK too long", []byte{0x40, 0x03, 0x00, 0x01, 0x00}, MQTT311, &ErrMalformedPacket{}},
+		{"PINGREQ with payload", []byte{0xC0, 0x01, 0x00}, MQTT311, &ErrMalformedPacket{}},
+		{"DISCONNECT with payload before MQTT 5.0", []byte{0xE0, 0x01, 0x00}, MQTT311, &ErrMalformedPacket{}},
+		{"SUBSCRIBE without topic filters", []byte{0x82, 0x02, 0x00, 0x01}, MQTT311, &ErrMalformedPacket{}},
+		{"SUBSCRIBE with reserved QoS bits", []byte{0x82, 0x06, 0x00, 0x01, 0x00, 0x01, 'a', 0x41}, MQTT311, &ErrInvalidQoS{}},
+		{"UNSUBSCRIBE without topic filters", []byte{0xA2, 0x02, 0x00, 0x01}, MQTT311, &ErrMalformedPacket{}},
+		{"CONNACK with reserved flags", []byte{0x20, 0x02, 0x02, 0x00}, MQTT311, &ErrMalformedPacket{}},
+		{"CONNACK with reserved return code", []byte{0x20, 0x02, 0x00, 0x06}, MQTT311, &ErrMalformedPacket{}},
+		{"CONNACK session present on refusal", []byte{0x20, 0x02, 0x01, 0x05}, MQTT311, &ErrMalformedPacket{}},
+		{"MQTT 5.0 CONNACK without properties", []byte{0x20, 0x02, 0x00, 0x00}, MQTT5, &ErrMalformedPacket{}},
+		{"SUBACK with reserved return code", []byte{0x90, 0x03, 0x00, 0x01, 0x03}, MQTT311, &ErrMalformedPacket{}},
+		{"CONNECT with reserved flag", []byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x01, 0x00, 0x3C, 0x00, 0x00}, 0, &ErrMalformedPacket{}},
+		{"CONNECT with will QoS without will", []byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x08, 0x00, 0x3C, 0x00, 0x00}, 0, &ErrMalformedPacket{}},
+		{"CONNECT with password without username", []byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x40, 0x00, 0x3C, 0x00, 0x00}, 0, &ErrMalformedPacket{}},
+		{"CONNECT with truncated protocol name", []byte{0x10, 0x03, 0x00, 0x04, 'M'}, 0, &ErrMalformedPacket{}},
+		{"CONNECT without client identifier", []byte{0x10, 0x0A, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C}, 0, &ErrMalformedPacket{}},
+		{"CONNECT with client identifier longer than the packet", []byte{0x10, 0x0C, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C, 0x00, 0x10}, 0, &ErrMalformedPacket{}},
+		{"CONNECT with trailing data", []byte{0x10, 0x0D, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x02, 0x00, 0x3C, 0x00, 0x00, 0x00}, 0, &ErrMalformedPacket{}},
+		{"CONNECT without announced password", []byte{0x10, 0x0F, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0xC2, 0x00, 0x3C, 0x00, 0x00, 0x00, 0x01, 'u'}, 0, &ErrMalformedPacket{}},
+		{"PUBLISH with topic longer than the packet", []byte{0x30, 0x03, 0x00, 0x05, 'a'}, MQTT311, &ErrMalformedPacket{}},
+		{"PUBLISH with invalid UTF-8 topic", []byte{0x30, 0x03, 0x00, 0x01, 0xFF}, MQTT311, &ErrMalformedPacket{}},
+		{"PUBLISH with null character in topic", []byte{0x30, 0x04, 0x00, 0x02, 'a', 0x00}, MQTT311, &ErrMalformedPacket{}},
+		{"PUBLISH QoS 1 without packet identifier", []byte{0x32, 0x03, 0x00, 0x01, 'a'}, MQTT311, &ErrMalformedPacket{}},
+		{"MQTT 5.0 PUBLISH with truncated properties", []byte{0x30, 0x05, 0x00, 0x01, 'a', 0x05, 0x01}, MQTT5, &ErrMalformedProperties{}},
+		{"SUBSCRIBE without subscription options", []byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x01, 'a'}, MQTT311, &ErrMalformedPacket{}},
+		{"SUBSCRIBE with truncated topic filter", []byte{0x82, 0x05, 0x00, 0x01, 0x00, 0x05, 'a'}, MQTT311, &ErrMalformedPacket{}},
+		{"UNSUBSCRIBE with truncated topic filter", []byte{0xA2, 0x05, 0x00, 0x01, 0x00, 0x05, 'a'}, MQTT311, &ErrMalformedPacket{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := decodeEncoded(t, test.buffer, test.protocolVersion)
+			// errors of a CONNECT packet with a known protocol level carry the level
+			var connectErr *ErrMalformedConnect
+			if errors.As(err, &connectErr) {
+				err = connectErr.Err
+			}
+			if reflect.TypeOf(err) != reflect.TypeOf(test.expected) {
+				t.Errorf("Expected %T, but got: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestParsePacket_ShortReads(t *testing.T) {
+	packet := &Packet{FixedHeader: &FixedHeader{MessageType: PUBLISH}, PublishTopic: "a/b", Payload: bytes.Repeat([]byte("x"), 100)}
+	encoded := packet.Encode()
+
+	// the packet arrives one byte at a time
+	reader := bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(encoded)), 16)
+	fh, err := DecodeFixedHeader(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	decoded, err := ParsePacket(fh, reader, MQTT311)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(decoded.Payload, packet.Payload) {
+		t.Errorf("Expected payload of %d bytes, but got: %d", len(packet.Payload), len(decoded.Payload))
+	}
+}
+
+func TestParsePacket_Truncated(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewReader([]byte{0x30, 0x05, 0x00, 0x01}))
+	fh, err := DecodeFixedHeader(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := ParsePacket(fh, reader, MQTT311); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v, but got: %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestDecodeFixedHeader_MalformedRemainingLength(t *testing.T) {
+	reader := bufio.NewReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}))
+	if _, err := DecodeFixedHeader(reader); reflect.TypeOf(err) != reflect.TypeOf(&ErrMalformedPacket{}) {
+		t.Errorf("Expected *packets.ErrMalformedPacket, but got: %v", err)
+	}
+}
+
+func TestParsePacket_LargePacket(t *testing.T) {
+	packet := &Packet{FixedHeader: &FixedHeader{MessageType: PUBLISH}, PublishTopic: "a/b", Payload: bytes.Repeat([]byte("0123456789"), 20000)}
+	encoded := packet.Encode()
+
+	decoded, err := decodeEncoded(t, encoded, MQTT311)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(decoded.Payload, packet.Payload) {
+		t.Errorf("Expected payload of %d bytes, but got: %d", len(packet.Payload), len(decoded.Payload))
+	}
+	if decoded.Size != uint32(len(encoded)) {
+		t.Errorf("Expected size %d, but got: %d", len(encoded), decoded.Size)
+	}
+
+	// a client claiming more data than it sends
+	if _, err := decodeEncoded(t, encoded[:len(encoded)-1], MQTT311); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %v, but got: %v", io.ErrUnexpectedEOF, err)
+	}
+}
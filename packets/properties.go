@@ -0,0 +1,348 @@
+package packets
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MQTT 5.0 property identifiers [MQTT-2.2.2.2]
+const (
+	PropPayloadFormatIndicator          byte = 0x01
+	PropMessageExpiryInterval           byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0B
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1A
+	PropServerReference                 byte = 0x1C
+	PropReasonString                    byte = 0x1F
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQoS                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2A
+)
+
+type ErrMalformedProperties struct {
+	reason string
+}
+
+func (e *ErrMalformedProperties) Error() string {
+	return "Malformed properties: " + e.reason
+}
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5.0 properties of a packet.
+// Optional numeric properties whose zero value is meaningful are pointers,
+// nil meaning the property was not present.
+type Properties struct {
+	PayloadFormatIndicator          *byte
+	MessageExpiryInterval           *uint32
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []uint32
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            string
+	AuthenticationData              []byte
+	RequestProblemInformation       *byte
+	WillDelayInterval               *uint32
+	RequestResponseInformation      *byte
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  *uint16
+	TopicAliasMaximum               *uint16
+	TopicAlias                      *uint16
+	MaximumQoS                      *byte
+	RetainAvailable                 *byte
+	UserProperties                  []UserProperty
+	MaximumPacketSize               *uint32
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+// Make a deep copy of properties
+func (p *Properties) Copy() *Properties {
+	if p == nil {
+		return nil
+	}
+	props := *p
+	if p.CorrelationData != nil {
+		props.CorrelationData = append([]byte{}, p.CorrelationData...)
+	}
+	if p.AuthenticationData != nil {
+		props.AuthenticationData = append([]byte{}, p.AuthenticationData...)
+	}
+	if p.SubscriptionIdentifiers != nil {
+		props.SubscriptionIdentifiers = append([]uint32{}, p.SubscriptionIdentifiers...)
+	}
+	if p.UserProperties != nil {
+		props.UserProperties = append([]UserProperty{}, p.UserProperties...)
+	}
+	return &props
+}
+
+// DecodeProperties reads the property length and the properties that follow it.
+// Returns the decoded properties and the rest of the buffer.
+func DecodeProperties(buf []byte) (*Properties, []byte, error) {
+	reader := bytes.NewReader(buf)
+	length, err := decodeRemainingLength(reader)
+	if err != nil {
+		return nil, nil, &ErrMalformedProperties{"invalid property length"}
+	}
+
+	start := len(buf) - reader.Len()
+	if int(length) > len(buf)-start {
+		return nil, nil, &ErrMalformedProperties{"property length exceeds packet"}
+	}
+
+	props := new(Properties)
+	data := buf[start : start+int(length)]
+	seen := make(map[byte]bool)
+
+	for len(data) > 0 {
+		id := data[0]
+		data = data[1:]
+
+		if seen[id] && id != PropUserProperty && id != PropSubscriptionIdentifier {
+			return nil, nil, &ErrMalformedProperties{fmt.Sprintf("property 0x%02X included more than once", id)}
+		}
+		seen[id] = true
+
+		switch id {
+		case PropPayloadFormatIndicator:
+			props.PayloadFormatIndicator, data, err = decodePropByte(data)
+		case PropRequestProblemInformation:
+			props.RequestProblemInformation, data, err = decodePropByte(data)
+		case PropRequestResponseInformation:
+			props.RequestResponseInformation, data, err = decodePropByte(data)
+		case PropMaximumQoS:
+			props.MaximumQoS, data, err = decodePropByte(data)
+		case PropRetainAvailable:
+			props.RetainAvailable, data, err = decodePropByte(data)
+		case PropWildcardSubscriptionAvailable:
+			props.WildcardSubscriptionAvailable, data, err = decodePropByte(data)
+		case PropSubscriptionIdentifierAvailable:
+			props.SubscriptionIdentifierAvailable, data, err = decodePropByte(data)
+		case PropSharedSubscriptionAvailable:
+			props.SharedSubscriptionAvailable, data, err = decodePropByte(data)
+		case PropServerKeepAlive:
+			props.ServerKeepAlive, data, err = decodePropUint16(data)
+		case PropReceiveMaximum:
+			props.ReceiveMaximum, data, err = decodePropUint16(data)
+		case PropTopicAliasMaximum:
+			props.TopicAliasMaximum, data, err = decodePropUint16(data)
+		case PropTopicAlias:
+			props.TopicAlias, data, err = decodePropUint16(data)
+		case PropMessageExpiryInterval:
+			props.MessageExpiryInterval, data, err = decodePropUint32(data)
+		case PropSessionExpiryInterval:
+			props.SessionExpiryInterval, data, err = decodePropUint32(data)
+		case PropWillDelayInterval:
+			props.WillDelayInterval, data, err = decodePropUint32(data)
+		case PropMaximumPacketSize:
+			props.MaximumPacketSize, data, err = decodePropUint32(data)
+		case PropContentType:
+			props.ContentType, data, err = decodePropString(data)
+		case PropResponseTopic:
+			props.ResponseTopic, data, err = decodePropString(data)
+		case PropAssignedClientIdentifier:
+			props.AssignedClientIdentifier, data, err = decodePropString(data)
+		case PropAuthenticationMethod:
+			props.AuthenticationMethod, data, err = decodePropString(data)
+		case PropResponseInformation:
+			props.ResponseInformation, data, err = decodePropString(data)
+		case PropServerReference:
+			props.ServerReference, data, err = decodePropString(data)
+		case PropReasonString:
+			props.ReasonString, data, err = decodePropString(data)
+		case PropCorrelationData:
+			props.CorrelationData, data, err = decodePropBinary(data)
+		case PropAuthenticationData:
+			props.AuthenticationData, data, err = decodePropBinary(data)
+		case PropSubscriptionIdentifier:
+			var id uint32
+			r := bytes.NewReader(data)
+			id, err = decodeRemainingLength(r)
+			if err == nil && id == 0 {
+				err = &ErrMalformedProperties{"subscription identifier of 0"}
+			}
+			props.SubscriptionIdentifiers = append(props.SubscriptionIdentifiers, id)
+			data = data[len(data)-r.Len():]
+		case PropUserProperty:
+			var up UserProperty
+			if up.Key, data, err = decodePropString(data); err == nil {
+				up.Value, data, err = decodePropString(data)
+			}
+			props.UserProperties = append(props.UserProperties, up)
+		default:
+			return nil, nil, &ErrMalformedProperties{fmt.Sprintf("unknown property 0x%02X", id)}
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return props, buf[start+int(length):], nil
+}
+
+func decodePropByte(buf []byte) (*byte, []byte, error) {
+	if len(buf) < 1 {
+		return nil, nil, &ErrMalformedProperties{"truncated byte property"}
+	}
+	v := buf[0]
+	return &v, buf[1:], nil
+}
+
+func decodePropUint16(buf []byte) (*uint16, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, &ErrMalformedProperties{"truncated two byte integer property"}
+	}
+	v := uint16(buf[0])<<8 | uint16(buf[1])
+	return &v, buf[2:], nil
+}
+
+func decodePropUint32(buf []byte) (*uint32, []byte, error) {
+	if len(buf) < 4 {
+		return nil, nil, &ErrMalformedProperties{"truncated four byte integer property"}
+	}
+	v := uint32(buf[0])<<24 | uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
+	return &v, buf[4:], nil
+}
+
+func decodePropString(buf []byte) (string, []byte, error) {
+	b, rest, err := decodePropBinary(buf)
+	return string(b), rest, err
+}
+
+func decodePropBinary(buf []byte) ([]byte, []byte, error) {
+	if len(buf) < 2 {
+		return nil, nil, &ErrMalformedProperties{"truncated string property"}
+	}
+	length := int(buf[0])<<8 | int(buf[1])
+	if length > len(buf)-2 {
+		return nil, nil, &ErrMalformedProperties{"string property exceeds property length"}
+	}
+	return buf[2 : 2+length], buf[2+length:], nil
+}
+
+// Encode returns the properties prefixed with their variable byte integer length.
+// Nil properties are encoded as a single zero length byte.
+func (p *Properties) Encode() []byte {
+	if p == nil {
+		return []byte{0}
+	}
+
+	var buf []byte
+	buf = appendPropByte(buf, PropPayloadFormatIndicator, p.PayloadFormatIndicator)
+	buf = appendPropUint32(buf, PropMessageExpiryInterval, p.MessageExpiryInterval)
+	buf = appendPropString(buf, PropContentType, p.ContentType)
+	buf = appendPropString(buf, PropResponseTopic, p.ResponseTopic)
+	buf = appendPropBinary(buf, PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifiers {
+		buf = append(buf, PropSubscriptionIdentifier)
+		buf = append(buf, encodeVarint(id)...)
+	}
+	buf = appendPropUint32(buf, PropSessionExpiryInterval, p.SessionExpiryInterval)
+	buf = appendPropString(buf, PropAssignedClientIdentifier, p.AssignedClientIdentifier)
+	buf = appendPropUint16(buf, PropServerKeepAlive, p.ServerKeepAlive)
+	buf = appendPropString(buf, PropAuthenticationMethod, p.AuthenticationMethod)
+	buf = appendPropBinary(buf, PropAuthenticationData, p.AuthenticationData)
+	buf = appendPropByte(buf, PropRequestProblemInformation, p.RequestProblemInformation)
+	buf = appendPropUint32(buf, PropWillDelayInterval, p.WillDelayInterval)
+	buf = appendPropByte(buf, PropRequestResponseInformation, p.RequestResponseInformation)
+	buf = appendPropString(buf, PropResponseInformation, p.ResponseInformation)
+	buf = appendPropString(buf, PropServerReference, p.ServerReference)
+	buf = appendPropString(buf, PropReasonString, p.ReasonString)
+	buf = appendPropUint16(buf, PropReceiveMaximum, p.ReceiveMaximum)
+	buf = appendPropUint16(buf, PropTopicAliasMaximum, p.TopicAliasMaximum)
+	buf = appendPropUint16(buf, PropTopicAlias, p.TopicAlias)
+	buf = appendPropByte(buf, PropMaximumQoS, p.MaximumQoS)
+	buf = appendPropByte(buf, PropRetainAvailable, p.RetainAvailable)
+	for _, up := range p.UserProperties {
+		buf = append(buf, PropUserProperty)
+		buf = append(buf, EncodeUTF8String(up.Key)...)
+		buf = append(buf, EncodeUTF8String(up.Value)...)
+	}
+	buf = appendPropUint32(buf, PropMaximumPacketSize, p.MaximumPacketSize)
+	buf = appendPropByte(buf, PropWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	buf = appendPropByte(buf, PropSubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+	buf = appendPropByte(buf, PropSharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+
+	return append(encodeVarint(uint32(len(buf))), buf...)
+}
+
+func appendPropByte(buf []byte, id byte, v *byte) []byte {
+	if v == nil {
+		return buf
+	}
+	return append(buf, id, *v)
+}
+
+func appendPropUint16(buf []byte, id byte, v *uint16) []byte {
+	if v == nil {
+		return buf
+	}
+	return append(buf, id, byte(*v>>8), byte(*v))
+}
+
+func appendPropUint32(buf []byte, id byte, v *uint32) []byte {
+	if v == nil {
+		return buf
+	}
+	return append(buf, id, byte(*v>>24), byte(*v>>16), byte(*v>>8), byte(*v))
+}
+
+func appendPropString(buf []byte, id byte, v string) []byte {
+	if v == "" {
+		return buf
+	}
+	buf = append(buf, id)
+	return append(buf, EncodeUTF8String(v)...)
+}
+
+func appendPropBinary(buf []byte, id byte, v []byte) []byte {
+	if v == nil {
+		return buf
+	}
+	buf = append(buf, id)
+	return append(buf, EncodeUTF8String(string(v))...)
+}
+
+// ForwardCopy returns the properties that are forwarded to subscribers of a PUBLISH [MQTT-3.3.2-3].
+// Topic alias and subscription identifiers are connection specific and are dropped.
+func (p *Properties) ForwardCopy() *Properties {
+	if p == nil {
+		return nil
+	}
+	return &Properties{
+		PayloadFormatIndicator: p.PayloadFormatIndicator,
+		MessageExpiryInterval:  p.MessageExpiryInterval,
+		ContentType:            p.ContentType,
+		ResponseTopic:          p.ResponseTopic,
+		CorrelationData:        p.CorrelationData,
+		UserProperties:         p.UserProperties,
+	}
+}
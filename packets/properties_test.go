@@ -0,0 +1,160 @@
+package packets
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestProperties_EncodeDecode(t *testing.T) {
+	expiry := uint32(3600)
+	receiveMax := uint16(20)
+	format := byte(1)
+
+	props := &Properties{
+		PayloadFormatIndicator:  &format,
+		SessionExpiryInterval:   &expiry,
+		ReceiveMaximum:          &receiveMax,
+		ContentType:             "application/json",
+		CorrelationData:         []byte{0x01, 0x02},
+		SubscriptionIdentifiers: []uint32{1, 300},
+		UserProperties: []UserProperty{
+			{"key", "value"},
+			{"key", "other value"},
+		},
+	}
+
+	rest := []byte{0xAA, 0xBB}
+	buf := append(props.Encode(), rest...)
+
+	decoded, remaining, err := DecodeProperties(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(props, decoded) {
+		t.Errorf("Expected: %+v, but got: %+v", props, decoded)
+	}
+
+	if !bytes.Equal(remaining, rest) {
+		t.Errorf("Expected remaining buffer: %v, but got: %v", rest, remaining)
+	}
+}
+
+func TestProperties_EncodeNil(t *testing.T) {
+	var props *Properties
+	if !bytes.Equal(props.Encode(), []byte{0x00}) {
+		t.Errorf("Expected nil properties to encode as zero length, got: %v", props.Encode())
+	}
+}
+
+func TestDecodeProperties_Malformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		buffer []byte
+	}{
+		{
+			name:   "Length exceeds buffer",
+			buffer: []byte{0x05, 0x01, 0x01},
+		},
+		{
+			name:   "Unknown property",
+			buffer: []byte{0x02, 0x7F, 0x00},
+		},
+		{
+			name:   "Duplicate property",
+			buffer: []byte{0x04, 0x01, 0x00, 0x01, 0x01},
+		},
+		{
+			name:   "Truncated four byte integer",
+			buffer: []byte{0x03, 0x11, 0x00, 0x00},
+		},
+		{
+			name:   "Truncated string",
+			buffer: []byte{0x03, 0x03, 0x00, 0x05},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := DecodeProperties(test.buffer)
+			if _, ok := err.(*ErrMalformedProperties); !ok {
+				t.Errorf("Expected ErrMalformedProperties, but got: %v", err)
+			}
+		})
+	}
+}
+
+func TestPacket_PublishV5RoundTrip(t *testing.T) {
+	expiry := uint32(60)
+	packet := &Packet{
+		FixedHeader:      &FixedHeader{MessageType: PUBLISH, Qos: 1},
+		PublishTopic:     "a/b",
+		PacketIdentifier: 7,
+		Payload:          []byte("hello"),
+		ProtocolVersion:  MQTT5,
+		Properties:       &Properties{MessageExpiryInterval: &expiry},
+	}
+
+	buf := packet.EncodePublish()
+
+	decoded := &Packet{
+		FixedHeader:     &FixedHeader{MessageType: PUBLISH, Qos: 1},
+		ProtocolVersion: MQTT5,
+	}
+	// skip fixed header
+	if err := decoded.DecodePublish(buf[2:]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if decoded.PublishTopic != "a/b" || decoded.PacketIdentifier != 7 || string(decoded.Payload) != "hello" {
+		t.Errorf("Unexpected packet: %+v", decoded)
+	}
+
+	if decoded.Properties.MessageExpiryInterval == nil || *decoded.Properties.MessageExpiryInterval != 60 {
+		t.Errorf("Expected message expiry interval 60, got: %v", decoded.Properties.MessageExpiryInterval)
+	}
+}
+
+func TestDecodeAck_DataAfterProperties(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageType byte
+		buf         []byte
+	}{
+		{"PUBACK", PUBACK, []byte{0x00, 0x01, 0x00, 0x00, 0x00}},
+		{"PUBREL", PUBREL, []byte{0x00, 0x01, 0x00, 0x00, 0x01}},
+		{"DISCONNECT", DISCONNECT, []byte{0x00, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			packet := &Packet{FixedHeader: &FixedHeader{MessageType: test.messageType}, ProtocolVersion: MQTT5}
+			var err error
+			if test.messageType == DISCONNECT {
+				err = packet.DecodeDisconnect(test.buf)
+			} else {
+				err = packet.DecodePuback(test.buf)
+			}
+			if err == nil {
+				t.Errorf("Expected error for data after the properties")
+			}
+		})
+	}
+}
+
+func TestDecodeSubscriptionOptions(t *testing.T) {
+	opts, err := DecodeSubscriptionOptions(0x2D)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := SubscriptionOptions{QoS: 1, NoLocal: true, RetainAsPublished: true, RetainHandling: 2}
+	if opts != expected {
+		t.Errorf("Expected: %+v, but got: %+v", expected, opts)
+	}
+
+	if _, err := DecodeSubscriptionOptions(0x30); err == nil {
+		t.Errorf("Expected error for retain handling 3")
+	}
+}
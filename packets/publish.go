@@ -1,49 +1,188 @@
 package packets
 
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+type ErrTopicAliasInvalid struct{}
+
+func (e *ErrTopicAliasInvalid) Error() string {
+	return "Topic alias not allowed"
+}
+
 func (p *Packet) DecodePublish(buf []byte) error {
-	var n uint16
-	p.PublishTopic, n = DecodeUTF8String(buf)
+	var err error
+	p.PublishTopic, buf, err = decodeString(buf, PUBLISH)
+	if err != nil {
+		return err
+	}
+	if !IsValidTopicName(p.PublishTopic) {
+		return &ErrMalformedPacket{PUBLISH, "invalid topic name"}
+	}
+
 	if p.FixedHeader.Qos > 0 {
-		p.DecodePacketIdentifier(buf[n+2:])
-		n += 2
+		p.PacketIdentifier, buf, err = decodeUint16(buf, PUBLISH)
+		if err != nil {
+			return err
+		}
+		// [MQTT-2.3.1-1]
+		if p.PacketIdentifier == 0 {
+			return &ErrMalformedPacket{PUBLISH, "packet identifier 0"}
+		}
 	}
-	p.Payload = buf[n+2:]
+
+	if p.ProtocolVersion == MQTT5 {
+		p.Properties, buf, err = DecodeProperties(buf)
+		if err != nil {
+			return err
+		}
+		// broker does not advertise Topic Alias Maximum, so clients must not send one [MQTT-3.3.2-8]
+		if p.Properties.TopicAlias != nil {
+			return &ErrTopicAliasInvalid{}
+		}
+	}
+
+	p.Payload = buf
 	return nil
 }
 
+// IsValidTopicName reports whether messages can be published to the topic, a UTF-8 string of at least
+// one character without wildcards or null characters [MQTT-3.3.2-2] [MQTT-4.7.3-1] [MQTT-4.7.3-2]
+func IsValidTopicName(topic string) bool {
+	return topic != "" && utf8.ValidString(topic) && !strings.ContainsAny(topic, "+#\x00")
+}
+
+// DecodePuback decodes PUBACK, PUBREC, PUBREL and PUBCOMP packets.
+// In MQTT 5.0 the reason code and properties may be omitted when the reason code is 0x00.
 func (p *Packet) DecodePuback(buf []byte) error {
-	p.DecodePacketIdentifier(buf)
+	buf = p.DecodePacketIdentifier(buf)
+	if p.PacketIdentifier == 0 {
+		return &ErrMalformedPacket{p.FixedHeader.MessageType, "packet identifier 0"}
+	}
+	if p.ProtocolVersion != MQTT5 || len(buf) == 0 {
+		return nil
+	}
+
+	return p.decodeReasonCodeAndProperties(buf)
+}
+
+// decodeReasonCodeAndProperties reads the reason code and the optional properties that end
+// MQTT 5.0 acknowledgements, DISCONNECT and AUTH packets
+func (p *Packet) decodeReasonCodeAndProperties(buf []byte) error {
+	p.ReasonCode = buf[0]
+	if len(buf) == 1 {
+		return nil
+	}
+
+	var err error
+	var rest []byte
+	p.Properties, rest, err = DecodeProperties(buf[1:])
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return &ErrMalformedPacket{p.FixedHeader.MessageType, "unexpected data after the properties"}
+	}
 	return nil
 }
 
+// EncodePublish encodes the PUBLISH packet without modifying it, the remaining length is computed from its contents
 func (p *Packet) EncodePublish() []byte {
-	var buffer []byte
-	buffer = append(buffer, p.FixedHeader.Encode()...)
-	buffer = append(buffer, EncodeUTF8String(p.PublishTopic)...)
+	var properties []byte
+	if p.ProtocolVersion == MQTT5 {
+		properties = p.Properties.Encode()
+	}
 
+	remainingLength := 2 + len(p.PublishTopic) + len(properties) + len(p.Payload)
 	if p.FixedHeader.Qos > 0 {
-		buffer = append(buffer, EncodePacketIdentifier(p.PacketIdentifier)...)
+		remainingLength += 2
 	}
 
+	fixedHeader := *p.FixedHeader
+	fixedHeader.RemainingLength = uint32(remainingLength)
+
+	buffer := make([]byte, 0, 5+remainingLength)
+	buffer = append(buffer, fixedHeader.Encode()...)
+	buffer = append(buffer, byte(len(p.PublishTopic)>>8), byte(len(p.PublishTopic)))
+	buffer = append(buffer, p.PublishTopic...)
+	if p.FixedHeader.Qos > 0 {
+		buffer = append(buffer, byte(p.PacketIdentifier>>8), byte(p.PacketIdentifier))
+	}
+	buffer = append(buffer, properties...)
 	buffer = append(buffer, p.Payload...)
 	return buffer
 }
 
+// EncodedPublish is a PUBLISH encoded once and shared by all the clients it is sent to.
+// The packet identifier and the DUP flag are the only parts that differ between clients,
+// AppendTo patches them into a copy of the encoding.
+type EncodedPublish struct {
+	buf      []byte // encoding with packet identifier 0 and the DUP flag cleared
+	idOffset int    // offset of the packet identifier, 0 for QoS 0 messages which have none
+}
+
+// EncodeShared encodes the PUBLISH packet for sending to many clients, the packet is not modified
+func (p *Packet) EncodeShared() *EncodedPublish {
+	fixedHeader := *p.FixedHeader
+	fixedHeader.Dup = false
+
+	shared := *p
+	shared.FixedHeader = &fixedHeader
+	shared.PacketIdentifier = 0
+
+	encoded := &EncodedPublish{buf: shared.EncodePublish()}
+	if fixedHeader.Qos > 0 {
+		// the packet identifier follows the fixed header, whose remaining length takes up to 4 bytes, and the topic name
+		headerLength := 2
+		for encoded.buf[headerLength-1]&0x80 != 0 {
+			headerLength++
+		}
+		encoded.idOffset = headerLength + 2 + len(p.PublishTopic)
+	}
+	return encoded
+}
+
+// Bytes returns the shared encoding, it must not be modified
+func (e *EncodedPublish) Bytes() []byte {
+	return e.buf
+}
+
+// Len returns the size of the encoded packet
+func (e *EncodedPublish) Len() int {
+	return len(e.buf)
+}
+
+// AppendTo appends the encoding with the packet identifier and the DUP flag of a single client to dst
+func (e *EncodedPublish) AppendTo(dst []byte, packetID uint16, dup bool) []byte {
+	start := len(dst)
+	dst = append(dst, e.buf...)
+	if e.idOffset > 0 {
+		dst[start+e.idOffset] = byte(packetID >> 8)
+		dst[start+e.idOffset+1] = byte(packetID)
+	}
+	if dup {
+		dst[start] |= 0x08
+	}
+	return dst
+}
+
 func (p *Packet) EncodePuback() []byte {
-	var buffer []byte
-	packet := new(Packet)
-	packet.FixedHeader = new(FixedHeader)
-	packet.FixedHeader.MessageType = PUBACK
-	packet.FixedHeader.RemainingLength = 2
-	buffer = append(buffer, packet.FixedHeader.Encode()...)
-	buffer = append(buffer, EncodePacketIdentifier(p.PacketIdentifier)...)
-	return buffer
+	packet := BuildResp(p, PUBACK)
+	return packet.EncodeResp()
 }
 
 func (p Packet) EncodeResp() []byte {
+	variableHeader := EncodePacketIdentifier(p.PacketIdentifier)
+	if p.ProtocolVersion == MQTT5 && (p.ReasonCode != SUCCESS.Code || p.Properties != nil) {
+		variableHeader = append(variableHeader, p.ReasonCode)
+		variableHeader = append(variableHeader, p.Properties.Encode()...)
+	}
+	p.FixedHeader.RemainingLength = uint32(len(variableHeader))
+
 	var buffer []byte
 	buffer = append(buffer, p.FixedHeader.Encode()...)
-	buffer = append(buffer, EncodePacketIdentifier(p.PacketIdentifier)...)
+	buffer = append(buffer, variableHeader...)
 	return buffer
 }
 
@@ -52,15 +191,16 @@ func BuildResp(packet *Packet, messageType byte) *Packet {
 	resp.FixedHeader = new(FixedHeader)
 	resp.FixedHeader.MessageType = messageType
 	resp.FixedHeader.RemainingLength = 2
+	if messageType == PUBREL {
+		// bits 3,2,1 and 0 of the fixed header in the PUBREL packet are reserved and must be set to 0,0,1 and 0 [MQTT-3.6.1-1]
+		resp.FixedHeader.Qos = 1
+	}
 	resp.PacketIdentifier = packet.PacketIdentifier
+	resp.ProtocolVersion = packet.ProtocolVersion
 	return resp
 }
 
+// SetRightQoS downgrades the QoS of the packet to maxQoS, the remaining length is computed when it is encoded
 func (p *Packet) SetRightQoS(maxQoS byte) {
-	if maxQoS < p.FixedHeader.Qos {
-		p.FixedHeader.Qos = maxQoS
-		if maxQoS == 0 {
-			p.FixedHeader.RemainingLength -= 2
-		}
-	}
+	p.FixedHeader.Qos = min(p.FixedHeader.Qos, maxQoS)
 }
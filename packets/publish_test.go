@@ -0,0 +1,109 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testPublish(qos byte, protocolVersion byte) *Packet {
+	expiry := uint32(60)
+	return &Packet{
+		FixedHeader:      &FixedHeader{MessageType: PUBLISH, Qos: qos, Dup: true},
+		PublishTopic:     "sensors/kitchen/temperature",
+		PacketIdentifier: 42,
+		Payload:          bytes.Repeat([]byte("x"), 256),
+		ProtocolVersion:  protocolVersion,
+		Properties:       &Properties{MessageExpiryInterval: &expiry},
+	}
+}
+
+func TestEncodePublish_DoesNotModifyPacket(t *testing.T) {
+	packet := testPublish(1, MQTT5)
+	packet.FixedHeader.RemainingLength = 7
+
+	first := packet.EncodePublish()
+	second := packet.EncodePublish()
+
+	if packet.FixedHeader.RemainingLength != 7 {
+		t.Errorf("Expected remaining length to stay 7, got: %d", packet.FixedHeader.RemainingLength)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("Expected the same encoding twice, got: %x and %x", first, second)
+	}
+}
+
+func TestSetRightQoS(t *testing.T) {
+	packet := testPublish(1, MQTT311)
+	packet.SetRightQoS(0)
+	packet.SetRightQoS(0)
+	packet.SetRightQoS(2)
+
+	if packet.FixedHeader.Qos != 0 {
+		t.Fatalf("Expected QoS 0, got: %d", packet.FixedHeader.Qos)
+	}
+
+	// the packet identifier is left out of QoS 0 packets
+	decoded := &Packet{FixedHeader: &FixedHeader{MessageType: PUBLISH}, ProtocolVersion: MQTT311}
+	if err := decoded.DecodePublish(packet.EncodePublish()[3:]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.PublishTopic != packet.PublishTopic || !bytes.Equal(decoded.Payload, packet.Payload) {
+		t.Errorf("Unexpected packet: %+v", decoded)
+	}
+}
+
+func TestEncodedPublish_AppendTo(t *testing.T) {
+	for _, protocolVersion := range []byte{MQTT311, MQTT5} {
+		for qos := byte(0); qos <= 2; qos++ {
+			packet := testPublish(qos, protocolVersion)
+			encoded := packet.EncodeShared()
+
+			if !packet.FixedHeader.Dup || packet.PacketIdentifier != 42 {
+				t.Fatalf("Expected the packet not to be modified, got: %+v", packet)
+			}
+
+			for _, dup := range []bool{false, true} {
+				expected := *packet
+				fixedHeader := *packet.FixedHeader
+				fixedHeader.Dup = dup
+				expected.FixedHeader = &fixedHeader
+				expected.PacketIdentifier = 1000
+
+				got := encoded.AppendTo([]byte("prefix"), 1000, dup)
+				if !bytes.Equal(got[6:], expected.EncodePublish()) {
+					t.Errorf("Version %d QoS %d DUP %v: expected %x, got %x", protocolVersion, qos, dup, expected.EncodePublish(), got[6:])
+				}
+			}
+
+			if encoded.Bytes()[0]&0x08 != 0 {
+				t.Errorf("Expected the shared encoding without the DUP flag")
+			}
+		}
+	}
+}
+
+// the encoding of a message sent to many subscribers, copying and encoding the packet for every subscriber
+func BenchmarkPublishFanoutEncodeEach(b *testing.B) {
+	packet := testPublish(1, MQTT5)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		out := packet.Copy()
+		out.Properties = packet.Properties.ForwardCopy()
+		out.PacketIdentifier = uint16(i)
+		_ = out.EncodePublish()
+	}
+}
+
+// the same with the packet encoded once and the packet identifier patched into a reused buffer
+func BenchmarkPublishFanoutEncodeShared(b *testing.B) {
+	encoded := testPublish(1, MQTT5).EncodeShared()
+	buf := make([]byte, 0, encoded.Len())
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf = encoded.AppendTo(buf[:0], uint16(i), false)
+	}
+}
@@ -1,7 +1,9 @@
 package packets
 
 import (
-	"regexp"
+	"fmt"
+	"strings"
+	"unicode/utf8"
 )
 
 type ErrInvalidFixedHeader struct{}
@@ -15,19 +17,45 @@ func (e *ErrInvalidQoS) Error() string {
 	return "Invalid QoS"
 }
 
+// SubscriptionOptions are the options requested for a topic filter.
+// MQTT 3.1.1 clients can only request the maximum QoS.
+type SubscriptionOptions struct {
+	QoS               byte
+	NoLocal           bool // MQTT 5.0, don't forward messages published by the subscribing client
+	RetainAsPublished bool // MQTT 5.0, keep the retain flag when forwarding
+	RetainHandling    byte // MQTT 5.0, 0 - send retained, 1 - send retained only for new subscription, 2 - don't send retained
+}
+
 type Subscriptions struct {
-	Subscriptions        map[string]byte
+	Subscriptions        map[string]byte // return code for each topic filter, granted QoS or 0x80 on failure
 	OrderedSubscriptions []string
+	Options              map[string]SubscriptionOptions // requested options for each valid topic filter
 }
 
 func (s *Subscriptions) Copy() *Subscriptions {
+	if s == nil {
+		return nil
+	}
 	subscriptions := make(map[string]byte)
 	for k, v := range s.Subscriptions {
 		subscriptions[k] = v
 	}
 	orderedSubscriptions := make([]string, len(s.OrderedSubscriptions))
 	copy(orderedSubscriptions, s.OrderedSubscriptions)
-	return &Subscriptions{subscriptions, orderedSubscriptions}
+
+	var options map[string]SubscriptionOptions
+	if s.Options != nil {
+		options = make(map[string]SubscriptionOptions)
+		for k, v := range s.Options {
+			options[k] = v
+		}
+	}
+	return &Subscriptions{subscriptions, orderedSubscriptions, options}
+}
+
+// GetOptions returns the requested options of a topic filter
+func (s *Subscriptions) GetOptions(topic string) SubscriptionOptions {
+	return s.Options[topic]
 }
 
 func (s *Subscriptions) GetAll() map[string]byte {
@@ -44,7 +72,25 @@ func (p *Packet) DecodeSubscribe(buf []byte) error {
 	}
 
 	buf = p.DecodePacketIdentifier(buf)
-	p.Subscriptions = DecodeTopicsSubscribe(buf)
+	if p.PacketIdentifier == 0 {
+		return &ErrMalformedPacket{SUBSCRIBE, "packet identifier 0"}
+	}
+	if p.ProtocolVersion == MQTT5 {
+		var err error
+		p.Properties, buf, err = DecodeProperties(buf)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	p.Subscriptions, err = DecodeTopicsSubscribe(buf, p.ProtocolVersion)
+	if err != nil {
+		return err
+	}
+	// [MQTT-3.8.3-3]
+	if len(p.Subscriptions.OrderedSubscriptions) == 0 {
+		return &ErrMalformedPacket{SUBSCRIBE, "no topic filters"}
+	}
 	return nil
 }
 
@@ -53,31 +99,104 @@ func (p *Packet) DecodeUnsubscribe(buf []byte) error {
 		return &ErrInvalidFixedHeader{}
 	}
 	buf = p.DecodePacketIdentifier(buf)
-	p.Subscriptions = DecodeTopicsUnsubscribe(buf)
+	if p.PacketIdentifier == 0 {
+		return &ErrMalformedPacket{UNSUBSCRIBE, "packet identifier 0"}
+	}
+	if p.ProtocolVersion == MQTT5 {
+		var err error
+		p.Properties, buf, err = DecodeProperties(buf)
+		if err != nil {
+			return err
+		}
+	}
+	var err error
+	p.Subscriptions, err = DecodeTopicsUnsubscribe(buf)
+	if err != nil {
+		return err
+	}
+	// [MQTT-3.10.3-2]
+	if len(p.Subscriptions.OrderedSubscriptions) == 0 {
+		return &ErrMalformedPacket{UNSUBSCRIBE, "no topic filters"}
+	}
 	return nil
 }
 
-func DecodeTopicsSubscribe(buf []byte) *Subscriptions {
+// DecodeSuback reads the packet identifier and the return code of every topic filter of a SUBACK
+func (p *Packet) DecodeSuback(buf []byte) error {
+	return p.decodeAck(SUBACK, buf)
+}
+
+// DecodeUnsuback reads the packet identifier of an UNSUBACK, and the reason code of every topic filter in MQTT 5.0
+func (p *Packet) DecodeUnsuback(buf []byte) error {
+	return p.decodeAck(UNSUBACK, buf)
+}
+
+func (p *Packet) decodeAck(messageType byte, buf []byte) error {
+	buf = p.DecodePacketIdentifier(buf)
+	if p.PacketIdentifier == 0 {
+		return &ErrMalformedPacket{messageType, "packet identifier 0"}
+	}
+
+	if p.ProtocolVersion == MQTT5 {
+		var err error
+		p.Properties, buf, err = DecodeProperties(buf)
+		if err != nil {
+			return err
+		}
+	} else if messageType == UNSUBACK {
+		// MQTT 3.1.1 UNSUBACK has no payload
+		return nil
+	}
+
+	if len(buf) == 0 {
+		return &ErrMalformedPacket{messageType, "no return codes"}
+	}
+	for _, code := range buf {
+		// MQTT 3.1.1 SUBACK return codes are the granted QoS or 0x80 for failure [MQTT-3.9.3-2]
+		if p.ProtocolVersion != MQTT5 && code > 2 && code != 0x80 {
+			return &ErrMalformedPacket{messageType, fmt.Sprintf("reserved return code 0x%02X", code)}
+		}
+	}
+	p.ReasonCodes = append([]byte{}, buf...)
+	return nil
+}
+
+// DecodeTopicsSubscribe reads the topic filters and their subscription options of a SUBSCRIBE payload.
+// Invalid topic filters are kept with the failure return code 0x80.
+func DecodeTopicsSubscribe(buf []byte, protocolVersion byte) (*Subscriptions, error) {
 	var qos byte
 	var err error
+	var opts SubscriptionOptions
 
-	l := len(buf)
 	topics := make(map[string]byte)
 	topicsOrdered := make([]string, 0)
-	for i := 0; i < l; {
-		topic, n := DecodeUTF8String(buf[i:])
+	options := make(map[string]SubscriptionOptions)
+	for len(buf) > 0 {
+		var topic string
+		topic, buf, err = decodeString(buf, SUBSCRIBE)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) == 0 {
+			return nil, &ErrMalformedPacket{SUBSCRIBE, "missing subscription options"}
+		}
 
-		if IsValidTopicFilter(topic) {
-			qos, err = DecodeQoS(buf[i+int(n)+2])
+		if protocolVersion == MQTT5 {
+			opts, err = DecodeSubscriptionOptions(buf[0])
 		} else {
-			qos = 0x80
+			qos, err = DecodeQoS(buf[0])
+			opts = SubscriptionOptions{QoS: qos}
 		}
-
-		//  3 bytes because of 2 bytes for UTF8 string length and 1 byte for qos + length of topic
-		i += int(n) + 3
-
 		if err != nil {
-			return nil
+			return nil, err
+		}
+		buf = buf[1:]
+
+		if IsValidTopicFilter(topic) {
+			qos = opts.QoS
+			options[topic] = opts
+		} else {
+			qos = 0x80
 		}
 		topics[topic] = qos
 		topicsOrdered = append(topicsOrdered, topic)
@@ -85,60 +204,199 @@ func DecodeTopicsSubscribe(buf []byte) *Subscriptions {
 	return &Subscriptions{
 		topics,
 		topicsOrdered,
-	}
+		options,
+	}, nil
 }
 
 func IsValidTopicFilter(topicFilter string) bool {
-	regex := regexp.MustCompile(`^(?:(?:[A-Za-z0-9_+-]+\/)*[A-Za-z0-9_+-]+(?:\/\+)?|\+)$|^(?:[A-Za-z0-9_+-]+\/)*\#$`)
-	return regex.MatchString(topicFilter)
+	if group, filter, ok := ParseSharedSubscription(topicFilter); ok {
+		// share name can't contain wildcards [MQTT-4.8.2-2]
+		if group == "" || strings.ContainsAny(group, "+#") {
+			return false
+		}
+		topicFilter = filter
+	} else if strings.HasPrefix(topicFilter, SharedSubscriptionPrefix) {
+		return false
+	}
+
+	// topic filters are UTF-8 strings of at least one character without null characters [MQTT-4.7.3-1] [MQTT-4.7.3-2]
+	if topicFilter == "" || !utf8.ValidString(topicFilter) || strings.ContainsRune(topicFilter, 0) {
+		return false
+	}
+
+	levels := strings.Split(topicFilter, "/")
+	for i, level := range levels {
+		// multi-level wildcard must occupy a whole level and be the last character [MQTT-4.7.1-2]
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		// single-level wildcard must occupy a whole level [MQTT-4.7.1-3]
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
 }
 
-func DecodeTopicsUnsubscribe(buf []byte) *Subscriptions {
-	l := len(buf)
-	topicsOrdered := make([]string, 0)
-	for i := 0; i < l; {
-		topic, n := DecodeUTF8String(buf[i:])
+const SharedSubscriptionPrefix = "$share/"
+
+// ParseSharedSubscription splits a shared subscription "$share/<group>/<filter>"
+// into the share name and the topic filter. ok is false for non shared subscriptions.
+func ParseSharedSubscription(topicFilter string) (group string, filter string, ok bool) {
+	if !strings.HasPrefix(topicFilter, SharedSubscriptionPrefix) {
+		return "", "", false
+	}
 
-		// 3 bytes because of 2 bytes for UTF8 string length + length of topic
-		i += int(n) + 2
+	group, filter, ok = strings.Cut(topicFilter[len(SharedSubscriptionPrefix):], "/")
+	return group, filter, ok
+}
+
+// DecodeTopicsUnsubscribe reads the topic filters of an UNSUBSCRIBE payload
+func DecodeTopicsUnsubscribe(buf []byte) (*Subscriptions, error) {
+	topicsOrdered := make([]string, 0)
+	for len(buf) > 0 {
+		var topic string
+		var err error
+		topic, buf, err = decodeString(buf, UNSUBSCRIBE)
+		if err != nil {
+			return nil, err
+		}
 		topicsOrdered = append(topicsOrdered, topic)
 	}
 	return &Subscriptions{
 		OrderedSubscriptions: topicsOrdered,
-	}
+	}, nil
 }
 
 func DecodeQoS(b byte) (byte, error) {
 	qos := b & 0x03
-	if (b>>2 != 0) && (qos > 2) {
+	// upper bits of the requested QoS byte are reserved [MQTT-3-8.3-4]
+	if b>>2 != 0 || qos > 2 {
 		return 0, &ErrInvalidQoS{}
 	}
 	return qos, nil
 }
 
+// DecodeSubscriptionOptions decodes the MQTT 5.0 subscription options byte [MQTT-3.8.3.1]
+func DecodeSubscriptionOptions(b byte) (SubscriptionOptions, error) {
+	opts := SubscriptionOptions{
+		QoS:               b & 0x03,
+		NoLocal:           b&0x04 != 0,
+		RetainAsPublished: b&0x08 != 0,
+		RetainHandling:    (b >> 4) & 0x03,
+	}
+
+	// reserved bits must be 0 [MQTT-3.8.3-5]
+	if opts.QoS > 2 || opts.RetainHandling > 2 || b>>6 != 0 {
+		return SubscriptionOptions{}, &ErrInvalidQoS{}
+	}
+	return opts, nil
+}
+
+// EncodeSubscriptionOptions encodes the MQTT 5.0 subscription options byte, MQTT 3.1.1 only uses the QoS bits
+func EncodeSubscriptionOptions(opts SubscriptionOptions) byte {
+	b := opts.QoS | opts.RetainHandling<<4
+	if opts.NoLocal {
+		b |= 0x04
+	}
+	if opts.RetainAsPublished {
+		b |= 0x08
+	}
+	return b
+}
+
 func validFHSubscribe(fixedHeader *FixedHeader) bool {
 	// last four bits of first byte have to be set to 0010 [MQTT-3.8.1-1]
 	return fixedHeader.Qos == 1 && !fixedHeader.Dup && !fixedHeader.Retain
 }
 
-func (p *Packet) EncodeSuback() []byte {
-	// buffer size is: 2 bytes fixed header + 2 bytes varible header + one byte per topic
-	buf := make([]byte, 4+len(p.Subscriptions.OrderedSubscriptions))
-	buf[0] = 0x90
-	buf[1] = byte(len(buf) - 2)
-	buf[2] = byte(p.PacketIdentifier >> 8)
-	buf[3] = byte(p.PacketIdentifier & 0xFF)
-	for i, topic := range p.Subscriptions.OrderedSubscriptions {
-		buf[i+4] = p.Subscriptions.Subscriptions[topic]
+// EncodeSubscribe encodes a SUBSCRIBE with the topic filters in OrderedSubscriptions and their options
+func (p *Packet) EncodeSubscribe() []byte {
+	variableHeader := EncodePacketIdentifier(p.PacketIdentifier)
+	if p.ProtocolVersion == MQTT5 {
+		variableHeader = append(variableHeader, p.Properties.Encode()...)
 	}
-	return buf
+	for _, topic := range p.Subscriptions.OrderedSubscriptions {
+		opts := p.Subscriptions.GetOptions(topic)
+		if p.ProtocolVersion != MQTT5 {
+			opts = SubscriptionOptions{QoS: opts.QoS}
+		}
+		variableHeader = append(variableHeader, EncodeUTF8String(topic)...)
+		variableHeader = append(variableHeader, EncodeSubscriptionOptions(opts))
+	}
+
+	// [MQTT-3.8.1-1]
+	fixedHeader := &FixedHeader{MessageType: SUBSCRIBE, Qos: 1, RemainingLength: uint32(len(variableHeader))}
+	return append(fixedHeader.Encode(), variableHeader...)
+}
+
+// EncodeUnsubscribe encodes an UNSUBSCRIBE with the topic filters in OrderedSubscriptions
+func (p *Packet) EncodeUnsubscribe() []byte {
+	variableHeader := EncodePacketIdentifier(p.PacketIdentifier)
+	if p.ProtocolVersion == MQTT5 {
+		variableHeader = append(variableHeader, p.Properties.Encode()...)
+	}
+	for _, topic := range p.Subscriptions.OrderedSubscriptions {
+		variableHeader = append(variableHeader, EncodeUTF8String(topic)...)
+	}
+
+	// [MQTT-3.10.1-1]
+	fixedHeader := &FixedHeader{MessageType: UNSUBSCRIBE, Qos: 1, RemainingLength: uint32(len(variableHeader))}
+	return append(fixedHeader.Encode(), variableHeader...)
+}
+
+// NewSuback builds the SUBACK of a SUBSCRIBE with the return code of each of its topic filters, in the order they
+// were requested. Nothing else is taken from the SUBSCRIBE, its properties must not be sent back [MQTT-3.9.2.1].
+func NewSuback(subscribe *Packet) *Packet {
+	suback := newAck(SUBACK, subscribe)
+	for _, topic := range subscribe.Subscriptions.OrderedSubscriptions {
+		suback.ReasonCodes = append(suback.ReasonCodes, subscribe.Subscriptions.Subscriptions[topic])
+	}
+	return suback
+}
+
+// NewUnsuback builds the UNSUBACK of an UNSUBSCRIBE, with reason code Success for each of its topic filters
+func NewUnsuback(unsubscribe *Packet) *Packet {
+	unsuback := newAck(UNSUBACK, unsubscribe)
+	for range unsubscribe.Subscriptions.OrderedSubscriptions {
+		unsuback.ReasonCodes = append(unsuback.ReasonCodes, SUCCESS.Code)
+	}
+	return unsuback
 }
 
+func newAck(messageType byte, request *Packet) *Packet {
+	return &Packet{
+		FixedHeader:      &FixedHeader{MessageType: messageType},
+		PacketIdentifier: request.PacketIdentifier,
+		ProtocolVersion:  request.ProtocolVersion,
+	}
+}
+
+// EncodeSuback encodes a SUBACK with its return codes
+func (p *Packet) EncodeSuback() []byte {
+	return p.encodeAck(SUBACK)
+}
+
+// EncodeUnsuback encodes an UNSUBACK, with its reason codes in MQTT 5.0
 func (p *Packet) EncodeUnsuback() []byte {
-	buf := make([]byte, 4)
-	buf[0] = 0xB0
-	buf[1] = 2
-	buf[2] = byte(p.PacketIdentifier >> 8)
-	buf[3] = byte(p.PacketIdentifier & 0xFF)
-	return buf
+	return p.encodeAck(UNSUBACK)
+}
+
+// encodeAck encodes SUBACK and UNSUBACK packets, with one reason code per topic filter.
+// MQTT 3.1.1 UNSUBACK packets only have the packet identifier.
+func (p *Packet) encodeAck(messageType byte) []byte {
+	variableHeader := EncodePacketIdentifier(p.PacketIdentifier)
+	if p.ProtocolVersion == MQTT5 {
+		variableHeader = append(variableHeader, p.Properties.Encode()...)
+	}
+
+	if p.ProtocolVersion == MQTT5 || messageType == SUBACK {
+		variableHeader = append(variableHeader, p.ReasonCodes...)
+	}
+
+	fixedHeader := &FixedHeader{
+		MessageType:     messageType,
+		RemainingLength: uint32(len(variableHeader)),
+	}
+	return append(fixedHeader.Encode(), variableHeader...)
 }
@@ -0,0 +1,79 @@
+package packets
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIsValidTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected bool
+	}{
+		{"sensors/temp", true},
+		{"sensors/+", true},
+		{"sensors/#", true},
+		{"#", true},
+		{"sensors/#/temp", false},
+		{"sensors/te+mp", false},
+		{"sensors/temp#", false},
+		{"", false},
+		{"$SYS/#", true},
+		{"$SYS/broker/retained messages/count", true},
+		{"$share/workers/jobs/#", true},
+		{"$share/workers/+", true},
+		{"$share/workers", false},
+		{"$share//jobs", false},
+		{"$share/work+ers/jobs", false},
+		{"$share/workers/jobs/#/x", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			if got := IsValidTopicFilter(test.filter); got != test.expected {
+				t.Errorf("Expected %v, but got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestParseSharedSubscription(t *testing.T) {
+	group, filter, ok := ParseSharedSubscription("$share/workers/jobs/+/run")
+	if !ok || group != "workers" || filter != "jobs/+/run" {
+		t.Errorf("Unexpected result: %q %q %v", group, filter, ok)
+	}
+
+	if _, _, ok := ParseSharedSubscription("jobs/+/run"); ok {
+		t.Errorf("Expected non shared subscription")
+	}
+}
+
+func TestNewSuback_DoesNotEchoSubscribeProperties(t *testing.T) {
+	subscribe := &Packet{
+		FixedHeader:      &FixedHeader{MessageType: SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 9,
+		ProtocolVersion:  MQTT5,
+		Properties:       &Properties{SubscriptionIdentifiers: []uint32{7}, UserProperties: []UserProperty{{"k", "v"}}},
+		Subscriptions: &Subscriptions{
+			Subscriptions:        map[string]byte{"a": 1, "b/#": 0x87},
+			OrderedSubscriptions: []string{"b/#", "a"},
+		},
+	}
+
+	expected := []byte{0x90, 0x05, 0x00, 0x09, 0x00, 0x87, 0x01}
+	if encoded := NewSuback(subscribe).EncodeSuback(); !bytes.Equal(encoded, expected) {
+		t.Errorf("Expected SUBACK %x, but got: %x", expected, encoded)
+	}
+
+	subscribe.FixedHeader.MessageType = UNSUBSCRIBE
+	expected = []byte{0xB0, 0x05, 0x00, 0x09, 0x00, 0x00, 0x00}
+	if encoded := NewUnsuback(subscribe).EncodeUnsuback(); !bytes.Equal(encoded, expected) {
+		t.Errorf("Expected UNSUBACK %x, but got: %x", expected, encoded)
+	}
+
+	subscribe.ProtocolVersion = MQTT311
+	expected = []byte{0xB0, 0x02, 0x00, 0x09}
+	if encoded := NewUnsuback(subscribe).EncodeUnsuback(); !bytes.Equal(encoded, expected) {
+		t.Errorf("Expected MQTT 3.1.1 UNSUBACK %x, but got: %x", expected, encoded)
+	}
+}
@@ -0,0 +1,93 @@
+package nixmq
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+func TestBroker_MaxPacketSize(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.MaxPacketSize = 100
+
+	// MQTT 5.0 clients are told the maximum
+	c := dial(t, l, packets.MQTT5)
+	connack := c.connect(connectOptions(packets.MQTT5, "client"))
+	if props := connack.Properties; props == nil || props.MaximumPacketSize == nil || *props.MaximumPacketSize != 100 {
+		t.Errorf("Expected Maximum Packet Size 100 in the CONNACK, but got: %+v", props)
+	}
+
+	c.publish("a", strings.Repeat("x", 50), 1, false)
+	c.send(newPublish("a", strings.Repeat("x", 200), 1, false))
+	c.expectDisconnect(packets.PACKET_TOO_LARGE)
+	if tooLarge := atomic.LoadUint64(&b.Info.PacketsTooLarge); tooLarge != 1 {
+		t.Errorf("Expected 1 packet too large, but got %d", tooLarge)
+	}
+}
+
+func TestBroker_DefaultMaxPacketSize(t *testing.T) {
+	b, l := newTestBroker(t)
+	if b.MaxPacketSize == 0 || b.MaxOutboundBytes == 0 {
+		t.Fatalf("Expected packet and outbound size limits by default, but got %d and %d", b.MaxPacketSize, b.MaxOutboundBytes)
+	}
+
+	// only the fixed header of a 2 MB PUBLISH is sent, the packet is refused before it is read
+	c := connect(t, l, connectOptions(packets.MQTT5, "client"))
+	c.write([]byte{0x30, 0x80, 0x80, 0x80, 0x01})
+	c.expectDisconnect(packets.PACKET_TOO_LARGE)
+}
+
+func TestBroker_MaxConnectPacketSize(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.MaxConnectPacketSize = 100
+
+	// the CONNECT is refused before it is read
+	c := dial(t, l, packets.MQTT311)
+	options := connectOptions(packets.MQTT311, "client")
+	options.WillTopic = "will"
+	options.WillMessage = strings.Repeat("x", 200)
+	c.write(options.Encode())
+	c.expectClosed()
+
+	options.WillMessage = "x"
+	connect(t, l, options)
+}
+
+func TestBroker_ClientMaximumPacketSize(t *testing.T) {
+	b, l := newTestBroker(t)
+	maximum := uint32(64)
+	options := connectOptions(packets.MQTT5, "subscriber")
+	options.Properties = &packets.Properties{MaximumPacketSize: &maximum}
+	subscriber := connect(t, l, options)
+	subscriber.subscribe(1, "a", packets.SubscriptionOptions{QoS: 1})
+
+	// messages larger than the client accepts are dropped
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+	publisher.publish("a", strings.Repeat("x", 100), 1, false)
+	publisher.publish("a", "small", 1, false)
+	subscriber.ack(subscriber.expectPublish("a", "small"))
+	subscriber.expectNothing(50 * time.Millisecond)
+	if tooLarge := atomic.LoadUint64(&b.Info.MessagesTooLarge); tooLarge != 1 {
+		t.Errorf("Expected 1 message too large, but got %d", tooLarge)
+	}
+}
+
+func TestOutbound_MaxOutboundBytes(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.MaxOutboundPackets = 0
+	b.MaxOutboundBytes = 64
+	subscriber := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	publishToStalledSubscriber(t, l, subscriber, 20)
+
+	// the 131 bytes of PUBLISH packets don't fit in the packets being written and the ones waiting
+	received := subscriber.received()
+	if len(received) == 0 || received[len(received)-1] != "20" {
+		t.Fatalf("Expected the newest message to be received, but got: %v", received)
+	}
+	if dropped := atomic.LoadUint64(&b.Info.OutboundDropped); dropped == 0 || int(dropped)+len(received) != 20 {
+		t.Errorf("Expected the %d messages not received to be dropped, but %d were", 20-len(received), dropped)
+	}
+}
@@ -0,0 +1,140 @@
+package nixmq
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// HashAlgorithm is the algorithm used to hash passwords stored in a password file
+type HashAlgorithm string
+
+const (
+	Bcrypt   HashAlgorithm = "bcrypt"
+	Argon2id HashAlgorithm = "argon2id"
+	PBKDF2   HashAlgorithm = "pbkdf2" // PBKDF2-SHA512 in the mosquitto_passwd "$7$" format
+)
+
+var ErrUnknownHashAlgorithm = errors.New("unknown password hash algorithm")
+
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+	argon2KeyLen  = 32
+
+	pbkdf2Iterations = 210000
+	pbkdf2KeyLen     = sha512.Size
+
+	saltLen = 16
+)
+
+// HashPassword hashes the password with the algorithm, returning it in the format stored in password files
+func HashPassword(password string, algorithm HashAlgorithm) (string, error) {
+	switch algorithm {
+	case Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case Argon2id:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	case PBKDF2:
+		salt, err := newSalt()
+		if err != nil {
+			return "", err
+		}
+		key := pbkdf2.Key([]byte(password), salt, pbkdf2Iterations, pbkdf2KeyLen, sha512.New)
+		return fmt.Sprintf("$7$%d$%s$%s", pbkdf2Iterations,
+			base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(key)), nil
+	}
+	return "", ErrUnknownHashAlgorithm
+}
+
+// VerifyPassword returns true if the password matches the hash, the algorithm is detected from the hash format
+func VerifyPassword(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2id(hash, password)
+	case strings.HasPrefix(hash, "$7$"):
+		return verifyPBKDF2(hash, password)
+	}
+	return false
+}
+
+// verifyArgon2id checks a hash in the format $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func verifyArgon2id(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, computed) == 1
+}
+
+// verifyPBKDF2 checks a hash in the format $7$<iterations>$<salt>$<key>
+func verifyPBKDF2(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[2])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	computed := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha512.New)
+	return subtle.ConstantTimeCompare(key, computed) == 1
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltLen)
+	_, err := rand.Read(salt)
+	return salt, err
+}
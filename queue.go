@@ -0,0 +1,209 @@
+package nixmq
+
+import (
+	"sync/atomic"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// DropPolicy selects which message is dropped when the queue of a session or the retained messages are full
+type DropPolicy byte
+
+const (
+	DropOldest DropPolicy = iota // make room by dropping the oldest message
+	DropNewest                   // drop the message that doesn't fit
+)
+
+// how many QoS 1 and 2 messages may be unacknowledged by a client when neither the broker nor the client limits it
+const maxInflightWindow = 65535
+
+// inflightWindow returns how many QoS 1 and 2 messages may be unacknowledged by the client,
+// the smaller of the broker's MaxInflight and the MQTT 5.0 Receive Maximum of the client
+func (b *Broker) inflightWindow(client *Client) int {
+	window := maxInflightWindow
+	if b.MaxInflight > 0 {
+		window = min(window, b.MaxInflight)
+	}
+	if receiveMaximum := client.Properties.ReceiveMaximum; receiveMaximum > 0 {
+		window = min(window, int(receiveMaximum))
+	}
+	return window
+}
+
+// send sends the message to the client, unless the session is inactive or the inflight window is full
+// and it is queued instead. encoded is the shared encoding of a message sent to many clients, or nil.
+// group is the shared subscription group the message was received through, or nil.
+// Returns false if the message was queued or dropped.
+func (b *Broker) send(client *Client, packet *packets.Packet, encoded *packets.EncodedPublish, group *sharedGroup) bool {
+	// messages larger than the client accepts are dropped as if they were sent [MQTT-3.1.2-25]
+	if b.exceedsMaximumPacketSize(client, packet, encoded) {
+		atomic.AddUint64(&b.Info.MessagesTooLarge, 1)
+		return false
+	}
+
+	s := client.Session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active {
+		// QoS 1 and 2 messages wait behind the queued ones to keep their order
+		if packet.FixedHeader.Qos == 0 || (len(s.queue) == 0 && len(s.PendingPackets) < b.inflightWindow(client)) {
+			b.transmit(client, packet, encoded)
+			if group != nil && packet.FixedHeader.Qos > 0 {
+				s.tagShared(packet, group)
+			}
+			return true
+		}
+	} else if packet.FixedHeader.Qos == 0 && !b.QueueQoS0 && client.IsClosed() {
+		// QoS 0 messages still queue while a connecting client is about to receive its queued messages
+		return false
+	}
+
+	if b.MaxQueuedMessages > 0 && len(s.queue) >= b.MaxQueuedMessages {
+		atomic.AddUint64(&b.Info.MessagesDropped, 1)
+		if b.QueueDropPolicy == DropNewest {
+			return false
+		}
+		delete(s.sharedGroups, s.queue[0])
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		b.storeDequeued(client, 1)
+	}
+
+	// queued messages belong to the session, QoS 0 messages are still shared with other subscribers
+	if encoded != nil && packet.FixedHeader.Qos == 0 {
+		packet = packet.Copy()
+	}
+	s.queue = append(s.queue, packet)
+	if group != nil {
+		s.tagShared(packet, group)
+	}
+	b.storeQueued(client, packet)
+	return false
+}
+
+// transmit assigns QoS 1 and 2 messages a packet identifier, keeping them until they are acknowledged,
+// and sends the message. Called while holding the session lock, so messages are sent in the order they are admitted.
+// Messages with a shared encoding are sent without encoding them again.
+func (b *Broker) transmit(client *Client, packet *packets.Packet, encoded *packets.EncodedPublish) {
+	s := client.Session
+	if packet.FixedHeader.Qos > 0 {
+		packet.PacketIdentifier = s.nextPacketID()
+		s.PendingPackets[packet.PacketIdentifier] = packet
+		s.markSent(packet.PacketIdentifier)
+		b.storeInflight(client, packet)
+	}
+
+	switch {
+	case encoded == nil:
+		// the client may have reconnected with another protocol version since the message was queued
+		packet.ProtocolVersion = client.Properties.ProtocolLevel
+		client.Send(packet.EncodePublish())
+	case packet.FixedHeader.Qos == 0:
+		client.Send(encoded.Bytes())
+	default:
+		client.sendPublish(encoded, packet.PacketIdentifier)
+	}
+}
+
+// sendQueued sends the queued messages the inflight window allows and activates the session,
+// so new messages are sent right away. It is called again whenever an acknowledgement frees the window.
+func (b *Broker) sendQueued(client *Client) {
+	s := client.Session
+	s.mu.Lock()
+
+	window := b.inflightWindow(client)
+	var sent []*packets.Packet
+	dequeued := 0
+	for len(s.queue) > 0 {
+		packet := s.queue[0]
+		if packet.FixedHeader.Qos > 0 && len(s.PendingPackets) >= window {
+			break
+		}
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		dequeued++
+		// the client may have reconnected with a lower maximum packet size
+		if b.exceedsMaximumPacketSize(client, packet, nil) {
+			delete(s.sharedGroups, packet)
+			atomic.AddUint64(&b.Info.MessagesTooLarge, 1)
+			continue
+		}
+		b.transmit(client, packet, nil)
+		// QoS 0 messages are done once they are sent
+		if packet.FixedHeader.Qos == 0 {
+			delete(s.sharedGroups, packet)
+		}
+		sent = append(sent, packet)
+	}
+	b.storeDequeued(client, dequeued)
+
+	s.active = !client.IsClosed()
+	s.mu.Unlock()
+
+	for _, packet := range sent {
+		b.Hooks.OnMessageDelivered(client, packet)
+	}
+}
+
+// nextPacketID returns the next packet identifier not used by an unacknowledged packet,
+// called while holding the lock. The inflight window keeps fewer than 65535 packets unacknowledged.
+func (s *Session) nextPacketID() uint16 {
+	for {
+		s.lastPacketID++
+		if s.lastPacketID == 0 {
+			s.lastPacketID = 1
+		}
+		if _, used := s.PendingPackets[s.lastPacketID]; !used {
+			return s.lastPacketID
+		}
+	}
+}
+
+// QueueLen returns the number of messages waiting for the client to connect
+func (s *Session) QueueLen() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.queue)
+}
+
+// deactivate makes new messages queue until the session is activated by sendQueued
+func (s *Session) deactivate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = false
+}
+
+// inherit takes over the unacknowledged and queued messages of the previous session of the client.
+// Messages queued for the previous session are older than the ones already queued.
+func (s *Session) inherit(old *Session) {
+	old.mu.Lock()
+	pending := old.PendingPackets
+	received := old.received
+	sent, sendSeq := old.sent, old.sendSeq
+	queue := old.queue
+	sharedGroups := old.sharedGroups
+	old.PendingPackets = make(map[uint16]*packets.Packet)
+	old.received = make(map[uint16]*packets.Packet)
+	old.sent = make(map[uint16]*sendInfo)
+	old.queue = nil
+	old.sharedGroups = nil
+	old.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, packet := range pending {
+		s.PendingPackets[id] = packet
+	}
+	for id, packet := range received {
+		s.received[id] = packet
+	}
+	for id, info := range sent {
+		s.sent[id] = info
+	}
+	for packet, group := range sharedGroups {
+		s.tagShared(packet, group)
+	}
+	s.sendSeq = max(s.sendSeq, sendSeq)
+	s.queue = append(queue, s.queue...)
+}
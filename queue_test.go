@@ -0,0 +1,91 @@
+package nixmq
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// offlineSubscriber leaves a persistent session subscribed to the topic filter and returns the options
+// to resume it with
+func offlineSubscriber(t *testing.T, b *Broker, l *listeners.MemoryListener, clientID string, filter string) *packets.ConnectOptions {
+	t.Helper()
+	options := connectOptions(packets.MQTT311, clientID)
+	options.CleanSession = false
+	c := connect(t, l, options)
+	c.subscribe(1, filter, packets.SubscriptionOptions{QoS: 1})
+	c.conn.Close()
+	eventually(t, func() bool {
+		client, ok := b.clients.Get(clientID)
+		return ok && client.IsClosed()
+	}, "Expected the client to be disconnected")
+	return options
+}
+
+// resume reconnects to the session, failing the test unless it was kept
+func resume(t *testing.T, l *listeners.MemoryListener, options *packets.ConnectOptions) *testClient {
+	t.Helper()
+	c := dial(t, l, options.ProtocolLevel)
+	if connack := c.connect(options); connack.ReasonCode != packets.ACCEPTED.Code || !connack.SessionPresent {
+		t.Fatalf("Expected the session to be resumed, but got reason code 0x%02X", connack.ReasonCode)
+	}
+	return c
+}
+
+func TestQueue_OfflineMessages(t *testing.T) {
+	b, l := newTestBroker(t)
+	options := offlineSubscriber(t, b, l, "offline", "a/#")
+
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+	publisher.publish("a/1", "1", 1, false)
+	publisher.publish("a/0", "qos 0", 0, false)
+	publisher.publish("a/2", "2", 2, false)
+
+	// QoS 0 messages are not queued for offline sessions
+	c := resume(t, l, options)
+	first := c.expectPublish("a/1", "1")
+	publish := c.expectPublish("a/2", "2")
+	if publish.FixedHeader.Qos != 1 {
+		t.Errorf("Expected the QoS of the subscription, but got %d", publish.FixedHeader.Qos)
+	}
+	c.ack(first)
+	c.ack(publish)
+	c.expectNothing(50 * time.Millisecond)
+}
+
+func TestQueue_DropPolicy(t *testing.T) {
+	tests := []struct {
+		policy   DropPolicy
+		received []string
+	}{
+		{DropOldest, []string{"2", "3"}},
+		{DropNewest, []string{"1", "2"}},
+	}
+
+	for _, test := range tests {
+		b, l := newTestBroker(t)
+		b.MaxQueuedMessages = 2
+		b.QueueDropPolicy = test.policy
+		options := offlineSubscriber(t, b, l, "offline", "a")
+
+		publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+		for _, payload := range []string{"1", "2", "3"} {
+			publisher.publish("a", payload, 1, false)
+		}
+		// the PUBACK is sent before the message is delivered
+		eventually(t, func() bool { return atomic.LoadUint64(&b.Info.MessagesDropped) == 1 }, "Expected 1 dropped message")
+
+		c := resume(t, l, options)
+		var received []*packets.Packet
+		for _, payload := range test.received {
+			received = append(received, c.expectPublish("a", payload))
+		}
+		for _, publish := range received {
+			c.ack(publish)
+		}
+		c.expectNothing(50 * time.Millisecond)
+	}
+}
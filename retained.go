@@ -0,0 +1,358 @@
+package nixmq
+
+import (
+	"container/list"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// how often expired retained messages are removed
+const retainedSweepInterval = time.Minute
+
+// RetainedMessage is a retained message with its lifecycle information
+type RetainedMessage struct {
+	Packet  *packets.Packet
+	Stored  time.Time // when the message was retained
+	Expires time.Time // zero if the message doesn't expire
+
+	node    *topicNode    // node of the topic
+	element *list.Element // position in TopicTree.retainedOrder, nil once removed
+	system  bool          // retained by the broker itself, not counted against the limits and never in retainedOrder
+}
+
+// Topic returns the topic name of the message
+func (m *RetainedMessage) Topic() string {
+	return m.Packet.PublishTopic
+}
+
+// Size returns the number of bytes the message counts against RetainLimits.MaxBytes
+func (m *RetainedMessage) Size() int {
+	return len(m.Packet.PublishTopic) + len(m.Packet.Payload)
+}
+
+func (m *RetainedMessage) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// RetainLimits bound the retained messages kept by a TopicTree, zero values disable a limit
+type RetainLimits struct {
+	MaxMessages int           // number of retained messages
+	MaxBytes    int           // total size of the retained messages
+	DropPolicy  DropPolicy    // DropOldest evicts the least recently retained messages, DropNewest refuses the new one
+	TTL         time.Duration // lifetime of messages without an MQTT 5.0 message expiry interval
+}
+
+// retainedExpiry returns when a message retained at now expires, the message expiry interval
+// of MQTT 5.0 messages takes precedence over the TTL
+func retainedExpiry(packet *packets.Packet, now time.Time, ttl time.Duration) time.Time {
+	if packet.Properties != nil && packet.Properties.MessageExpiryInterval != nil {
+		return now.Add(time.Duration(*packet.Properties.MessageExpiryInterval) * time.Second)
+	}
+	if ttl > 0 {
+		return now.Add(ttl)
+	}
+	return time.Time{}
+}
+
+// Retain keeps the packet as the retained message of its topic. A packet with an empty payload
+// removes the retained message instead [MQTT-3.3.1-10]. Returns the messages evicted to make room,
+// and false if the packet was refused because of the limits.
+func (t *TopicTree) Retain(packet *packets.Packet, limits RetainLimits) ([]*RetainedMessage, bool) {
+	if len(packet.Payload) == 0 {
+		t.ClearRetained(packet.PublishTopic)
+		return nil, true
+	}
+
+	now := time.Now()
+	message := &RetainedMessage{
+		Packet:  packet,
+		Stored:  now,
+		Expires: retainedExpiry(packet, now, limits.TTL),
+		node:    t.getTopicNode(splitTopic(packet.PublishTopic), t.root),
+	}
+	size := message.Size()
+
+	// a message that can never fit doesn't evict anything
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		return nil, false
+	}
+
+	t.retainedMu.Lock()
+	defer t.retainedMu.Unlock()
+
+	message.node.mu.RLock()
+	previous := message.node.retained
+	message.node.mu.RUnlock()
+
+	// the previous message of the topic is replaced, so it doesn't count against the limits
+	count, bytes := int(t.retained), int(t.retainedBytes)
+	if previous != nil && !previous.system {
+		count--
+		bytes -= previous.Size()
+	}
+	fits := func() bool {
+		return (limits.MaxMessages <= 0 || count < limits.MaxMessages) &&
+			(limits.MaxBytes <= 0 || bytes+size <= limits.MaxBytes)
+	}
+
+	if !fits() && limits.DropPolicy == DropNewest {
+		return nil, false
+	}
+
+	if previous != nil {
+		t.removeRetained(previous)
+	}
+
+	var evicted []*RetainedMessage
+	for !fits() {
+		oldest := t.retainedOrder.Front().Value.(*RetainedMessage)
+		t.removeRetained(oldest)
+		evicted = append(evicted, oldest)
+		count, bytes = int(t.retained), int(t.retainedBytes)
+	}
+
+	message.node.mu.Lock()
+	message.node.retained = message
+	message.node.mu.Unlock()
+
+	message.element = t.retainedOrder.PushBack(message)
+	atomic.AddInt64(&t.retained, 1)
+	t.retainedBytes += int64(size)
+	return evicted, true
+}
+
+// retainSystem keeps the packet as the retained message of its topic without counting it against
+// the limits or the retained messages of clients, so broker messages and client messages never evict each other
+func (t *TopicTree) retainSystem(packet *packets.Packet) {
+	message := &RetainedMessage{
+		Packet: packet,
+		Stored: time.Now(),
+		node:   t.getTopicNode(splitTopic(packet.PublishTopic), t.root),
+		system: true,
+	}
+
+	t.retainedMu.Lock()
+	defer t.retainedMu.Unlock()
+
+	message.node.mu.Lock()
+	previous := message.node.retained
+	message.node.retained = message
+	message.node.mu.Unlock()
+
+	if previous != nil && !previous.system {
+		t.removeRetained(previous)
+	}
+}
+
+// removeRetained removes the message from its node, called while holding retainedMu.
+// Returns false if the message was already removed.
+func (t *TopicTree) removeRetained(message *RetainedMessage) bool {
+	if message.system {
+		message.node.mu.Lock()
+		defer message.node.mu.Unlock()
+		if message.node.retained != message {
+			return false
+		}
+		message.node.retained = nil
+		return true
+	}
+	if message.element == nil {
+		return false
+	}
+
+	message.node.mu.Lock()
+	if message.node.retained == message {
+		message.node.retained = nil
+	}
+	message.node.mu.Unlock()
+
+	t.retainedOrder.Remove(message.element)
+	message.element = nil
+	atomic.AddInt64(&t.retained, -1)
+	t.retainedBytes -= int64(message.Size())
+	return true
+}
+
+// ClearRetained removes the retained message of the topic, returning false if there was none
+func (t *TopicTree) ClearRetained(topic string) bool {
+	node, ok := t.findNode(splitTopic(topic))
+	if !ok {
+		return false
+	}
+
+	t.retainedMu.Lock()
+	defer t.retainedMu.Unlock()
+
+	node.mu.RLock()
+	message := node.retained
+	node.mu.RUnlock()
+
+	return message != nil && t.removeRetained(message)
+}
+
+// GetRetained returns the retained message of the topic unless it expired
+func (t *TopicTree) GetRetained(topic string) (*RetainedMessage, bool) {
+	node, ok := t.findNode(splitTopic(topic))
+	if !ok {
+		return nil, false
+	}
+
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+	if node.retained == nil || node.retained.expired(time.Now()) {
+		return nil, false
+	}
+	return node.retained, true
+}
+
+// PurgeRetained removes the retained messages of the topics matching the topic filter and returns them
+func (t *TopicTree) PurgeRetained(filter string) []*RetainedMessage {
+	matching := t.Retained(filter)
+
+	t.retainedMu.Lock()
+	defer t.retainedMu.Unlock()
+
+	purged := make([]*RetainedMessage, 0, len(matching))
+	for _, message := range matching {
+		if t.removeRetained(message) {
+			purged = append(purged, message)
+		}
+	}
+	return purged
+}
+
+// ExpireRetained removes the retained messages that expired before now and returns them
+func (t *TopicTree) ExpireRetained(now time.Time) []*RetainedMessage {
+	t.retainedMu.Lock()
+	defer t.retainedMu.Unlock()
+
+	var expired []*RetainedMessage
+	for e := t.retainedOrder.Front(); e != nil; {
+		message := e.Value.(*RetainedMessage)
+		e = e.Next()
+		if message.expired(now) {
+			t.removeRetained(message)
+			expired = append(expired, message)
+		}
+	}
+	return expired
+}
+
+// RetainedCount returns the number of retained messages of clients
+func (t *TopicTree) RetainedCount() int64 {
+	return atomic.LoadInt64(&t.retained)
+}
+
+// RetainedBytes returns the total size of the retained messages of clients
+func (t *TopicTree) RetainedBytes() int64 {
+	t.retainedMu.Lock()
+	defer t.retainedMu.Unlock()
+	return t.retainedBytes
+}
+
+func (b *Broker) retainLimits() RetainLimits {
+	return RetainLimits{
+		MaxMessages: b.MaxRetainedMessages,
+		MaxBytes:    b.MaxRetainedBytes,
+		DropPolicy:  b.RetainedDropPolicy,
+		TTL:         b.RetainedTTL,
+	}
+}
+
+// retain keeps the message as the retained message of its topic, or clears it if the payload is empty
+func (b *Broker) retain(client *Client, packet *packets.Packet) {
+	evicted, ok := b.Subscriptions.Retain(packet, b.retainLimits())
+	b.Hooks.OnRetain(client, packet)
+
+	if !ok {
+		atomic.AddUint64(&b.Info.RetainedDropped, 1)
+		b.Log.Println("Retained message limit reached, not retaining message on", packet.PublishTopic)
+	}
+	atomic.AddUint64(&b.Info.RetainedDropped, uint64(len(evicted)))
+	b.deleteStoredRetained(evicted)
+
+	if b.Store == nil || !ok {
+		return
+	}
+	if len(packet.Payload) == 0 {
+		b.storeError(b.Store.DeleteRetained(packet.PublishTopic))
+	} else {
+		b.storeError(b.Store.SetRetained(packet.PublishTopic, packet))
+	}
+}
+
+// deleteStoredRetained removes the messages from the store
+func (b *Broker) deleteStoredRetained(messages []*RetainedMessage) {
+	if b.Store == nil {
+		return
+	}
+	for _, message := range messages {
+		b.storeError(b.Store.DeleteRetained(message.Topic()))
+	}
+}
+
+// sendRetained sends a copy of the retained message to a new subscriber
+func (b *Broker) sendRetained(client *Client, retained *RetainedMessage, qos byte) {
+	// a wildcard subscription can be allowed while some of the topics it matches are denied
+	if !b.Hooks.OnACLCheck(client, retained.Topic(), false) {
+		return
+	}
+
+	// needs to be copied because we might need to change the QoS
+	retainedCopy := retained.Packet.Copy()
+	retainedCopy.SetRightQoS(qos)
+	retainedCopy.ProtocolVersion = client.Properties.ProtocolLevel
+	retainedCopy.Properties = retained.Packet.Properties.ForwardCopy()
+	// the copy is a new delivery, the DUP flag of the retransmission that was retained is not kept [MQTT-3.3.1-3]
+	retainedCopy.FixedHeader.Dup = false
+
+	// the message expiry interval is reduced by the time the message waited [MQTT-3.3.2-6]
+	if props := retainedCopy.Properties; props != nil && props.MessageExpiryInterval != nil {
+		remaining := uint32(math.Ceil(time.Until(retained.Expires).Seconds()))
+		props.MessageExpiryInterval = &remaining
+	}
+
+	// QoS 1 and 2 copies get a packet identifier of the session like any other message
+	b.send(client, retainedCopy, nil, nil)
+}
+
+// expireRetained periodically removes expired retained messages until the broker is closed
+func (b *Broker) expireRetained() {
+	ticker := time.NewTicker(retainedSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.deleteStoredRetained(b.Subscriptions.ExpireRetained(now))
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// RetainedMessages lists the retained messages of the topics matching the topic filter, sorted by topic
+func (b *Broker) RetainedMessages(filter string) []*RetainedMessage {
+	retained := b.Subscriptions.Retained(filter)
+	sort.Slice(retained, func(i, j int) bool {
+		return retained[i].Topic() < retained[j].Topic()
+	})
+	return retained
+}
+
+// RetainedMessage returns the retained message of the topic
+func (b *Broker) RetainedMessage(topic string) (*RetainedMessage, bool) {
+	return b.Subscriptions.GetRetained(topic)
+}
+
+// PurgeRetained removes the retained messages of the topics matching the topic filter
+// and returns how many were removed
+func (b *Broker) PurgeRetained(filter string) int {
+	purged := b.Subscriptions.PurgeRetained(filter)
+	b.deleteStoredRetained(purged)
+	return len(purged)
+}
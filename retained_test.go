@@ -0,0 +1,236 @@
+package nixmq
+
+import (
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// subscribeRetained subscribes to the topic filter and returns the sorted topics of the retained messages
+// received before the SUBACK
+func (c *testClient) subscribeRetained(packetID uint16, filter string, opts packets.SubscriptionOptions) []string {
+	c.t.Helper()
+	c.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: packetID,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{filter: opts.QoS},
+			OrderedSubscriptions: []string{filter},
+			Options:              map[string]packets.SubscriptionOptions{filter: opts},
+		},
+	})
+
+	var topics []string
+	for {
+		packet, err := c.read(testTimeout)
+		if err != nil {
+			c.t.Fatalf("Expected SUBACK, but got: %v", err)
+		}
+		switch packet.FixedHeader.MessageType {
+		case packets.SUBACK:
+			slices.Sort(topics)
+			return topics
+		case packets.PUBLISH:
+			if !packet.FixedHeader.Retain {
+				c.t.Errorf("Expected the retain flag on the retained message of %s", packet.PublishTopic)
+			}
+			topics = append(topics, packet.PublishTopic)
+		default:
+			c.t.Fatalf("Expected SUBACK, but got %s", packets.PacketName(packet.FixedHeader.MessageType))
+		}
+	}
+}
+
+func TestRetained_WildcardSubscriptions(t *testing.T) {
+	b, l := newTestBroker(t)
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+	for _, topic := range []string{"a", "a/b", "a/c/d", "b/x"} {
+		publisher.publish(topic, "retained", 1, true)
+	}
+	b.publish(SysPrefix+"version", Version)
+
+	tests := []struct {
+		filter string
+		topics []string
+	}{
+		{"a", []string{"a"}},
+		{"a/+", []string{"a/b"}},
+		{"a/#", []string{"a", "a/b", "a/c/d"}},
+		{"+/+", []string{"a/b", "b/x"}},
+		{"+/c/#", []string{"a/c/d"}},
+		{"#", []string{"a", "a/b", "a/c/d", "b/x"}},
+		{"$SYS/#", []string{SysPrefix + "version"}},
+		{"c/#", nil},
+	}
+	for _, protocolVersion := range []byte{packets.MQTT311, packets.MQTT5} {
+		c := connect(t, l, connectOptions(protocolVersion, "subscriber"))
+		for i, test := range tests {
+			if topics := c.subscribeRetained(uint16(i+1), test.filter, packets.SubscriptionOptions{QoS: 0}); !slices.Equal(topics, test.topics) {
+				t.Errorf("Expected retained messages of %v for %s, but got: %v", test.topics, test.filter, topics)
+			}
+		}
+	}
+}
+
+func TestRetained_RetainHandling(t *testing.T) {
+	_, l := newTestBroker(t)
+	connect(t, l, connectOptions(packets.MQTT5, "publisher")).publish("a/b", "retained", 1, true)
+	c := connect(t, l, connectOptions(packets.MQTT5, "subscriber"))
+
+	// 1 sends the retained messages only for a new subscription, 2 never sends them
+	if topics := c.subscribeRetained(1, "a/#", packets.SubscriptionOptions{RetainHandling: 1}); len(topics) != 1 {
+		t.Errorf("Expected the retained message for a new subscription, but got: %v", topics)
+	}
+	if topics := c.subscribeRetained(2, "a/#", packets.SubscriptionOptions{RetainHandling: 1}); len(topics) != 0 {
+		t.Errorf("Expected no retained message for an existing subscription, but got: %v", topics)
+	}
+	if topics := c.subscribeRetained(3, "a/+", packets.SubscriptionOptions{RetainHandling: 2}); len(topics) != 0 {
+		t.Errorf("Expected no retained message, but got: %v", topics)
+	}
+}
+
+func TestRetained_NoDup(t *testing.T) {
+	_, l := newTestBroker(t)
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+	publish := newPublish("a", "retained", 1, true)
+	publish.FixedHeader.Dup = true
+	publisher.send(publish)
+	publisher.expect(packets.PUBACK)
+
+	c := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	c.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 1,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{"a": 1},
+			OrderedSubscriptions: []string{"a"},
+			Options:              map[string]packets.SubscriptionOptions{"a": {QoS: 1}},
+		},
+	})
+	if retained := c.expectPublish("a", "retained"); retained.FixedHeader.Dup {
+		t.Errorf("Expected the retained message without the DUP flag it was published with")
+	}
+	c.expect(packets.SUBACK)
+}
+
+func TestRetained_Clear(t *testing.T) {
+	_, l := newTestBroker(t)
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+	publisher.publish("a", "retained", 1, true)
+	publisher.publish("a", "", 1, true)
+
+	c := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	if topics := c.subscribeRetained(1, "#", packets.SubscriptionOptions{}); len(topics) != 0 {
+		t.Errorf("Expected the retained message to be cleared, but got: %v", topics)
+	}
+}
+
+func TestRetained_Limits(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		topics []string
+	}{
+		{DropOldest, []string{"a", "c"}},
+		{DropNewest, []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		b, l := newTestBroker(t)
+		b.MaxRetainedMessages = 2
+		b.RetainedDropPolicy = test.policy
+		publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+		for _, topic := range []string{"a", "b", "a", "c"} {
+			publisher.publish(topic, "retained", 1, true)
+		}
+		// the PUBACK is sent before the message is retained
+		eventually(t, func() bool { return atomic.LoadUint64(&b.Info.RetainedDropped) == 1 }, "Expected 1 dropped retained message")
+
+		// replacing the retained message of a topic doesn't count against the limit, but makes it the newest
+		c := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+		if topics := c.subscribeRetained(1, "#", packets.SubscriptionOptions{}); !slices.Equal(topics, test.topics) {
+			t.Errorf("Expected retained messages of %v with policy %d, but got: %v", test.topics, test.policy, topics)
+		}
+	}
+}
+
+func TestRetained_SysNotCounted(t *testing.T) {
+	for _, policy := range []DropPolicy{DropOldest, DropNewest} {
+		b, l := newTestBroker(t)
+		b.MaxRetainedMessages = 1
+		b.RetainedDropPolicy = policy
+		b.publish(SysPrefix+"version", Version)
+		b.publish(SysPrefix+"uptime", "1")
+
+		// $SYS messages neither take the room of client messages nor are evicted by them
+		connect(t, l, connectOptions(packets.MQTT311, "publisher")).publish("a", "retained", 1, true)
+		eventually(t, func() bool { return b.Subscriptions.RetainedCount() == 1 }, "Expected 1 retained message")
+		c := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+		if topics := c.subscribeRetained(1, "#", packets.SubscriptionOptions{}); !slices.Equal(topics, []string{"a"}) {
+			t.Errorf("Expected the retained message of a with policy %d, but got: %v", policy, topics)
+		}
+		if topics := c.subscribeRetained(2, SysPrefix+"#", packets.SubscriptionOptions{}); len(topics) != 2 {
+			t.Errorf("Expected both $SYS messages with policy %d, but got: %v", policy, topics)
+		}
+		if bytes := b.Subscriptions.RetainedBytes(); bytes != int64(len("a")+len("retained")) {
+			t.Errorf("Expected only the client message to be counted, but got %d bytes", bytes)
+		}
+		if dropped := atomic.LoadUint64(&b.Info.RetainedDropped); dropped != 0 {
+			t.Errorf("Expected no dropped retained messages with policy %d, but got %d", policy, dropped)
+		}
+	}
+}
+
+func TestRetained_Expiry(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.RetainedTTL = 50 * time.Millisecond
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+	publisher.publish("ttl", "retained", 1, true)
+
+	// the message expiry interval takes precedence over the TTL
+	expiry := uint32(60)
+	publish := newPublish("interval", "retained", 1, true)
+	publish.Properties = &packets.Properties{MessageExpiryInterval: &expiry}
+	publisher.send(publish)
+	publisher.expect(packets.PUBACK)
+
+	time.Sleep(100 * time.Millisecond)
+	c := connect(t, l, connectOptions(packets.MQTT5, "subscriber"))
+	if topics := c.subscribeRetained(1, "ttl", packets.SubscriptionOptions{}); len(topics) != 0 {
+		t.Errorf("Expected the retained message to expire, but got: %v", topics)
+	}
+
+	c.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 2,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{"interval": 0},
+			OrderedSubscriptions: []string{"interval"},
+			Options:              map[string]packets.SubscriptionOptions{"interval": {}},
+		},
+	})
+	received := c.expectPublish("interval", "retained")
+	if props := received.Properties; props == nil || props.MessageExpiryInterval == nil || *props.MessageExpiryInterval > expiry {
+		t.Errorf("Expected the remaining message expiry interval, but got: %+v", props)
+	}
+	c.expect(packets.SUBACK)
+}
+
+func TestRetained_Purge(t *testing.T) {
+	b, l := newTestBroker(t)
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+	for _, topic := range []string{"a", "a/b", "b"} {
+		publisher.publish(topic, "retained", 1, true)
+	}
+	eventually(t, func() bool { return b.Subscriptions.RetainedCount() == 3 }, "Expected 3 retained messages")
+
+	if purged := b.PurgeRetained("a/#"); purged != 2 {
+		t.Errorf("Expected 2 purged retained messages, but got %d", purged)
+	}
+	c := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	if topics := c.subscribeRetained(1, "#", packets.SubscriptionOptions{}); !slices.Equal(topics, []string{"b"}) {
+		t.Errorf("Expected only the retained message of b, but got: %v", topics)
+	}
+}
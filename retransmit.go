@@ -0,0 +1,151 @@
+package nixmq
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// upper bound of the retransmission interval as it doubles after every retry
+const maxRetryInterval = 5 * time.Minute
+
+// sendInfo records when and in which order an unacknowledged packet was sent and how often it was resent
+type sendInfo struct {
+	seq     uint64
+	at      time.Time
+	retries int
+}
+
+// markSent records that the unacknowledged packet was just sent, called while holding the lock.
+// A PUBREL takes a new place in the order, as PUBRELs are resent in the order the PUBRECs were received [MQTT-4.6.0-3].
+func (s *Session) markSent(packetID uint16) {
+	s.sendSeq++
+	s.sent[packetID] = &sendInfo{seq: s.sendSeq, at: time.Now()}
+}
+
+// pendingInOrder returns the unacknowledged packets in the order they were sent, called while holding the lock.
+// Packets restored from the store have no send order and come first, ordered by packet identifier.
+func (s *Session) pendingInOrder() []*packets.Packet {
+	pending := make([]*packets.Packet, 0, len(s.PendingPackets))
+	for _, packet := range s.PendingPackets {
+		pending = append(pending, packet)
+	}
+
+	seq := func(packet *packets.Packet) uint64 {
+		if info, ok := s.sent[packet.PacketIdentifier]; ok {
+			return info.seq
+		}
+		return 0
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		si, sj := seq(pending[i]), seq(pending[j])
+		if si != sj {
+			return si < sj
+		}
+		return pending[i].PacketIdentifier < pending[j].PacketIdentifier
+	})
+	return pending
+}
+
+// ResendPendingPackets resends the unacknowledged packets in the order they were sent [MQTT-4.6.0-1],
+// with the DUP flag set on PUBLISH packets [MQTT-3.3.1-1]. Returns the number of packets resent.
+func (c *Client) ResendPendingPackets() int {
+	s := c.Session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.pendingInOrder()
+	for _, packet := range pending {
+		s.markSent(packet.PacketIdentifier)
+		c.resend(packet)
+	}
+	return len(pending)
+}
+
+// resend sends the unacknowledged packet again, called while holding the lock,
+// so new messages can't overtake the resent ones
+func (c *Client) resend(packet *packets.Packet) {
+	if packet.FixedHeader.MessageType == packets.PUBLISH {
+		packet.FixedHeader.Dup = true
+	}
+	packet.ProtocolVersion = c.Properties.ProtocolLevel
+	c.Send(packet.Encode())
+}
+
+// retryInterval returns how long a packet resent the number of times waits for its acknowledgement
+func (b *Broker) retryInterval(retries int) time.Duration {
+	interval := b.RetryInterval
+	for ; retries > 0 && interval < maxRetryInterval; retries-- {
+		interval *= 2
+	}
+	return min(interval, maxRetryInterval)
+}
+
+// resendStale resends, in the order they were sent, the unacknowledged packets whose retry interval
+// has passed. Returns the number of packets resent, when the next packet becomes stale, and false
+// if a packet was retried MaxRetries times without being acknowledged.
+func (c *Client) resendStale(now time.Time) (int, time.Time, bool) {
+	b := c.Broker
+	s := c.Session
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resent := 0
+	next := now.Add(b.RetryInterval)
+	for _, packet := range s.pendingInOrder() {
+		info, ok := s.sent[packet.PacketIdentifier]
+		if !ok {
+			s.markSent(packet.PacketIdentifier)
+			info = s.sent[packet.PacketIdentifier]
+		}
+
+		deadline := info.at.Add(b.retryInterval(info.retries))
+		if deadline.After(now) {
+			if deadline.Before(next) {
+				next = deadline
+			}
+			continue
+		}
+
+		if b.MaxRetries > 0 && info.retries >= b.MaxRetries {
+			return resent, next, false
+		}
+		info.retries++
+		info.at = now
+		c.resend(packet)
+		resent++
+
+		if deadline := now.Add(b.retryInterval(info.retries)); deadline.Before(next) {
+			next = deadline
+		}
+	}
+	return resent, next, true
+}
+
+// retransmit resends each unacknowledged packet while the client is connected whenever it stays
+// unacknowledged for the retry interval, which doubles after every retry of the packet. MQTT 5.0 only
+// allows resending when the session resumes [MQTT-4.4.0-1], so it is used for MQTT 3.1 and 3.1.1 clients only.
+func (c *Client) retransmit() {
+	b := c.Broker
+	timer := time.NewTimer(b.RetryInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-c.done:
+			return
+		}
+
+		resent, next, ok := c.resendStale(time.Now())
+		atomic.AddUint64(&b.Info.Retransmissions, uint64(resent))
+		if !ok {
+			b.Log.Println("Disconnecting client not acknowledging messages:", c.Properties.ClientID)
+			c.Close()
+			return
+		}
+		timer.Reset(time.Until(next))
+	}
+}
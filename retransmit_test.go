@@ -0,0 +1,52 @@
+package nixmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+func TestRetransmit_OnlyStalePackets(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.RetryInterval = 200 * time.Millisecond
+	subscriber := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	subscriber.subscribe(1, "a", packets.SubscriptionOptions{QoS: 1})
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+
+	publisher.publish("a", "1", 1, false)
+	first := subscriber.expectPublish("a", "1")
+	time.Sleep(100 * time.Millisecond)
+	publisher.publish("a", "2", 1, false)
+	second := subscriber.expectPublish("a", "2")
+
+	// only the first message is stale when it is resent
+	if resent := subscriber.expectPublish("a", "1"); !resent.FixedHeader.Dup || resent.PacketIdentifier != first.PacketIdentifier {
+		t.Errorf("Expected packet %d to be resent with DUP, but got packet %d with DUP %v", first.PacketIdentifier, resent.PacketIdentifier, resent.FixedHeader.Dup)
+	}
+	subscriber.expectNothing(50 * time.Millisecond)
+	if resent := subscriber.expectPublish("a", "2"); !resent.FixedHeader.Dup || resent.PacketIdentifier != second.PacketIdentifier {
+		t.Errorf("Expected packet %d to be resent with DUP, but got packet %d with DUP %v", second.PacketIdentifier, resent.PacketIdentifier, resent.FixedHeader.Dup)
+	}
+	subscriber.ack(first)
+	subscriber.ack(second)
+	subscriber.expectNothing(500 * time.Millisecond)
+}
+
+func TestRetransmit_MaxRetries(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.RetryInterval = 50 * time.Millisecond
+	b.MaxRetries = 2
+	subscriber := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	subscriber.subscribe(1, "a", packets.SubscriptionOptions{QoS: 1})
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+
+	// a new message acknowledged in time doesn't save the client that never acknowledges the first
+	publisher.publish("a", "1", 1, false)
+	subscriber.expectPublish("a", "1")
+	subscriber.expectPublish("a", "1")
+	publisher.publish("a", "2", 1, false)
+	subscriber.ack(subscriber.expectPublish("a", "2"))
+	subscriber.expectPublish("a", "1")
+	subscriber.expectClosed()
+}
@@ -0,0 +1,235 @@
+package nixmq
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// SharedStrategy selects which member of a shared subscription group receives a message
+type SharedStrategy byte
+
+const (
+	SharedRoundRobin    SharedStrategy = iota // members take turns
+	SharedRandom                              // random member
+	SharedSticky                              // messages from the same publisher go to the same member
+	SharedLeastInflight                       // member with the fewest unacknowledged messages
+)
+
+// sharedGroup holds the members of a shared subscription ($share/<group>/<filter>)
+type sharedGroup struct {
+	mu      sync.RWMutex
+	name    string
+	filter  string
+	members []*Client
+	options map[*Client]packets.SubscriptionOptions
+	next    int // next member for round robin
+}
+
+func newSharedGroup(name string, filter string) *sharedGroup {
+	return &sharedGroup{
+		name:    name,
+		filter:  filter,
+		options: make(map[*Client]packets.SubscriptionOptions),
+	}
+}
+
+func (g *sharedGroup) add(client *Client, opts packets.SubscriptionOptions) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.options[client]; !ok {
+		g.members = append(g.members, client)
+	}
+	g.options[client] = opts
+}
+
+func (g *sharedGroup) remove(client *Client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.options[client]; !ok {
+		return
+	}
+	delete(g.options, client)
+
+	for i, member := range g.members {
+		if member == client {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			// keep round robin pointing at the member that was next
+			if g.next > i {
+				g.next--
+			}
+			break
+		}
+	}
+
+	if g.next >= len(g.members) {
+		g.next = 0
+	}
+}
+
+func (g *sharedGroup) Len() int {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return len(g.members)
+}
+
+// pick selects the member that receives the next message, preferring connected members.
+// exclude is skipped, used when redistributing messages of a member whose session ended.
+func (g *sharedGroup) pick(strategy SharedStrategy, publisherID string, exclude *Client) (*Client, packets.SubscriptionOptions, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	connected := false
+	for _, member := range g.members {
+		if member != exclude && !member.IsClosed() {
+			connected = true
+			break
+		}
+	}
+
+	// if no member is connected, the message is kept in one of the offline sessions
+	eligible := func(member *Client) bool {
+		return member != exclude && (!connected || !member.IsClosed())
+	}
+
+	candidates := make([]*Client, 0, len(g.members))
+	for _, member := range g.members {
+		if eligible(member) {
+			candidates = append(candidates, member)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, packets.SubscriptionOptions{}, false
+	}
+
+	var chosen *Client
+	switch strategy {
+	case SharedRandom:
+		chosen = candidates[rand.Intn(len(candidates))]
+	case SharedSticky:
+		h := fnv.New32a()
+		h.Write([]byte(publisherID))
+		chosen = candidates[h.Sum32()%uint32(len(candidates))]
+	case SharedLeastInflight:
+		chosen = candidates[0]
+		for _, c := range candidates[1:] {
+			if c.Session.Len() < chosen.Session.Len() {
+				chosen = c
+			}
+		}
+	default:
+		for i := range g.members {
+			idx := (g.next + i) % len(g.members)
+			if eligible(g.members[idx]) {
+				chosen = g.members[idx]
+				g.next = (idx + 1) % len(g.members)
+				break
+			}
+		}
+	}
+
+	return chosen, g.options[chosen], true
+}
+
+// addShared adds the client to the shared subscription group of the node, creating the group if needed
+func (n *topicNode) addShared(name string, filter string, client *Client, opts packets.SubscriptionOptions) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	group, ok := n.shared[name]
+	if !ok {
+		group = newSharedGroup(name, filter)
+		n.shared[name] = group
+	}
+	group.add(client, opts)
+}
+
+// removeShared removes the client from the group, node lock must be held by the caller
+func (n *topicNode) removeShared(name string, client *Client) {
+	group, ok := n.shared[name]
+	if !ok {
+		return
+	}
+	group.remove(client)
+	if group.Len() == 0 {
+		delete(n.shared, name)
+	}
+}
+
+// sharedSubscriber is a member of a shared subscription group picked to receive a message
+type sharedSubscriber struct {
+	client *Client
+	opts   packets.SubscriptionOptions
+	group  *sharedGroup
+}
+
+// selectShared picks one member of every matching shared subscription group. A client picked by several groups,
+// or also subscribed without a shared subscription, receives a copy of the message for every subscription [MQTT-4.8.2-5].
+func (s *Subscribers) selectShared(strategy SharedStrategy, publisherID string) {
+	for _, group := range s.groups {
+		if client, opts, ok := group.pick(strategy, publisherID, nil); ok {
+			s.shared = append(s.shared, sharedSubscriber{client: client, opts: opts, group: group})
+		}
+	}
+	s.groups = nil
+}
+
+// sharedMessage is a message a client received through a shared subscription that it didn't acknowledge
+type sharedMessage struct {
+	packet *packets.Packet
+	group  *sharedGroup
+}
+
+// tagShared records that the queued or unacknowledged message was received through the shared subscription group,
+// called while holding the lock
+func (s *Session) tagShared(packet *packets.Packet, group *sharedGroup) {
+	if s.sharedGroups == nil {
+		s.sharedGroups = make(map[*packets.Packet]*sharedGroup)
+	}
+	s.sharedGroups[packet] = group
+}
+
+// takeShared removes the unacknowledged and queued messages received through shared subscriptions from the session
+// and returns them in the order they were sent and queued. Messages of the other subscriptions stay in the session.
+func (s *Session) takeShared() []sharedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sharedGroups) == 0 {
+		return nil
+	}
+
+	var messages []sharedMessage
+	for _, packet := range s.pendingInOrder() {
+		if group, ok := s.sharedGroups[packet]; ok {
+			messages = append(messages, sharedMessage{packet: packet, group: group})
+			delete(s.PendingPackets, packet.PacketIdentifier)
+			delete(s.sent, packet.PacketIdentifier)
+		}
+	}
+
+	queue := s.queue[:0]
+	for _, packet := range s.queue {
+		if group, ok := s.sharedGroups[packet]; ok {
+			messages = append(messages, sharedMessage{packet: packet, group: group})
+		} else {
+			queue = append(queue, packet)
+		}
+	}
+	clear(s.queue[len(queue):])
+	s.queue = queue
+
+	s.sharedGroups = nil
+	return messages
+}
+
+// redistributeShared hands the unacknowledged and queued messages a client received through shared subscriptions
+// to another member of the same group once the session of the client ends
+func (b *Broker) redistributeShared(client *Client) {
+	for _, message := range client.Session.takeShared() {
+		if member, opts, ok := message.group.pick(b.SharedStrategy, "", client); ok {
+			b.deliver(member, newFanout(message.packet), opts, message.group)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package nixmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// joinGroup connects a client subscribed to the shared subscription
+func joinGroup(t *testing.T, l *listeners.MemoryListener, clientID string, filter string, qos byte) *testClient {
+	t.Helper()
+	c := connect(t, l, connectOptions(packets.MQTT5, clientID))
+	c.subscribe(1, filter, packets.SubscriptionOptions{QoS: qos})
+	return c
+}
+
+// received returns the payloads the client receives until no PUBLISH arrives for a while
+func (c *testClient) received() []string {
+	c.t.Helper()
+	var payloads []string
+	for {
+		packet, err := c.read(50 * time.Millisecond)
+		if err != nil {
+			if !isTimeout(err) {
+				c.t.Fatalf("Failed to read: %v", err)
+			}
+			return payloads
+		}
+		if packet.FixedHeader.MessageType == packets.PUBLISH {
+			payloads = append(payloads, string(packet.Payload))
+		}
+	}
+}
+
+func TestSharedSubscriptions_RoundRobin(t *testing.T) {
+	_, l := newTestBroker(t)
+	a := joinGroup(t, l, "a", "$share/g/jobs/#", 0)
+	b := joinGroup(t, l, "b", "$share/g/jobs/#", 0)
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		publisher.publish("jobs/x", payload, 0, false)
+	}
+
+	if got := a.received(); len(got) != 2 || got[0] != "1" || got[1] != "3" {
+		t.Errorf("Expected a to receive 1 and 3, but got: %v", got)
+	}
+	if got := b.received(); len(got) != 2 || got[0] != "2" || got[1] != "4" {
+		t.Errorf("Expected b to receive 2 and 4, but got: %v", got)
+	}
+}
+
+func TestSharedSubscriptions_Random(t *testing.T) {
+	broker, l := newTestBroker(t)
+	broker.SharedStrategy = SharedRandom
+	a := joinGroup(t, l, "a", "$share/g/jobs/#", 0)
+	b := joinGroup(t, l, "b", "$share/g/jobs/#", 0)
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+
+	for i := 0; i < 10; i++ {
+		publisher.publish("jobs/x", "job", 0, false)
+	}
+
+	// every message goes to exactly one member
+	if received := len(a.received()) + len(b.received()); received != 10 {
+		t.Errorf("Expected 10 messages across the group, but got: %d", received)
+	}
+}
+
+func TestSharedSubscriptions_Sticky(t *testing.T) {
+	broker, l := newTestBroker(t)
+	broker.SharedStrategy = SharedSticky
+	a := joinGroup(t, l, "a", "$share/g/jobs/#", 0)
+	b := joinGroup(t, l, "b", "$share/g/jobs/#", 0)
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+
+	for i := 0; i < 5; i++ {
+		publisher.publish("jobs/x", "job", 0, false)
+	}
+
+	// all messages of the publisher go to the same member
+	receivedA, receivedB := len(a.received()), len(b.received())
+	if !(receivedA == 5 && receivedB == 0) && !(receivedA == 0 && receivedB == 5) {
+		t.Errorf("Expected one member to receive all 5 messages, but got %d and %d", receivedA, receivedB)
+	}
+}
+
+func TestSharedSubscriptions_LeastInflight(t *testing.T) {
+	broker, l := newTestBroker(t)
+	broker.SharedStrategy = SharedLeastInflight
+	a := joinGroup(t, l, "a", "$share/g/jobs/#", 1)
+	b := joinGroup(t, l, "b", "$share/g/jobs/#", 1)
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+
+	// a keeps its message unacknowledged, so the next ones go to b
+	publisher.publish("jobs/x", "1", 1, false)
+	a.expectPublish("jobs/x", "1")
+
+	publisher.publish("jobs/x", "2", 1, false)
+	b.ack(b.expectPublish("jobs/x", "2"))
+
+	publisher.publish("jobs/x", "3", 1, false)
+	b.expectPublish("jobs/x", "3")
+	a.expectNothing(50 * time.Millisecond)
+}
+
+func TestSharedSubscriptions_CopyPerSubscription(t *testing.T) {
+	_, l := newTestBroker(t)
+	c := connect(t, l, connectOptions(packets.MQTT5, "c"))
+	c.subscribe(1, "$share/one/jobs/#", packets.SubscriptionOptions{QoS: 1})
+	c.subscribe(2, "$share/two/jobs/#", packets.SubscriptionOptions{QoS: 0})
+	c.subscribe(3, "jobs/#", packets.SubscriptionOptions{QoS: 1})
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+
+	publisher.publish("jobs/x", "job", 1, false)
+
+	// one copy for each subscription, with the QoS of that subscription
+	qos := make(map[byte]int)
+	for i := 0; i < 3; i++ {
+		publish := c.expectPublish("jobs/x", "job")
+		qos[publish.FixedHeader.Qos]++
+		if publish.FixedHeader.Qos > 0 {
+			c.ack(publish)
+		}
+	}
+	if qos[0] != 1 || qos[1] != 2 {
+		t.Errorf("Expected a QoS 0 and two QoS 1 copies, but got: %v", qos)
+	}
+	c.expectNothing(50 * time.Millisecond)
+}
+
+func TestSharedSubscriptions_NoLocalIsProtocolError(t *testing.T) {
+	_, l := newTestBroker(t)
+	c := connect(t, l, connectOptions(packets.MQTT5, "c"))
+
+	c.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 1,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{"$share/g/jobs": 0},
+			OrderedSubscriptions: []string{"$share/g/jobs"},
+			Options:              map[string]packets.SubscriptionOptions{"$share/g/jobs": {NoLocal: true}},
+		},
+	})
+
+	disconnect := c.expect(packets.DISCONNECT)
+	if disconnect.ReasonCode != packets.PROTOCOL_ERROR.Code {
+		t.Errorf("Expected reason code Protocol Error, but got: 0x%02X", disconnect.ReasonCode)
+	}
+}
+
+func TestSharedSubscriptions_Redistribute(t *testing.T) {
+	broker, l := newTestBroker(t)
+	broker.MaxInflight = 1
+	a := connect(t, l, connectOptions(packets.MQTT311, "a"))
+	a.subscribe(1, "$share/g/jobs/#", packets.SubscriptionOptions{QoS: 1})
+	a.subscribe(2, "jobs/mine", packets.SubscriptionOptions{QoS: 1})
+	b := joinGroup(t, l, "b", "$share/g/jobs/#", 1)
+	publisher := connect(t, l, connectOptions(packets.MQTT5, "publisher"))
+
+	// a keeps 1 unacknowledged, so both the shared copy of 3 and the copy of its own subscription are queued
+	publisher.publish("jobs/x", "1", 1, false)
+	a.expectPublish("jobs/x", "1")
+	publisher.publish("jobs/x", "2", 1, false)
+	b.ack(b.expectPublish("jobs/x", "2"))
+	publisher.publish("jobs/mine", "3", 1, false)
+	eventually(t, func() bool { return sessionOf(broker, "a").QueueLen() == 2 }, "Expected 2 messages queued for a")
+
+	// the session of a ends with its connection, only the messages of the shared subscription go to b
+	a.conn.Close()
+	b.ack(b.expectPublish("jobs/x", "1"))
+	b.ack(b.expectPublish("jobs/mine", "3"))
+	b.expectNothing(50 * time.Millisecond)
+}
+
+func sessionOf(b *Broker, clientID string) *Session {
+	client, ok := b.clients.Get(clientID)
+	if !ok {
+		return NewSession()
+	}
+	return client.Session
+}
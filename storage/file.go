@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// ErrClosed is returned by writes to a closed store
+var ErrClosed = errors.New("storage: store is closed")
+
+// ErrCorruptLog is returned by OpenFile for a log line that can't be read
+type ErrCorruptLog struct {
+	Line   int
+	Reason string
+}
+
+func (e *ErrCorruptLog) Error() string {
+	return fmt.Sprintf("storage: corrupt log line %d: %s", e.Line, e.Reason)
+}
+
+// operations recorded in the log
+const (
+	opRetain        = "retain"
+	opUnretain      = "unretain"
+	opSession       = "session"
+	opDeleteSession = "delete_session"
+	opInflight      = "inflight"
+	opAck           = "ack"
+	opQueue         = "queue"
+	opDequeue       = "dequeue"
+)
+
+// record is a line of the log
+type record struct {
+	Op       string   `json:"op"`
+	ClientID string   `json:"client_id,omitempty"`
+	Topic    string   `json:"topic,omitempty"`
+	PacketID uint16   `json:"packet_id,omitempty"`
+	Count    int      `json:"count,omitempty"`
+	Session  *Session `json:"session,omitempty"`
+	Packet   []byte   `json:"packet,omitempty"`
+}
+
+// File is a Store keeping an append-only log of JSON records in a single file.
+// The current state is kept in memory as well, so the log can be compacted into a snapshot
+// of it. The log is compacted when the file is opened and whenever it holds more than
+// CompactAfter records and twice as many records as the snapshot would.
+type File struct {
+	CompactAfter int  // records in the log before it is compacted
+	SyncWrites   bool // fsync every write, otherwise writes only survive a crash of the broker, not of the machine
+
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	w        *bufio.Writer
+	records  int // records in the log
+	snapshot int // records in the log after the last compaction
+	retained map[string][]byte
+	sessions map[string]*fileSession
+}
+
+type fileSession struct {
+	session  *Session // nil for messages of a session that was deleted or not stored yet
+	inflight map[uint16][]byte
+	queue    [][]byte
+}
+
+// OpenFile opens the log at path, creating it if it doesn't exist.
+// A partially written last record, left by a crash, is discarded.
+func OpenFile(path string) (*File, error) {
+	f := &File{
+		CompactAfter: 10000,
+		path:         path,
+		retained:     make(map[string][]byte),
+		sessions:     make(map[string]*fileSession),
+	}
+
+	if err := f.replay(); err != nil {
+		return nil, err
+	}
+
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// replay applies the records of the log to the in-memory state
+func (f *File) replay() error {
+	file, err := os.Open(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// data without a newline is a record that was being written
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return &ErrCorruptLog{line, err.Error()}
+		}
+		if err := f.apply(&rec); err != nil {
+			return &ErrCorruptLog{line, err.Error()}
+		}
+	}
+}
+
+// apply changes the in-memory state by the record
+func (f *File) apply(rec *record) error {
+	switch rec.Op {
+	case opRetain:
+		f.retained[rec.Topic] = rec.Packet
+	case opUnretain:
+		delete(f.retained, rec.Topic)
+	case opSession:
+		if rec.Session == nil {
+			return errors.New("session record without session")
+		}
+		f.session(rec.Session.ClientID).session = rec.Session
+	case opDeleteSession:
+		delete(f.sessions, rec.ClientID)
+	case opInflight:
+		f.session(rec.ClientID).inflight[rec.PacketID] = rec.Packet
+	case opAck:
+		if s, ok := f.sessions[rec.ClientID]; ok {
+			delete(s.inflight, rec.PacketID)
+		}
+	case opQueue:
+		s := f.session(rec.ClientID)
+		s.queue = append(s.queue, rec.Packet)
+	case opDequeue:
+		if s, ok := f.sessions[rec.ClientID]; ok {
+			n := min(rec.Count, len(s.queue))
+			clear(s.queue[:n])
+			s.queue = s.queue[n:]
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+	return nil
+}
+
+// session returns the in-memory session of the client, creating it if needed
+func (f *File) session(clientID string) *fileSession {
+	s, ok := f.sessions[clientID]
+	if !ok {
+		s = &fileSession{inflight: make(map[uint16][]byte)}
+		f.sessions[clientID] = s
+	}
+	return s
+}
+
+// write appends the record to the log and applies it
+func (f *File) write(rec *record) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return ErrClosed
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if _, err := f.w.Write(data); err != nil {
+		return err
+	}
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	if f.SyncWrites {
+		if err := f.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	f.records++
+	if err := f.apply(rec); err != nil {
+		return err
+	}
+
+	if f.records > max(f.CompactAfter, 2*f.snapshot) {
+		return f.compact()
+	}
+	return nil
+}
+
+// snapshotRecords returns the records recreating the current state, sessions without
+// a stored session record are left out
+func (f *File) snapshotRecords() []*record {
+	var records []*record
+
+	topics := make([]string, 0, len(f.retained))
+	for topic := range f.retained {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		records = append(records, &record{Op: opRetain, Topic: topic, Packet: f.retained[topic]})
+	}
+
+	clientIDs := make([]string, 0, len(f.sessions))
+	for clientID, s := range f.sessions {
+		if s.session != nil {
+			clientIDs = append(clientIDs, clientID)
+		}
+	}
+	sort.Strings(clientIDs)
+	for _, clientID := range clientIDs {
+		s := f.sessions[clientID]
+		records = append(records, &record{Op: opSession, Session: s.session})
+
+		ids := make([]int, 0, len(s.inflight))
+		for id := range s.inflight {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			records = append(records, &record{Op: opInflight, ClientID: clientID, PacketID: uint16(id), Packet: s.inflight[uint16(id)]})
+		}
+
+		for _, packet := range s.queue {
+			records = append(records, &record{Op: opQueue, ClientID: clientID, Packet: packet})
+		}
+	}
+
+	return records
+}
+
+// compact replaces the log with a snapshot of the current state. The snapshot is written
+// to a temporary file first, so the log is never left half written, and the current log
+// stays in use until the snapshot has replaced it.
+// Every record of the current log is flushed, as write flushes after each record.
+func (f *File) compact() error {
+	records := f.snapshotRecords()
+
+	tmpPath := f.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	discard := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return discard(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return discard(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return discard(err)
+	}
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		return discard(err)
+	}
+	syncDir(filepath.Dir(f.path))
+
+	// the snapshot is the log now, records are appended to it through the same file
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = tmp
+	f.w = w
+	f.records = len(records)
+	f.snapshot = len(records)
+	return nil
+}
+
+// syncDir makes a rename in the directory durable, where the platform supports it
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// Compact replaces the log with a snapshot of the current state
+func (f *File) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return ErrClosed
+	}
+	return f.compact()
+}
+
+func (f *File) SetRetained(topic string, packet *packets.Packet) error {
+	return f.write(&record{Op: opRetain, Topic: topic, Packet: EncodePacket(packet)})
+}
+
+func (f *File) DeleteRetained(topic string) error {
+	return f.write(&record{Op: opUnretain, Topic: topic})
+}
+
+func (f *File) SetSession(session *Session) error {
+	return f.write(&record{Op: opSession, Session: session})
+}
+
+func (f *File) DeleteSession(clientID string) error {
+	return f.write(&record{Op: opDeleteSession, ClientID: clientID})
+}
+
+func (f *File) SetInflight(clientID string, packet *packets.Packet) error {
+	return f.write(&record{Op: opInflight, ClientID: clientID, PacketID: packet.PacketIdentifier, Packet: EncodePacket(packet)})
+}
+
+func (f *File) DeleteInflight(clientID string, packetID uint16) error {
+	return f.write(&record{Op: opAck, ClientID: clientID, PacketID: packetID})
+}
+
+func (f *File) AppendQueued(clientID string, packet *packets.Packet) error {
+	return f.write(&record{Op: opQueue, ClientID: clientID, Packet: EncodePacket(packet)})
+}
+
+func (f *File) DropQueued(clientID string, n int) error {
+	return f.write(&record{Op: opDequeue, ClientID: clientID, Count: n})
+}
+
+// Load decodes the stored state
+func (f *File) Load() (*State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := &State{
+		Retained: make(map[string]*packets.Packet, len(f.retained)),
+		Sessions: make(map[string]*SessionState),
+	}
+
+	for topic, data := range f.retained {
+		packet, err := DecodePacket(data)
+		if err != nil {
+			return nil, fmt.Errorf("retained message of %s: %w", topic, err)
+		}
+		state.Retained[topic] = packet
+	}
+
+	for clientID, s := range f.sessions {
+		if s.session == nil {
+			continue
+		}
+
+		session := &SessionState{
+			Session:  *s.session,
+			Inflight: make(map[uint16]*packets.Packet, len(s.inflight)),
+			Queue:    make([]*packets.Packet, 0, len(s.queue)),
+		}
+		for id, data := range s.inflight {
+			packet, err := DecodePacket(data)
+			if err != nil {
+				return nil, fmt.Errorf("inflight packet %d of %s: %w", id, clientID, err)
+			}
+			session.Inflight[id] = packet
+		}
+		for _, data := range s.queue {
+			packet, err := DecodePacket(data)
+			if err != nil {
+				return nil, fmt.Errorf("queued message of %s: %w", clientID, err)
+			}
+			session.Queue = append(session.Queue, packet)
+		}
+		state.Sessions[clientID] = session
+	}
+
+	return state, nil
+}
+
+// Close flushes the log and closes the file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return ErrClosed
+	}
+
+	err := f.w.Flush()
+	if syncErr := f.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	return err
+}
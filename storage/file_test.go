@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+func testPublish(topic string, qos byte, id uint16, payload string) *packets.Packet {
+	return &packets.Packet{
+		FixedHeader: &packets.FixedHeader{
+			MessageType: packets.PUBLISH,
+			Qos:         qos,
+		},
+		PublishTopic:     topic,
+		PacketIdentifier: id,
+		Payload:          []byte(payload),
+		ProtocolVersion:  packets.MQTT311,
+	}
+}
+
+func openTestFile(t *testing.T) (*File, string) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	return f, path
+}
+
+func reopen(t *testing.T, f *File, path string) *File {
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	f, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	return f
+}
+
+func TestEncodePacket_RoundTrip(t *testing.T) {
+	expiry := uint32(60)
+	publish := testPublish("a/b", 1, 7, "hello")
+	publish.Properties = &packets.Properties{MessageExpiryInterval: &expiry}
+
+	decoded, err := DecodePacket(EncodePacket(publish))
+	if err != nil {
+		t.Fatalf("DecodePacket failed: %v", err)
+	}
+
+	if decoded.PublishTopic != "a/b" || decoded.PacketIdentifier != 7 || !bytes.Equal(decoded.Payload, []byte("hello")) {
+		t.Errorf("Unexpected decoded packet: %+v", decoded)
+	}
+	if decoded.Properties == nil || decoded.Properties.MessageExpiryInterval == nil || *decoded.Properties.MessageExpiryInterval != 60 {
+		t.Errorf("Expected properties to be kept")
+	}
+	if publish.ProtocolVersion != packets.MQTT311 {
+		t.Errorf("Expected EncodePacket not to modify the packet")
+	}
+
+	if _, err := DecodePacket(packets.EncodePingresp()); err == nil {
+		t.Errorf("Expected an error for a PINGRESP")
+	}
+}
+
+func TestFile_Restore(t *testing.T) {
+	f, path := openTestFile(t)
+
+	session := &Session{
+		ClientID:              "client",
+		Username:              "user",
+		ProtocolLevel:         packets.MQTT5,
+		SessionExpiryInterval: 3600,
+		Subscriptions: map[string]packets.SubscriptionOptions{
+			"a/#": {QoS: 1, NoLocal: true},
+		},
+	}
+
+	writes := []error{
+		f.SetRetained("a/b", testPublish("a/b", 0, 0, "retained")),
+		f.SetRetained("a/c", testPublish("a/c", 0, 0, "cleared")),
+		f.DeleteRetained("a/c"),
+		f.SetSession(session),
+		f.SetInflight("client", testPublish("a/b", 1, 1, "one")),
+		f.SetInflight("client", testPublish("a/b", 2, 2, "two")),
+		f.DeleteInflight("client", 1),
+		f.AppendQueued("client", testPublish("a/b", 1, 0, "q1")),
+		f.AppendQueued("client", testPublish("a/b", 1, 0, "q2")),
+		f.AppendQueued("client", testPublish("a/b", 1, 0, "q3")),
+		f.DropQueued("client", 1),
+	}
+	for i, err := range writes {
+		if err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+
+	f = reopen(t, f, path)
+	defer f.Close()
+
+	state, err := f.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if len(state.Retained) != 1 || string(state.Retained["a/b"].Payload) != "retained" {
+		t.Errorf("Unexpected retained messages: %v", state.Retained)
+	}
+
+	stored, ok := state.Sessions["client"]
+	if !ok {
+		t.Fatalf("Expected session to be restored")
+	}
+	if !reflect.DeepEqual(stored.Session, *session) {
+		t.Errorf("Expected session %+v, got %+v", *session, stored.Session)
+	}
+
+	if len(stored.Inflight) != 1 || string(stored.Inflight[2].Payload) != "two" {
+		t.Errorf("Unexpected inflight packets: %v", stored.Inflight)
+	}
+
+	if len(stored.Queue) != 2 || string(stored.Queue[0].Payload) != "q2" || string(stored.Queue[1].Payload) != "q3" {
+		t.Errorf("Unexpected queue: %v", stored.Queue)
+	}
+}
+
+func TestFile_DeleteSession(t *testing.T) {
+	f, path := openTestFile(t)
+
+	f.SetSession(&Session{ClientID: "client", SessionExpiryInterval: 60})
+	f.SetInflight("client", testPublish("a", 1, 1, "one"))
+	f.AppendQueued("client", testPublish("a", 1, 0, "q"))
+	f.DeleteSession("client")
+
+	// messages written without a session are not restored
+	f.AppendQueued("orphan", testPublish("a", 1, 0, "q"))
+
+	f = reopen(t, f, path)
+	defer f.Close()
+
+	state, err := f.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(state.Sessions) != 0 {
+		t.Errorf("Expected no sessions, got %v", state.Sessions)
+	}
+}
+
+func TestFile_Compact(t *testing.T) {
+	f, path := openTestFile(t)
+	f.CompactAfter = 10
+
+	for i := 0; i < 100; i++ {
+		if err := f.SetRetained("a", testPublish("a", 0, 0, "payload")); err != nil {
+			t.Fatalf("SetRetained failed: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > 10 {
+		t.Errorf("Expected log to be compacted, it has %d lines", lines)
+	}
+
+	f = reopen(t, f, path)
+	defer f.Close()
+
+	state, err := f.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(state.Retained) != 1 {
+		t.Errorf("Expected 1 retained message, got %d", len(state.Retained))
+	}
+}
+
+func TestOpenFile_TornRecord(t *testing.T) {
+	f, path := openTestFile(t)
+	f.SetRetained("a", testPublish("a", 0, 0, "kept"))
+	f.Close()
+
+	// a crash while writing leaves a record without its newline
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	file.WriteString(`{"op":"retain","topic":"b","pa`)
+	file.Close()
+
+	f, err = OpenFile(path)
+	if err != nil {
+		t.Fatalf("Expected torn record to be discarded, got %v", err)
+	}
+	defer f.Close()
+
+	state, err := f.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(state.Retained) != 1 || string(state.Retained["a"].Payload) != "kept" {
+		t.Errorf("Unexpected retained messages: %v", state.Retained)
+	}
+}
+
+func TestOpenFile_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	os.WriteFile(path, []byte("{\"op\":\"retain\",\"topic\":\"a\"}\nnot json\n"), 0600)
+
+	_, err := OpenFile(path)
+	var corrupt *ErrCorruptLog
+	if !errors.As(err, &corrupt) || corrupt.Line != 2 {
+		t.Errorf("Expected ErrCorruptLog on line 2, got %v", err)
+	}
+}
+
+func TestFile_Closed(t *testing.T) {
+	f, _ := openTestFile(t)
+	f.Close()
+
+	if err := f.SetRetained("a", testPublish("a", 0, 0, "")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestFile_CompactFailure(t *testing.T) {
+	f, path := openTestFile(t)
+	defer f.Close()
+	f.SetRetained("a", testPublish("a", 0, 0, "kept"))
+
+	// the snapshot can't replace the log when a directory took its place
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(path, "occupied"), 0700); err != nil {
+		t.Fatalf("MkdirAll failed: %v", err)
+	}
+	if err := f.Compact(); err == nil {
+		t.Fatalf("Expected Compact to fail")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the snapshot to be removed, got %v", err)
+	}
+
+	// the current log stays in use
+	if err := f.SetRetained("b", testPublish("b", 0, 0, "")); err != nil {
+		t.Errorf("Expected the store to stay open, got %v", err)
+	}
+}
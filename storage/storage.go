@@ -0,0 +1,93 @@
+// Package storage persists the broker state that has to survive a restart:
+// retained messages and persistent sessions with their subscriptions,
+// unacknowledged (inflight) messages and queued messages.
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// Store is implemented by durable storage backends. Writes are applied in the order they are made,
+// so a write for a session made after DeleteSession belongs to a new session.
+type Store interface {
+	// SetRetained stores the retained message of the topic, replacing the previous one
+	SetRetained(topic string, packet *packets.Packet) error
+	DeleteRetained(topic string) error
+
+	// SetSession stores the session of a client, replacing its previous subscriptions
+	SetSession(session *Session) error
+	// DeleteSession removes the session with its inflight and queued messages
+	DeleteSession(clientID string) error
+
+	// SetInflight stores an unacknowledged packet, replacing the packet with the same identifier
+	SetInflight(clientID string, packet *packets.Packet) error
+	DeleteInflight(clientID string, packetID uint16) error
+
+	// AppendQueued adds a message to the end of the offline queue of the session
+	AppendQueued(clientID string, packet *packets.Packet) error
+	// DropQueued removes the n oldest messages from the offline queue of the session
+	DropQueued(clientID string, n int) error
+
+	// Load returns everything stored
+	Load() (*State, error)
+	Close() error
+}
+
+// Session holds what is needed to restore a persistent session
+type Session struct {
+	ClientID              string                                 `json:"client_id"`
+	Username              string                                 `json:"username,omitempty"`
+	ProtocolLevel         byte                                   `json:"protocol_level"`
+	SessionExpiryInterval uint32                                 `json:"session_expiry_interval"`
+	Subscriptions         map[string]packets.SubscriptionOptions `json:"subscriptions,omitempty"`
+}
+
+// SessionState is a stored session with its messages
+type SessionState struct {
+	Session
+	Inflight map[uint16]*packets.Packet // unacknowledged packets by packet identifier
+	Queue    []*packets.Packet          // queued messages, oldest first
+}
+
+// State is the broker state returned by Load
+type State struct {
+	Retained map[string]*packets.Packet // retained messages by topic
+	Sessions map[string]*SessionState   // sessions by client ID
+}
+
+// EncodePacket serializes a PUBLISH, PUBREC or PUBREL packet. Packets are stored in their
+// MQTT 5.0 encoding, so the properties are kept whatever the protocol level of the client.
+func EncodePacket(packet *packets.Packet) []byte {
+	p := packet.Copy()
+	p.ProtocolVersion = packets.MQTT5
+	// queued messages get their packet identifier when they are sent, but a valid PUBLISH needs one
+	if p.FixedHeader.MessageType == packets.PUBLISH && p.FixedHeader.Qos > 0 && p.PacketIdentifier == 0 {
+		p.PacketIdentifier = unassignedPacketID
+	}
+	return p.Encode()
+}
+
+// packet identifier of stored messages that were not sent yet
+const unassignedPacketID = 0xFFFF
+
+// DecodePacket parses a packet serialized by EncodePacket
+func DecodePacket(data []byte) (*packets.Packet, error) {
+	// the whole packet fits the buffer, as ParsePacket reads the remaining length in one call
+	reader := bufio.NewReaderSize(bytes.NewReader(data), len(data)+16)
+	fh, err := packets.DecodeFixedHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch fh.MessageType {
+	case packets.PUBLISH, packets.PUBACK, packets.PUBREC, packets.PUBREL, packets.PUBCOMP:
+	default:
+		return nil, fmt.Errorf("unexpected stored packet type %d", fh.MessageType)
+	}
+
+	return packets.ParsePacket(fh, reader, packets.MQTT5)
+}
@@ -0,0 +1,146 @@
+package nixmq
+
+import (
+	"sync/atomic"
+
+	"github.com/lawnp/leafMQ/packets"
+	"github.com/lawnp/leafMQ/storage"
+)
+
+// persistent sessions outlive the connection, so they are written to the store
+func (c *Client) persistent() bool {
+	return c.Properties.SessionExpiryInterval != 0
+}
+
+// storeError logs failed writes, the broker keeps running on its in-memory state
+func (b *Broker) storeError(err error) {
+	if err != nil {
+		b.Log.Println("Storage error:", err)
+	}
+}
+
+// storeSession writes the session and its subscriptions to the store if it is persistent
+func (b *Broker) storeSession(client *Client) {
+	if b.Store == nil || !client.persistent() {
+		return
+	}
+
+	b.storeError(b.Store.SetSession(&storage.Session{
+		ClientID:              client.Properties.ClientID,
+		Username:              client.Properties.Username,
+		ProtocolLevel:         client.Properties.ProtocolLevel,
+		SessionExpiryInterval: client.Properties.SessionExpiryInterval,
+		Subscriptions:         client.Session.Subscriptions.copy(),
+	}))
+}
+
+// deleteStoredSession removes the session of the client from the store
+func (b *Broker) deleteStoredSession(client *Client) {
+	if b.Store != nil {
+		b.storeError(b.Store.DeleteSession(client.Properties.ClientID))
+	}
+}
+
+// storeInflight writes an unacknowledged packet, called while holding the session lock
+// so the store sees the changes of a packet identifier in order
+func (b *Broker) storeInflight(client *Client, packet *packets.Packet) {
+	if b.Store != nil && client.persistent() {
+		b.storeError(b.Store.SetInflight(client.Properties.ClientID, packet))
+	}
+}
+
+// storeAck removes an acknowledged packet, called while holding the session lock
+func (b *Broker) storeAck(client *Client, packetID uint16) {
+	if b.Store != nil && client.persistent() {
+		b.storeError(b.Store.DeleteInflight(client.Properties.ClientID, packetID))
+	}
+}
+
+// storeQueued appends a queued message, called while holding the session lock
+func (b *Broker) storeQueued(client *Client, packet *packets.Packet) {
+	if b.Store != nil && client.persistent() {
+		b.storeError(b.Store.AppendQueued(client.Properties.ClientID, packet))
+	}
+}
+
+// storeDequeued removes the n oldest queued messages, called while holding the session lock
+func (b *Broker) storeDequeued(client *Client, n int) {
+	if b.Store != nil && client.persistent() && n > 0 {
+		b.storeError(b.Store.DropQueued(client.Properties.ClientID, n))
+	}
+}
+
+// restore loads the retained messages and the sessions of disconnected clients from the store.
+// The expiry of restored retained messages and sessions starts over.
+func (b *Broker) restore() error {
+	state, err := b.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, packet := range state.Retained {
+		evicted, ok := b.Subscriptions.Retain(packet, b.retainLimits())
+		if !ok {
+			b.storeError(b.Store.DeleteRetained(packet.PublishTopic))
+		}
+		b.deleteStoredRetained(evicted)
+	}
+
+	for _, stored := range state.Sessions {
+		client := b.offlineClient(stored)
+		b.clients.restore(client)
+
+		for topic, opts := range stored.Subscriptions {
+			b.Subscriptions.Add(topic, opts, client)
+		}
+		client.expireSession()
+	}
+
+	b.Log.Println("Restored", len(state.Retained), "retained messages and", len(state.Sessions), "sessions")
+	return nil
+}
+
+// offlineClient recreates the client of a stored session without a connection
+func (b *Broker) offlineClient(stored *storage.SessionState) *Client {
+	client := &Client{
+		Properties: &Properties{
+			ProtocolLevel:         stored.ProtocolLevel,
+			ClientID:              stored.ClientID,
+			Username:              stored.Username,
+			SessionExpiryInterval: stored.SessionExpiryInterval,
+		},
+		Broker:  b,
+		Session: NewSession(),
+		out:     newOutbound(),
+	}
+	client.isClosed.Store(true)
+	client.closeOnce.Do(func() {}) // there is no connection to close
+
+	for topic, opts := range stored.Subscriptions {
+		client.Session.Subscriptions.add(topic, opts)
+	}
+	for id, packet := range stored.Inflight {
+		// QoS 2 messages received from the client are not restored
+		if t := packet.FixedHeader.MessageType; t != packets.PUBLISH && t != packets.PUBREL {
+			continue
+		}
+		packet.ProtocolVersion = stored.ProtocolLevel
+		client.Session.PendingPackets[id] = packet
+	}
+	for _, packet := range stored.Queue {
+		packet.ProtocolVersion = stored.ProtocolLevel
+		client.Session.queue = append(client.Session.queue, packet)
+	}
+
+	return client
+}
+
+// restore adds the client of a restored session as disconnected
+func (c *Clients) restore(client *Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.internal[client.Properties.ClientID] = client
+
+	atomic.AddUint32(&client.Broker.Info.ClientDisconnected, 1)
+	atomic.AddUint32(&client.Broker.Info.Clients, 1)
+}
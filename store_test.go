@@ -0,0 +1,75 @@
+package nixmq
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+	"github.com/lawnp/leafMQ/storage"
+)
+
+// newStoredBroker returns a test broker keeping its state in the log at path, restored from it
+func newStoredBroker(t *testing.T, path string) (*Broker, *listeners.MemoryListener) {
+	t.Helper()
+	store, err := storage.OpenFile(path)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	b, l := newTestBroker(t)
+	b.Store = store
+	if err := b.restore(); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	return b, l
+}
+
+func TestBroker_RestoreFromStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.log")
+	b, l := newStoredBroker(t, path)
+
+	options := connectOptions(packets.MQTT311, "persistent")
+	options.CleanSession = false
+	c := connect(t, l, options)
+	c.subscribe(1, "a/#", packets.SubscriptionOptions{QoS: 1})
+	c.conn.Close()
+	eventually(t, func() bool {
+		client, ok := b.clients.Get("persistent")
+		return ok && client.isClosed.Load()
+	}, "Expected the client to be disconnected")
+
+	publisher := connect(t, l, connectOptions(packets.MQTT311, "publisher"))
+	publisher.publish("a/retained", "r", 1, true)
+	publisher.publish("a/queued", "q", 1, false)
+	// the PUBACK is sent before the messages are queued
+	eventually(t, func() bool {
+		client, _ := b.clients.Get("persistent")
+		return client.Session.QueueLen() == 2
+	}, "Expected the messages to be queued")
+	b.Close()
+
+	// the session with its subscription and queued messages and the retained message survive the restart
+	b, l = newStoredBroker(t, path)
+	c = dial(t, l, packets.MQTT311)
+	if connack := c.connect(options); connack.ReasonCode != packets.ACCEPTED.Code || !connack.SessionPresent {
+		t.Fatalf("Expected the restored session to be present, but got: 0x%02X", connack.ReasonCode)
+	}
+	retained := c.expectPublish("a/retained", "r")
+	queued := c.expectPublish("a/queued", "q")
+	c.ack(retained)
+	c.ack(queued)
+
+	// retained messages are sent before the SUBACK
+	subscriber := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	subscriber.send(&packets.Packet{
+		FixedHeader:      &packets.FixedHeader{MessageType: packets.SUBSCRIBE, Qos: 1},
+		PacketIdentifier: 1,
+		Subscriptions: &packets.Subscriptions{
+			Subscriptions:        map[string]byte{"a/+": 0},
+			OrderedSubscriptions: []string{"a/+"},
+			Options:              map[string]packets.SubscriptionOptions{"a/+": {QoS: 0}},
+		},
+	})
+	subscriber.expectPublish("a/retained", "r")
+	subscriber.expect(packets.SUBACK)
+}
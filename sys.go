@@ -0,0 +1,123 @@
+package nixmq
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+const SysPrefix = "$SYS/broker/"
+
+// loadAverage is an exponentially weighted moving average of a per minute rate
+// over 1, 5 and 15 minutes, calculated the same way as unix load averages.
+type loadAverage struct {
+	last    uint64 // counter value at the previous update
+	one     float64
+	five    float64
+	fifteen float64
+}
+
+func (l *loadAverage) update(counter uint64, interval time.Duration) {
+	rate := float64(counter-l.last) / interval.Minutes()
+	l.last = counter
+
+	l.one = ewma(l.one, rate, interval, time.Minute)
+	l.five = ewma(l.five, rate, interval, 5*time.Minute)
+	l.fifteen = ewma(l.fifteen, rate, interval, 15*time.Minute)
+}
+
+func ewma(average float64, rate float64, interval time.Duration, period time.Duration) float64 {
+	factor := math.Exp(-interval.Seconds() / period.Seconds())
+	return rate + factor*(average-rate)
+}
+
+// sysLoad holds the load averages published under $SYS/broker/load
+type sysLoad struct {
+	messagesReceived loadAverage
+	messagesSent     loadAverage
+	bytesReceived    loadAverage
+	bytesSent        loadAverage
+	connections      loadAverage
+}
+
+// publishSys periodically publishes broker statistics to the $SYS topic tree until the broker is closed
+func (b *Broker) publishSys() {
+	ticker := time.NewTicker(b.SysInterval)
+	defer ticker.Stop()
+
+	load := new(sysLoad)
+	b.publish(SysPrefix+"version", Version)
+
+	for {
+		select {
+		case <-ticker.C:
+			load.update(b.Info, b.SysInterval)
+			b.publishSysTopics(load)
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (l *sysLoad) update(info *Info, interval time.Duration) {
+	l.messagesReceived.update(atomic.LoadUint64(&info.PacketsReceived), interval)
+	l.messagesSent.update(atomic.LoadUint64(&info.PacketsSent), interval)
+	l.bytesReceived.update(atomic.LoadUint64(&info.BytesReceived), interval)
+	l.bytesSent.update(atomic.LoadUint64(&info.BytesSent), interval)
+	l.connections.update(atomic.LoadUint64(&info.Connections), interval)
+}
+
+func (b *Broker) publishSysTopics(load *sysLoad) {
+	info := b.Info
+	uptime := int64(time.Since(info.Started).Seconds())
+
+	b.publish(SysPrefix+"uptime", strconv.FormatInt(uptime, 10)+" seconds")
+	b.publish(SysPrefix+"clients/connected", formatUint(uint64(atomic.LoadUint32(&info.ClientConnected))))
+	b.publish(SysPrefix+"clients/disconnected", formatUint(uint64(atomic.LoadUint32(&info.ClientDisconnected))))
+	b.publish(SysPrefix+"clients/total", formatUint(uint64(atomic.LoadUint32(&info.Clients))))
+	b.publish(SysPrefix+"messages/received", formatUint(atomic.LoadUint64(&info.PacketsReceived)))
+	b.publish(SysPrefix+"messages/sent", formatUint(atomic.LoadUint64(&info.PacketsSent)))
+	b.publish(SysPrefix+"bytes/received", formatUint(atomic.LoadUint64(&info.BytesReceived)))
+	b.publish(SysPrefix+"bytes/sent", formatUint(atomic.LoadUint64(&info.BytesSent)))
+	b.publish(SysPrefix+"subscriptions/count", formatUint(uint64(atomic.LoadUint32(&info.Subscriptions))))
+	b.publish(SysPrefix+"retained messages/count", strconv.FormatInt(b.Subscriptions.RetainedCount(), 10))
+
+	b.publishLoad("messages/received", &load.messagesReceived)
+	b.publishLoad("messages/sent", &load.messagesSent)
+	b.publishLoad("bytes/received", &load.bytesReceived)
+	b.publishLoad("bytes/sent", &load.bytesSent)
+	b.publishLoad("connections", &load.connections)
+}
+
+func (b *Broker) publishLoad(name string, l *loadAverage) {
+	b.publish(SysPrefix+"load/"+name+"/1min", formatFloat(l.one))
+	b.publish(SysPrefix+"load/"+name+"/5min", formatFloat(l.five))
+	b.publish(SysPrefix+"load/"+name+"/15min", formatFloat(l.fifteen))
+}
+
+// publish sends a retained QoS 0 message originating from the broker itself.
+// It isn't counted with the retained messages of clients, so statistics never evict them or count against the limits.
+func (b *Broker) publish(topic string, payload string) {
+	packet := &packets.Packet{
+		FixedHeader: &packets.FixedHeader{
+			MessageType: packets.PUBLISH,
+			Retain:      true,
+		},
+		PublishTopic: topic,
+		Payload:      []byte(payload),
+	}
+
+	b.Subscriptions.retainSystem(packet)
+	b.SendSubscribers(packet, nil)
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
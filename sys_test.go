@@ -0,0 +1,28 @@
+package nixmq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+func TestSys_ClientsConnected(t *testing.T) {
+	b, l := newTestBroker(t)
+	b.ConnectTimeout = 50 * time.Millisecond
+	b.MaxConnections = 2
+
+	subscriber := connect(t, l, connectOptions(packets.MQTT311, "subscriber"))
+	subscriber.subscribe(1, SysPrefix+"clients/+", packets.SubscriptionOptions{QoS: 0})
+
+	// neither a timed out nor a refused connection is a connected client
+	dial(t, l, packets.MQTT311).expectClosed()
+	connect(t, l, connectOptions(packets.MQTT311, "client"))
+	refusedConnection(t, l, packets.MQTT311)
+	expectClientCounts(t, b, 2, 0)
+
+	b.publishSysTopics(new(sysLoad))
+	subscriber.expectPublish(SysPrefix+"clients/connected", "2")
+	subscriber.expectPublish(SysPrefix+"clients/disconnected", "0")
+	subscriber.expectPublish(SysPrefix+"clients/total", "2")
+}
@@ -1,35 +1,60 @@
 package nixmq
 
 import (
+	"container/list"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/lawnp/leafMQ/packets"
 )
 
 type TopicTree struct {
-	root *topicNode
+	root          *topicNode
+	retainedMu    sync.Mutex // serializes changes of retained messages
+	retainedOrder *list.List // retained messages, least recently stored first
+	retained      int64      // number of retained messages
+	retainedBytes int64      // size of the retained messages, see RetainedMessage.Size
 }
 
 func NewTopicTree() *TopicTree {
 	return &TopicTree{
-		root: newTopicNode(),
+		root:          newTopicNode(),
+		retainedOrder: list.New(),
 	}
 }
 
-func (t *TopicTree) Add(topic string, maxQoS byte, client *Client) *packets.Packet {
-	topicLevels := splitTopic(topic)
-	node := t.getTopicNode(topicLevels, t.root)
-	node.subscribers.add(client, maxQoS)
+// Add subscribes client to the topic filter and returns the retained messages matching it.
+// Shared subscriptions ($share/<group>/<filter>) add the client to the group instead
+// and never return retained messages.
+func (t *TopicTree) Add(topic string, opts packets.SubscriptionOptions, client *Client) []*RetainedMessage {
+	group, filter, shared := packets.ParseSharedSubscription(topic)
+	if !shared {
+		filter = topic
+	}
 
+	topicLevels := splitTopic(filter)
+	node := t.getTopicNode(topicLevels, t.root)
 	atomic.AddUint32(&client.Broker.Info.Subscriptions, 1)
-	return node.retained
+
+	if shared {
+		node.addShared(group, filter, client, opts)
+		return nil
+	}
+
+	node.subscribers.add(client, opts)
+	return t.Retained(filter)
 }
 
 func (t *TopicTree) Remove(topic string, client *Client) {
-	topicLevels := splitTopic(topic)
-	t.removeTopicRecursive(topicLevels, t.root, client)
+	group, filter, shared := packets.ParseSharedSubscription(topic)
+	if !shared {
+		filter = topic
+	}
+
+	topicLevels := splitTopic(filter)
+	t.removeTopicRecursive(topicLevels, t.root, client, group)
 
 	// subtract 1 from the number of subscriptions
 	// as per: https://pkg.go.dev/sync/atomic#AddUint32
@@ -57,14 +82,20 @@ func (t *TopicTree) getTopicNode(topicLevels []string, node *topicNode) *topicNo
 	return t.getTopicNode(topicLevels[1:], childNode)
 }
 
-func (t *TopicTree) removeTopicRecursive(topicLevels []string, node *topicNode, client *Client) {
+// removeTopicRecursive removes the client from the node of the topic levels.
+// If group is not empty, the client is removed from that shared subscription group.
+func (t *TopicTree) removeTopicRecursive(topicLevels []string, node *topicNode, client *Client, group string) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
 
 	if len(topicLevels) == 0 {
-		node.subscribers.remove(client)
+		if group != "" {
+			node.removeShared(group, client)
+		} else {
+			node.subscribers.remove(client)
+		}
 		// if there are no subscribers, no retained message and no children we can remove the node
-		if node.subscribers.Len() == 0 && node.retained == nil && len(node.children) == 0 {
+		if node.subscribers.Len() == 0 && len(node.shared) == 0 && node.retained == nil && len(node.children) == 0 {
 			node = nil
 		}
 		return
@@ -75,68 +106,89 @@ func (t *TopicTree) removeTopicRecursive(topicLevels []string, node *topicNode,
 	if !ok {
 		return
 	}
-	t.removeTopicRecursive(topicLevels[1:], childNode, client)
+	t.removeTopicRecursive(topicLevels[1:], childNode, client, group)
 }
 
+// GetSubscribers returns all subscribers with a topic filter matching the topic.
+// Shared subscription groups are returned unresolved, see Subscribers.selectShared.
 func (t *TopicTree) GetSubscribers(topic string) *Subscribers {
-
 	topicLevels := splitTopic(topic)
 	subscribers := newSubscribers()
 
-	node := t.root
-
-	for i := 0; i < len(topicLevels); i++ {
-		topicLevel := topicLevels[i]
-
-		node.mu.RLock()
-		defer node.mu.RUnlock()
-
-		subscribers.addMultiLevelWildCard(node)
-
-		if child, ok := node.children["+"]; ok {
-			subscribers.addSingleLevelWildCard(child, topicLevels[i+1:])
+	visit := func(node *topicNode) {
+		for client, opts := range node.subscribers.getAll() {
+			subscribers.add(client, opts)
 		}
-
-		childNode, ok := node.children[topicLevel]
-
-		if !ok {
-			break
+		for _, group := range node.shared {
+			subscribers.groups = append(subscribers.groups, group)
 		}
-
-		node = childNode
 	}
 
-	subscribers.addMultiLevelWildCard(node)
+	// topics beginning with $ are not matched by wildcards at the first level [MQTT-4.7.2-1]
+	if strings.HasPrefix(topic, "$") {
+		t.root.mu.RLock()
+		node, ok := t.root.children[topicLevels[0]]
+		t.root.mu.RUnlock()
 
-	for client, qos := range node.subscribers.getAll() {
-		subscribers.add(client, qos)
+		if ok {
+			t.matchNodes(node, topicLevels[1:], visit)
+		}
+		return subscribers
 	}
 
+	t.matchNodes(t.root, topicLevels, visit)
 	return subscribers
 }
 
-func (s *Subscribers) addMultiLevelWildCard(node *topicNode) {
+// matchNodes calls visit for every node whose topic filter matches the topic levels
+func (t *TopicTree) matchNodes(node *topicNode, topicLevels []string, visit func(*topicNode)) {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+
+	// "#" also matches the parent level [MQTT-4.7.1-2]
 	if child, ok := node.children["#"]; ok {
-		for client, qos := range child.subscribers.getAll() {
-			s.add(client, qos)
-		}
+		child.mu.RLock()
+		visit(child)
+		child.mu.RUnlock()
 	}
-}
 
-func (s *Subscribers) addSingleLevelWildCard(node *topicNode, topicLevels []string) {
-	for _, topicLevel := range topicLevels {
-		childNode, ok := node.children[topicLevel]
+	if len(topicLevels) == 0 {
+		visit(node)
+		return
+	}
 
-		if !ok {
-			return
-		}
+	if child, ok := node.children["+"]; ok {
+		t.matchNodes(child, topicLevels[1:], visit)
+	}
 
-		node = childNode
+	if child, ok := node.children[topicLevels[0]]; ok {
+		t.matchNodes(child, topicLevels[1:], visit)
 	}
+}
+
+// topicMatches reports whether the topic filter matches the topic name
+func topicMatches(filter string, topic string) bool {
+	filterLevels := splitTopic(filter)
+	topicLevels := splitTopic(topic)
 
-	for client, qos := range node.subscribers.getAll() {
-		s.add(client, qos)
+	// [MQTT-4.7.2-1]
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "#" || filterLevels[0] == "+") {
+		return false
 	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
 }
 
 func (t *TopicTree) GetAllTopics() []string {
@@ -153,6 +205,10 @@ func getAllTopicsRecursive(node *topicNode, topic string, topics *[]string) {
 		*topics = append(*topics, topic)
 	}
 
+	for group := range node.shared {
+		*topics = append(*topics, packets.SharedSubscriptionPrefix+group+"/"+topic)
+	}
+
 	for topicLevel, childNode := range node.children {
 		childNode.mu.RLock()
 		defer childNode.mu.RUnlock()
@@ -169,40 +225,116 @@ func (t *TopicTree) RemoveClientSubscriptions(client *Client) {
 	}
 }
 
-func (t *TopicTree) Retain(packet *packets.Packet) {
-	topicLevels := splitTopic(packet.PublishTopic)
-	t.getTopicNode(topicLevels, t.root).retained = packet
+// Retained returns the retained messages of the topics matching the topic filter, leaving out expired ones.
+// Only the branches of the tree the filter can match are visited.
+func (t *TopicTree) Retained(filter string) []*RetainedMessage {
+	var retained []*RetainedMessage
+	collectRetained(t.root, splitTopic(filter), true, time.Now(), &retained)
+	return retained
+}
+
+// collectRetained appends the retained messages below node matching the filter levels.
+// root is true for the root node, where wildcards don't match topics beginning with $ [MQTT-4.7.2-1].
+func collectRetained(node *topicNode, filterLevels []string, root bool, now time.Time, retained *[]*RetainedMessage) {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+
+	if len(filterLevels) == 0 {
+		node.appendRetained(now, retained)
+		return
+	}
+
+	switch level := filterLevels[0]; level {
+	case "#":
+		// "#" also matches the parent level [MQTT-4.7.1-2]
+		node.appendRetained(now, retained)
+		for name, child := range node.children {
+			if root && strings.HasPrefix(name, "$") {
+				continue
+			}
+			collectAllRetained(child, now, retained)
+		}
+	case "+":
+		for name, child := range node.children {
+			if root && strings.HasPrefix(name, "$") {
+				continue
+			}
+			collectRetained(child, filterLevels[1:], false, now, retained)
+		}
+	default:
+		if child, ok := node.children[level]; ok {
+			collectRetained(child, filterLevels[1:], false, now, retained)
+		}
+	}
+}
+
+// collectAllRetained appends every retained message of the subtree
+func collectAllRetained(node *topicNode, now time.Time, retained *[]*RetainedMessage) {
+	node.mu.RLock()
+	defer node.mu.RUnlock()
+
+	node.appendRetained(now, retained)
+	for _, child := range node.children {
+		collectAllRetained(child, now, retained)
+	}
+}
+
+// appendRetained appends the retained message of the node unless there is none or it expired,
+// called while holding the node lock
+func (n *topicNode) appendRetained(now time.Time, retained *[]*RetainedMessage) {
+	if n.retained != nil && !n.retained.expired(now) {
+		*retained = append(*retained, n.retained)
+	}
+}
+
+// findNode returns the node of the topic levels without creating it
+func (t *TopicTree) findNode(topicLevels []string) (*topicNode, bool) {
+	node := t.root
+	for _, level := range topicLevels {
+		node.mu.RLock()
+		child, ok := node.children[level]
+		node.mu.RUnlock()
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node, true
 }
 
 type topicNode struct {
 	mu          sync.RWMutex
-	children    map[string]*topicNode // all child nodes
-	subscribers *Subscribers          // array of client ids that are subscribed to this topic level
-	retained    *packets.Packet       // retained message
+	children    map[string]*topicNode   // all child nodes
+	subscribers *Subscribers            // array of client ids that are subscribed to this topic level
+	shared      map[string]*sharedGroup // shared subscription groups by share name
+	retained    *RetainedMessage        // retained message
 }
 
 func newTopicNode() *topicNode {
 	return &topicNode{
 		children:    make(map[string]*topicNode),
 		subscribers: newSubscribers(),
+		shared:      make(map[string]*sharedGroup),
 	}
 }
 
 type Subscribers struct {
 	mu      sync.RWMutex
-	clients map[*Client]byte
+	clients map[*Client]packets.SubscriptionOptions
+	groups  []*sharedGroup     // matching shared subscription groups, only set by GetSubscribers
+	shared  []sharedSubscriber // members of the groups picked by selectShared
 }
 
 func newSubscribers() *Subscribers {
 	return &Subscribers{
-		clients: make(map[*Client]byte),
+		clients: make(map[*Client]packets.SubscriptionOptions),
 	}
 }
 
-func (s *Subscribers) add(client *Client, maxQoS byte) {
+func (s *Subscribers) add(client *Client, opts packets.SubscriptionOptions) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.clients[client] = maxQoS
+	s.clients[client] = opts
 }
 
 func (s *Subscribers) remove(client *Client) {
@@ -211,7 +343,7 @@ func (s *Subscribers) remove(client *Client) {
 	delete(s.clients, client)
 }
 
-func (s *Subscribers) getAll() map[*Client]byte {
+func (s *Subscribers) getAll() map[*Client]packets.SubscriptionOptions {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.clients
@@ -223,19 +355,19 @@ func (s *Subscribers) Len() int {
 
 type Subscriptions struct {
 	mu     sync.RWMutex
-	topics map[string]byte
+	topics map[string]packets.SubscriptionOptions
 }
 
 func newSubscriptions() *Subscriptions {
 	return &Subscriptions{
-		topics: make(map[string]byte),
+		topics: make(map[string]packets.SubscriptionOptions),
 	}
 }
 
-func (s *Subscriptions) add(topic string, maxQoS byte) {
+func (s *Subscriptions) add(topic string, opts packets.SubscriptionOptions) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.topics[topic] = maxQoS
+	s.topics[topic] = opts
 }
 
 func (s *Subscriptions) remove(topic string) {
@@ -244,8 +376,26 @@ func (s *Subscriptions) remove(topic string) {
 	delete(s.topics, topic)
 }
 
-func (s *Subscriptions) getAll() map[string]byte {
+func (s *Subscriptions) getAll() map[string]packets.SubscriptionOptions {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.topics
 }
+
+// copy returns the topic filters and their options
+func (s *Subscriptions) copy() map[string]packets.SubscriptionOptions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topics := make(map[string]packets.SubscriptionOptions, len(s.topics))
+	for topic, opts := range s.topics {
+		topics[topic] = opts
+	}
+	return topics
+}
+
+func (s *Subscriptions) has(topic string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.topics[topic]
+	return ok
+}
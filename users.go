@@ -1,30 +1,171 @@
 package nixmq
 
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ErrInvalidPasswordFile struct {
+	Line   int
+	Reason string
+}
+
+func (e *ErrInvalidPasswordFile) Error() string {
+	return "invalid password file on line " + strconv.Itoa(e.Line) + ": " + e.Reason
+}
+
+// Users holds usernames and their password hashes, passwords are never kept in plain text
 type Users struct {
-	Users map[string]string
+	mu     sync.RWMutex
+	hashes map[string]string
 }
 
 func NewUsers() *Users {
 	return &Users{
-		Users: make(map[string]string),
+		hashes: make(map[string]string),
 	}
 }
 
-// testing purposes only
-func (u *Users) PopulateUsers() {
-	u.Add("admin", "admin")
-	u.Add("user", "user")
+// LoadPasswordFile reads users from a password file, see Users.Load for the format
+func LoadPasswordFile(path string) (*Users, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := NewUsers()
+	if err := users.Load(file); err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
-func (u *Users) Add(username, password string) {
-	u.Users[username] = password
+// Load replaces the users with the ones read from r. Every line holds a username and
+// a password hash separated by a colon, as written by Users.Write:
+//
+//	# comment
+//	alice:$2a$10$...
+//	bob:$argon2id$v=19$m=65536,t=3,p=4$...
+func (u *Users) Load(r io.Reader) error {
+	hashes := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" || hash == "" {
+			return &ErrInvalidPasswordFile{line, "expected username:hash"}
+		}
+		if _, ok := hashes[username]; ok {
+			return &ErrInvalidPasswordFile{line, "duplicate user " + username}
+		}
+		hashes[username] = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hashes = hashes
+	return nil
 }
 
+// Write writes the users in the password file format, ordered by username
+func (u *Users) Write(w io.Writer) error {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	usernames := make([]string, 0, len(u.hashes))
+	for username := range u.hashes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	bw := bufio.NewWriter(w)
+	for _, username := range usernames {
+		bw.WriteString(username + ":" + u.hashes[username] + "\n")
+	}
+	return bw.Flush()
+}
+
+// WriteFile replaces the password file at path, readable only by its owner
+func (u *Users) WriteFile(path string) error {
+	// written to a temporary file first so a failed write doesn't lose the existing users
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := u.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Add hashes the password with bcrypt and adds or replaces the user
+func (u *Users) Add(username, password string) error {
+	hash, err := HashPassword(password, Bcrypt)
+	if err != nil {
+		return err
+	}
+	u.AddHash(username, hash)
+	return nil
+}
+
+// AddHash adds or replaces the user with an already hashed password
+func (u *Users) AddHash(username, hash string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hashes[username] = hash
+}
+
+// Get returns the password hash of the user
 func (u *Users) Get(username string) (string, bool) {
-	password, ok := u.Users[username]
-	return password, ok
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	hash, ok := u.hashes[username]
+	return hash, ok
 }
 
 func (u *Users) Remove(username string) {
-	delete(u.Users, username)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.hashes, username)
+}
+
+func (u *Users) Len() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.hashes)
+}
+
+// Authenticate returns true if the user exists and the password matches its hash
+func (u *Users) Authenticate(username, password string) bool {
+	hash, ok := u.Get(username)
+	if !ok {
+		return false
+	}
+	return VerifyPassword(hash, password)
 }
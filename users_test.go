@@ -0,0 +1,61 @@
+package nixmq
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lawnp/leafMQ/packets"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestBroker_PasswordFile(t *testing.T) {
+	// hashed with few iterations to keep the test fast, the cost is read from the hash
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("alice's password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	salt := []byte("0123456789abcdef")
+	pbkdf2Hash := fmt.Sprintf("$7$1000$%s$%s", base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(pbkdf2.Key([]byte("bob's password"), salt, 1000, sha512.Size, sha512.New)))
+
+	path := filepath.Join(t.TempDir(), "passwd")
+	content := "# users\nalice:" + string(bcryptHash) + "\nbob:" + pbkdf2Hash + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+	users, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load password file: %v", err)
+	}
+
+	b, l := newTestBroker(t)
+	b.AllowAnonymous = false
+	b.Users = users
+
+	tests := []struct {
+		protocolVersion byte
+		username        string
+		password        string
+		code            byte
+	}{
+		{packets.MQTT311, "alice", "alice's password", packets.ACCEPTED.Code},
+		{packets.MQTT5, "bob", "bob's password", packets.ACCEPTED.Code},
+		{packets.MQTT311, "alice", "bob's password", packets.BAD_USERNAME_OR_PASSWORD.Code},
+		{packets.MQTT5, "bob", "alice's password", packets.BAD_USERNAME_OR_PASSWORD.V5().Code},
+		{packets.MQTT311, "mallory", "alice's password", packets.BAD_USERNAME_OR_PASSWORD.Code},
+		{packets.MQTT311, "", "", packets.BAD_USERNAME_OR_PASSWORD.Code},
+	}
+	for i, test := range tests {
+		options := connectOptions(test.protocolVersion, fmt.Sprintf("client-%d", i))
+		options.Username = test.username
+		options.Password = test.password
+		if connack := dial(t, l, test.protocolVersion).connect(options); connack.ReasonCode != test.code {
+			t.Errorf("Expected reason code 0x%02X for user %q, but got: 0x%02X", test.code, test.username, connack.ReasonCode)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package nixmq
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// actions sent to the webhook
+const (
+	WebhookConnect   = "connect"
+	WebhookPublish   = "publish"
+	WebhookSubscribe = "subscribe"
+)
+
+// WebhookRequest is the JSON body POSTed to the webhook
+type WebhookRequest struct {
+	Action      string `json:"action"`
+	ClientID    string `json:"client_id"`
+	Username    string `json:"username"`
+	Password    string `json:"password,omitempty"` // only sent with connect
+	PeerAddress string `json:"peer_address"`
+	Topic       string `json:"topic,omitempty"` // topic name of publish, topic filter or, with CheckDeliveries, topic of a delivered message of subscribe
+}
+
+// WebhookResponse is the JSON body the webhook answers with status 200
+type WebhookResponse struct {
+	Allow bool `json:"allow"`
+}
+
+// WebhookAuth is a hook delegating authentication and publish and subscribe authorization
+// to an HTTP endpoint. Publish authorization is an ACL check covering wills too, subscriptions
+// are authorized when they are made and the decision holds for the messages they deliver.
+// The endpoint answers with status 200 and a WebhookResponse, 401 and 403 deny the request.
+// Other answers and unreachable endpoints are failures, denied unless FailOpen is set.
+// Answers are cached for CacheTTL.
+type WebhookAuth struct {
+	HookBase
+	URL             string
+	Client          *http.Client  // client used for requests, its Timeout bounds each request
+	CacheTTL        time.Duration // how long answers are cached, 0 disables caching
+	MaxCacheEntries int           // answers cached, the oldest are evicted when full, 0 for no limit
+	FailOpen        bool          // allow requests when the webhook fails
+	// CheckDeliveries also asks the webhook about the topic of every message delivered to a client,
+	// including retained and $SYS messages. Deliveries wait for the answer unless it is cached.
+	CheckDeliveries bool
+
+	mu        sync.Mutex
+	cache     map[string]webhookAnswer
+	lastSweep time.Time
+}
+
+type webhookAnswer struct {
+	allow   bool
+	expires time.Time
+}
+
+// NewWebhookAuth creates a webhook hook with a 5 second request timeout and 1 minute cache of 10000 answers
+func NewWebhookAuth(url string) *WebhookAuth {
+	return &WebhookAuth{
+		URL:             url,
+		Client:          &http.Client{Timeout: 5 * time.Second},
+		CacheTTL:        time.Minute,
+		MaxCacheEntries: 10000,
+		cache:           make(map[string]webhookAnswer),
+	}
+}
+
+func (w *WebhookAuth) ID() string {
+	return "webhook-auth"
+}
+
+func (w *WebhookAuth) Provides(event HookEvent) bool {
+	return event == OnConnectAuthenticate || event == OnSubscribe || event == OnACLCheck
+}
+
+func (w *WebhookAuth) OnConnectAuthenticate(client *Client, packet *packets.Packet) bool {
+	return w.allowed(client, WebhookConnect, "")
+}
+
+// OnSubscribe asks the webhook whether the client may subscribe to each topic filter, refusing the denied ones
+func (w *WebhookAuth) OnSubscribe(client *Client, packet *packets.Packet) *packets.Packet {
+	for topic, code := range packet.Subscriptions.GetAll() {
+		if code < 0x80 && !w.allowed(client, WebhookSubscribe, topic) {
+			packet.Subscriptions.Subscriptions[topic] = client.refusedSubscriptionCode()
+		}
+	}
+	return packet
+}
+
+// OnACLCheck asks the webhook whether the client may publish to the topic, which also covers its will.
+// Reads were authorized by OnSubscribe, they are only asked about with CheckDeliveries.
+func (w *WebhookAuth) OnACLCheck(client *Client, topic string, write bool) bool {
+	if write {
+		return w.allowed(client, WebhookPublish, topic)
+	}
+	if !w.CheckDeliveries {
+		return true
+	}
+	return w.allowed(client, WebhookSubscribe, topic)
+}
+
+// allowed asks the webhook, or the cache, whether the client may perform the action
+func (w *WebhookAuth) allowed(client *Client, action string, topic string) bool {
+	// sessions restored from the store have no connection and no peer address
+	request := WebhookRequest{
+		Action:      action,
+		ClientID:    client.Properties.ClientID,
+		Username:    client.Properties.Username,
+		PeerAddress: client.PeerAddress,
+		Topic:       topic,
+	}
+	if action == WebhookConnect {
+		request.Password = client.Properties.Password
+	}
+
+	key := webhookCacheKey(request)
+	if allow, ok := w.cached(key); ok {
+		return allow
+	}
+
+	allow, err := w.post(request)
+	if err != nil {
+		client.Broker.Log.Println("Auth webhook failed:", err)
+		return w.FailOpen
+	}
+
+	w.store(key, allow)
+	return allow
+}
+
+func (w *WebhookAuth) post(request WebhookRequest) (bool, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return false, err
+	}
+
+	httpClient := w.Client
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var answer WebhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return false, err
+	}
+	return answer.Allow, nil
+}
+
+// webhookCacheKey identifies a request, the password is hashed so it isn't kept in memory.
+// Only the host of the peer address is used, as the port changes with every connection.
+func webhookCacheKey(request WebhookRequest) string {
+	password := sha256.Sum256([]byte(request.Password))
+	host, _, err := net.SplitHostPort(request.PeerAddress)
+	if err != nil {
+		host = request.PeerAddress
+	}
+	return request.Action + "\x00" + request.ClientID + "\x00" + request.Username + "\x00" +
+		hex.EncodeToString(password[:]) + "\x00" + host + "\x00" + request.Topic
+}
+
+func (w *WebhookAuth) cached(key string) (bool, bool) {
+	if w.CacheTTL <= 0 {
+		return false, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	answer, ok := w.cache[key]
+	if !ok || time.Now().After(answer.expires) {
+		return false, false
+	}
+	return answer.allow, true
+}
+
+func (w *WebhookAuth) store(key string, allow bool) {
+	if w.CacheTTL <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if w.cache == nil {
+		w.cache = make(map[string]webhookAnswer)
+	}
+
+	// expired answers are removed at most once per TTL
+	if now.Sub(w.lastSweep) > w.CacheTTL {
+		for k, answer := range w.cache {
+			if now.After(answer.expires) {
+				delete(w.cache, k)
+			}
+		}
+		w.lastSweep = now
+	}
+
+	// answers expire in the order they were cached, so the first to expire is the oldest
+	if _, ok := w.cache[key]; !ok && w.MaxCacheEntries > 0 && len(w.cache) >= w.MaxCacheEntries {
+		oldest := ""
+		for k, answer := range w.cache {
+			if oldest == "" || answer.expires.Before(w.cache[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(w.cache, oldest)
+	}
+
+	w.cache[key] = webhookAnswer{allow, now.Add(w.CacheTTL)}
+}
@@ -0,0 +1,249 @@
+package nixmq
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// webhookServer answers webhook requests with the decision of allow and records the requests
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []WebhookRequest
+}
+
+func newWebhookServer(t *testing.T, allow func(request WebhookRequest) bool) *webhookServer {
+	t.Helper()
+	s := &webhookServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, request)
+		s.mu.Unlock()
+		json.NewEncoder(w).Encode(WebhookResponse{Allow: allow(request)})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// count returns how many requests of the action were made for the topic
+func (s *webhookServer) count(action string, topic string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, request := range s.requests {
+		if request.Action == action && request.Topic == topic {
+			n++
+		}
+	}
+	return n
+}
+
+// newWebhookBroker returns a broker delegating authentication and authorization to the webhook server
+func newWebhookBroker(t *testing.T, server *webhookServer) (*Broker, *listeners.MemoryListener, *WebhookAuth) {
+	t.Helper()
+	b, l := newTestBroker(t)
+	b.AllowAnonymous = false
+	webhook := NewWebhookAuth(server.URL)
+	b.AddHook(webhook)
+	return b, l, webhook
+}
+
+// testWebhookPolicy allows users with password "secret" to connect, denies publishing to ok/denied
+// and reading ok/hidden, and allows everything else below ok/
+func testWebhookPolicy(request WebhookRequest) bool {
+	switch request.Action {
+	case WebhookConnect:
+		return request.Password == "secret"
+	case WebhookPublish:
+		return request.Topic != "ok/denied" && topicMatches("ok/#", request.Topic)
+	default:
+		return request.Topic == "ok/#" || (request.Topic != "ok/hidden" && topicMatches("ok/#", request.Topic))
+	}
+}
+
+func webhookOptions(protocolVersion byte, clientID string) *packets.ConnectOptions {
+	options := connectOptions(protocolVersion, clientID)
+	options.Username = clientID
+	options.Password = "secret"
+	return options
+}
+
+func TestWebhookAuth_Connect(t *testing.T) {
+	server := newWebhookServer(t, testWebhookPolicy)
+	_, l, _ := newWebhookBroker(t, server)
+
+	connect(t, l, webhookOptions(packets.MQTT311, "alice"))
+
+	options := webhookOptions(packets.MQTT311, "mallory")
+	options.Password = "guess"
+	if connack := dial(t, l, packets.MQTT311).connect(options); connack.ReasonCode != packets.BAD_USERNAME_OR_PASSWORD.Code {
+		t.Errorf("Expected the webhook to refuse the password, but got: 0x%02X", connack.ReasonCode)
+	}
+}
+
+func TestWebhookAuth_PublishAndSubscribe(t *testing.T) {
+	server := newWebhookServer(t, testWebhookPolicy)
+	_, l, webhook := newWebhookBroker(t, server)
+	webhook.CheckDeliveries = true
+
+	subscriber := connect(t, l, webhookOptions(packets.MQTT5, "subscriber"))
+	if suback := subscriber.subscribe(1, "ok/#", packets.SubscriptionOptions{QoS: 0}); suback.ReasonCodes[0] != 0 {
+		t.Fatalf("Expected subscription to be allowed, but got: 0x%02X", suback.ReasonCodes[0])
+	}
+	if suback := subscriber.subscribe(2, "secret/#", packets.SubscriptionOptions{QoS: 0}); suback.ReasonCodes[0] != packets.NOT_AUTHORIZED_V5.Code {
+		t.Errorf("Expected subscription to be refused, but got: 0x%02X", suback.ReasonCodes[0])
+	}
+
+	publisher := connect(t, l, webhookOptions(packets.MQTT5, "publisher"))
+	publisher.send(newPublish("ok/denied", "x", 1, false))
+	if puback := publisher.expect(packets.PUBACK); puback.ReasonCode != packets.NOT_AUTHORIZED_V5.Code {
+		t.Errorf("Expected publish to be refused, but got: 0x%02X", puback.ReasonCode)
+	}
+
+	// the subscriber may not read ok/hidden although its subscription covers it
+	publisher.publish("ok/hidden", "hidden", 0, false)
+	publisher.publish("ok/visible", "visible", 0, false)
+	subscriber.expectPublish("ok/visible", "visible")
+	subscriber.expectNothing(50 * time.Millisecond)
+}
+
+func TestWebhookAuth_SubscriptionCoversDeliveries(t *testing.T) {
+	server := newWebhookServer(t, func(request WebhookRequest) bool {
+		return request.Topic == SysPrefix+"#" || testWebhookPolicy(request)
+	})
+	b, l, _ := newWebhookBroker(t, server)
+
+	subscriber := connect(t, l, webhookOptions(packets.MQTT311, "subscriber"))
+	subscriber.subscribe(1, "ok/#", packets.SubscriptionOptions{QoS: 0})
+	subscriber.subscribe(2, SysPrefix+"#", packets.SubscriptionOptions{QoS: 0})
+
+	publisher := connect(t, l, webhookOptions(packets.MQTT311, "publisher"))
+	publisher.publish("ok/hidden", "hidden", 0, false)
+	subscriber.expectPublish("ok/hidden", "hidden")
+	b.publish(SysPrefix+"version", Version)
+	subscriber.expectPublish(SysPrefix+"version", Version)
+
+	// the subscriptions were authorized once, the deliveries don't wait for the webhook
+	if n := server.count(WebhookSubscribe, "ok/#"); n != 1 {
+		t.Errorf("Expected the webhook to be asked about the subscription once, but it was asked %d times", n)
+	}
+	if n := server.count(WebhookSubscribe, "ok/hidden") + server.count(WebhookSubscribe, SysPrefix+"version"); n != 0 {
+		t.Errorf("Expected the webhook not to be asked about deliveries, but it was asked %d times", n)
+	}
+}
+
+func TestWebhookAuth_Will(t *testing.T) {
+	server := newWebhookServer(t, testWebhookPolicy)
+	_, l, _ := newWebhookBroker(t, server)
+
+	subscriber := connect(t, l, webhookOptions(packets.MQTT311, "subscriber"))
+	subscriber.subscribe(1, "ok/#", packets.SubscriptionOptions{QoS: 0})
+
+	// the will is published to a topic the client may not publish to
+	options := webhookOptions(packets.MQTT311, "device")
+	options.WillTopic = "ok/denied"
+	options.WillMessage = "gone"
+	device := connect(t, l, options)
+	device.conn.Close()
+
+	subscriber.expectNothing(100 * time.Millisecond)
+	if server.count(WebhookPublish, "ok/denied") == 0 {
+		t.Errorf("Expected the webhook to be asked about the will")
+	}
+}
+
+func TestWebhookAuth_Cache(t *testing.T) {
+	server := newWebhookServer(t, testWebhookPolicy)
+	_, l, _ := newWebhookBroker(t, server)
+
+	publisher := connect(t, l, webhookOptions(packets.MQTT311, "publisher"))
+	for i := 0; i < 3; i++ {
+		publisher.publish("ok/x", "x", 1, false)
+	}
+	if n := server.count(WebhookPublish, "ok/x"); n != 1 {
+		t.Errorf("Expected the answer to be cached, but the webhook was asked %d times", n)
+	}
+}
+
+func TestWebhookAuth_CacheLimit(t *testing.T) {
+	server := newWebhookServer(t, testWebhookPolicy)
+	_, l, webhook := newWebhookBroker(t, server)
+	webhook.MaxCacheEntries = 2
+
+	// the connect answer is evicted first, then the answer for ok/a
+	publisher := connect(t, l, webhookOptions(packets.MQTT311, "publisher"))
+	for _, topic := range []string{"ok/a", "ok/b", "ok/c", "ok/b", "ok/a"} {
+		publisher.publish(topic, "x", 1, false)
+	}
+	if n := len(webhook.cache); n != 2 {
+		t.Errorf("Expected 2 cached answers, but got %d", n)
+	}
+	if a, b := server.count(WebhookPublish, "ok/a"), server.count(WebhookPublish, "ok/b"); a != 2 || b != 1 {
+		t.Errorf("Expected the oldest answer to be evicted, but the webhook was asked %d times about ok/a and %d about ok/b", a, b)
+	}
+}
+
+func TestWebhookAuth_Failure(t *testing.T) {
+	server := newWebhookServer(t, testWebhookPolicy)
+	server.Close()
+
+	_, l, webhook := newWebhookBroker(t, server)
+	if connack := dial(t, l, packets.MQTT311).connect(webhookOptions(packets.MQTT311, "alice")); connack.ReasonCode == packets.ACCEPTED.Code {
+		t.Errorf("Expected clients to be refused when the webhook fails")
+	}
+
+	webhook.FailOpen = true
+	connect(t, l, webhookOptions(packets.MQTT311, "alice"))
+}
+
+func TestWebhookAuth_RestoredSession(t *testing.T) {
+	server := newWebhookServer(t, testWebhookPolicy)
+	path := filepath.Join(t.TempDir(), "store.log")
+	newStoredWebhookBroker := func() (*Broker, *listeners.MemoryListener) {
+		b, l := newStoredBroker(t, path)
+		b.AllowAnonymous = false
+		webhook := NewWebhookAuth(server.URL)
+		webhook.CheckDeliveries = true
+		b.AddHook(webhook)
+		return b, l
+	}
+
+	b, l := newStoredWebhookBroker()
+	options := webhookOptions(packets.MQTT311, "persistent")
+	options.CleanSession = false
+	c := connect(t, l, options)
+	c.subscribe(1, "ok/#", packets.SubscriptionOptions{QoS: 1})
+	c.conn.Close()
+	eventually(t, func() bool {
+		client, ok := b.clients.Get("persistent")
+		return ok && client.isClosed.Load()
+	}, "Expected the client to be disconnected")
+	b.Close()
+
+	// the restored session has no connection, the webhook is asked about the delivery without a peer address
+	b, l = newStoredWebhookBroker()
+	connect(t, l, webhookOptions(packets.MQTT311, "publisher")).publish("ok/x", "queued", 1, false)
+	eventually(t, func() bool {
+		client, _ := b.clients.Get("persistent")
+		return client.Session.QueueLen() == 1
+	}, "Expected the message to be queued")
+
+	c = dial(t, l, packets.MQTT311)
+	if connack := c.connect(options); connack.ReasonCode != packets.ACCEPTED.Code || !connack.SessionPresent {
+		t.Fatalf("Expected the restored session to be present, but got: 0x%02X", connack.ReasonCode)
+	}
+	c.ack(c.expectPublish("ok/x", "queued"))
+}
@@ -0,0 +1,69 @@
+package nixmq
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lawnp/leafMQ/listeners"
+	"github.com/lawnp/leafMQ/packets"
+)
+
+// readWebsocketPacket reads the next packet the broker sends over the websocket connection
+func readWebsocketPacket(t *testing.T, conn *websocket.Conn) *packets.Packet {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Fatalf("Expected a binary message, but got type %d", messageType)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	fixedHeader, err := packets.DecodeFixedHeader(reader)
+	if err != nil {
+		t.Fatalf("Failed to decode fixed header: %v", err)
+	}
+	packet, err := packets.ParsePacket(fixedHeader, reader, packets.MQTT311)
+	if err != nil {
+		t.Fatalf("Failed to parse packet: %v", err)
+	}
+	return packet
+}
+
+func TestBroker_Websocket(t *testing.T) {
+	b, _ := newTestBroker(t)
+	l := listeners.NewWebsocket("127.0.0.1", "18085", "/mqtt")
+	b.AddListener(l)
+	go l.Serve(b.bindListener(l.ID()))
+	time.Sleep(100 * time.Millisecond)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	conn, _, err := dialer.Dial("ws://127.0.0.1:18085/mqtt", nil)
+	if err != nil {
+		t.Fatalf("Failed to establish connection: %v", err)
+	}
+	defer conn.Close()
+
+	// a packet may be split across websocket messages
+	connect := connectOptions(packets.MQTT311, "websocket").Encode()
+	for _, part := range [][]byte{connect[:5], connect[5:]} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, part); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if connack := readWebsocketPacket(t, conn); connack.FixedHeader.MessageType != packets.CONNACK || connack.ReasonCode != packets.ACCEPTED.Code {
+		t.Fatalf("Expected accepted CONNACK, but got %s with 0x%02X", packets.PacketName(connack.FixedHeader.MessageType), connack.ReasonCode)
+	}
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{0xC0, 0x00}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if pingresp := readWebsocketPacket(t, conn); pingresp.FixedHeader.MessageType != packets.PINGRES {
+		t.Errorf("Expected PINGRESP, but got %s", packets.PacketName(pingresp.FixedHeader.MessageType))
+	}
+}